@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github/similadayo/chitchat/config"
+	"github/similadayo/chitchat/controller"
+	"github/similadayo/chitchat/utils"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const keysUsage = `Usage:
+  chitchat keys list
+  chitchat keys rotate [-alg HS256|RS256|EdDSA] [-activate-in 10m]
+  chitchat keys retire <kid|legacy>`
+
+// runKeys manages the JWT signing keys. Running servers pick up changes
+// within KEY_REFRESH. Rotated keys are encrypted with JWT_KEY_ENCRYPTION_KEY,
+// which the servers need to load them.
+func runKeys(db *gorm.DB, args []string) {
+	if len(args) == 0 {
+		log.Fatal(keysUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		keys, err := controller.ListKeys(db)
+		if err != nil {
+			log.Fatalf("Could not list the keys: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KID\tALGORITHM\tACTIVATES\tRETIRED")
+		for _, key := range keys {
+			retired := "-"
+			if key.RetiredAt != nil {
+				retired = key.RetiredAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.Kid, key.Algorithm, key.ActivatesAt.Format(time.RFC3339), retired)
+		}
+		w.Flush()
+
+	case "rotate":
+		flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+		// Publishing the key before it signs gives verifiers time to
+		// refresh their cached JWKS
+		algorithm := flags.String("alg", utils.AlgEdDSA, "signing algorithm: HS256, RS256 or EdDSA")
+		activateIn := flags.Duration("activate-in", 10*time.Minute, "how long to publish the key before it starts signing")
+		flags.Parse(args[1:])
+
+		key, err := controller.RotateKey(db, config.LoadAuthConfig().KeyEncryptionKey, *algorithm, *activateIn)
+		if err != nil {
+			log.Fatalf("Could not rotate the key: %v", err)
+		}
+		fmt.Printf("Created %s key %s, signing from %s\n", key.Algorithm, key.Kid, key.ActivatesAt.Format(time.RFC3339))
+		fmt.Println("Retire the previous key once the access tokens it signed have expired")
+
+	case "retire":
+		if len(args) != 2 {
+			log.Fatal(keysUsage)
+		}
+		if err := controller.RetireKey(db, args[1]); err != nil {
+			log.Fatalf("Could not retire the key: %v", err)
+		}
+		fmt.Printf("Retired key %s\n", args[1])
+
+	default:
+		log.Fatal(keysUsage)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github/similadayo/chitchat/routes"
 	"log"
 	"net/http"
+	"os"
 )
 
 func main() {
@@ -15,9 +16,15 @@ func main() {
 
 	config.MigrateDB(db)
 
+	// "keys" manages the JWT signing keys instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		runKeys(db, os.Args[2:])
+		return
+	}
+
 	log.Println("Successfully connected to the database")
 
-	r := routes.InitRoutes()
+	r := routes.InitRoutes(db)
 
 	log.Println("Server is running on port 8080")
 	if err := http.ListenAndServe(":8080", r); err != nil {
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"encoding/base64"
+	"github/similadayo/chitchat/utils"
+	"log"
+	"os"
+)
+
+// LoadAuthConfig reads the token settings from the environment, falling
+// back to the defaults for anything unset
+func LoadAuthConfig() utils.AuthConfig {
+	LoadEnv()
+
+	cfg := utils.DefaultAuthConfig()
+	cfg.AccessTokenTTL = durationEnv("ACCESS_TOKEN_TTL", cfg.AccessTokenTTL)
+	cfg.RefreshTokenTTL = durationEnv("REFRESH_TOKEN_TTL", cfg.RefreshTokenTTL)
+	cfg.RevocationRefresh = durationEnv("REVOCATION_REFRESH", cfg.RevocationRefresh)
+	cfg.SessionTouchInterval = durationEnv("SESSION_TOUCH_INTERVAL", cfg.SessionTouchInterval)
+	cfg.KeyRefresh = durationEnv("KEY_REFRESH", cfg.KeyRefresh)
+	cfg.JWTSecret = []byte(os.Getenv("JWT_KEY"))
+
+	// JWT_KEY_ENCRYPTION_KEY is a base64 encoded AES-256 key, such as the
+	// output of "openssl rand -base64 32"
+	if encoded := os.Getenv("JWT_KEY_ENCRYPTION_KEY"); encoded != "" {
+		kek, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(kek) != utils.KeyEncryptionKeySize {
+			log.Fatalf("JWT_KEY_ENCRYPTION_KEY must be %d base64 encoded bytes", utils.KeyEncryptionKeySize)
+		}
+		cfg.KeyEncryptionKey = kek
+	}
+
+	if cfg.AccessTokenTTL <= 0 || cfg.RevocationRefresh <= 0 || cfg.SessionTouchInterval <= 0 || cfg.KeyRefresh <= 0 {
+		log.Fatalf("ACCESS_TOKEN_TTL, REVOCATION_REFRESH, SESSION_TOUCH_INTERVAL and KEY_REFRESH must be positive")
+	}
+	if cfg.RefreshTokenTTL <= cfg.AccessTokenTTL {
+		log.Fatalf("REFRESH_TOKEN_TTL (%s) must be longer than ACCESS_TOKEN_TTL (%s)", cfg.RefreshTokenTTL, cfg.AccessTokenTTL)
+	}
+
+	return cfg
+}
@@ -7,22 +7,33 @@ import (
 	"os"
 
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-// ConnectDB establishes a connection to the database
+// ConnectDB establishes a connection to the database. DB_DRIVER selects
+// mysql (the default) or sqlite, in which case DB_NAME is the database file.
 func ConnectDB() (*gorm.DB, error) {
 	LoadEnv()
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_NAME"),
-	)
+	var dialector gorm.Dialector
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", "mysql":
+		dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+			os.Getenv("DB_USER"),
+			os.Getenv("DB_PASSWORD"),
+			os.Getenv("DB_HOST"),
+			os.Getenv("DB_PORT"),
+			os.Getenv("DB_NAME"),
+		)
+		dialector = mysql.Open(dsn)
+	case "sqlite":
+		dialector = sqlite.Open(os.Getenv("DB_NAME"))
+	default:
+		return nil, fmt.Errorf("unsupported DB_DRIVER %q", driver)
+	}
 
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
@@ -33,7 +44,7 @@ func ConnectDB() (*gorm.DB, error) {
 // MigrateDB performs database migration
 func MigrateDB(db *gorm.DB) {
 
-	err := db.AutoMigrate(&models.User{}, &models.Message{})
+	err := db.AutoMigrate(&models.User{}, &models.Message{}, &models.Group{}, &models.GroupMember{}, &models.GroupAuditLog{}, &models.MessageRevision{}, &models.HiddenMessage{}, &models.ReadWatermark{}, &models.ConversationSetting{}, &models.Reaction{}, &models.Attachment{}, &models.AttachmentVariant{}, &models.UserBlock{}, &models.TokenRevocation{}, &models.RefreshToken{}, &models.Session{}, &models.SigningKey{})
 	if err != nil {
 		log.Fatalf("Error migrating database: %v", err)
 	}
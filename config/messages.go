@@ -0,0 +1,9 @@
+package config
+
+import "time"
+
+// MessageEditWindow returns how long after sending a message its sender may
+// still edit it, from MESSAGE_EDIT_WINDOW (e.g. "15m")
+func MessageEditWindow() time.Duration {
+	return durationEnv("MESSAGE_EDIT_WINDOW", 15*time.Minute)
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"crypto/rand"
+	"github/similadayo/chitchat/utils"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LoadStorageConfig reads the attachment storage settings from the
+// environment, falling back to the defaults for anything unset
+func LoadStorageConfig() utils.StorageConfig {
+	LoadEnv()
+
+	cfg := utils.DefaultStorageConfig()
+	if driver := os.Getenv("STORAGE_DRIVER"); driver != "" {
+		cfg.Driver = driver
+	}
+	if dir := os.Getenv("STORAGE_DIR"); dir != "" {
+		cfg.LocalDir = dir
+	}
+	cfg.S3.Endpoint = os.Getenv("S3_ENDPOINT")
+	cfg.S3.Bucket = os.Getenv("S3_BUCKET")
+	cfg.S3.AccessKey = os.Getenv("S3_ACCESS_KEY")
+	cfg.S3.SecretKey = os.Getenv("S3_SECRET_KEY")
+	if region := os.Getenv("S3_REGION"); region != "" {
+		cfg.S3.Region = region
+	}
+
+	cfg.MaxUploadSize = int64(intEnv("MAX_UPLOAD_SIZE", int(cfg.MaxUploadSize)))
+	cfg.MaxAvatarSize = int64(intEnv("MAX_AVATAR_SIZE", int(cfg.MaxAvatarSize)))
+	cfg.URLTTL = durationEnv("STORAGE_URL_TTL", cfg.URLTTL)
+
+	cfg.URLSecret = []byte(os.Getenv("STORAGE_URL_SECRET"))
+	if len(cfg.URLSecret) == 0 {
+		// Links then stop working when the server restarts
+		cfg.URLSecret = make([]byte, 32)
+		if _, err := rand.Read(cfg.URLSecret); err != nil {
+			log.Fatalf("Error generating STORAGE_URL_SECRET: %v", err)
+		}
+		log.Printf("STORAGE_URL_SECRET is not set, download links won't survive a restart")
+	}
+
+	if cfg.MaxUploadSize < 1 || cfg.MaxAvatarSize < 1 {
+		log.Fatalf("MAX_UPLOAD_SIZE and MAX_AVATAR_SIZE must be positive")
+	}
+
+	return cfg
+}
+
+// LoadMediaConfig reads the image processing settings from the environment.
+// THUMBNAIL_SIZES is a comma-separated list such as "160,480,1080".
+func LoadMediaConfig() utils.MediaConfig {
+	LoadEnv()
+
+	cfg := utils.DefaultMediaConfig()
+	cfg.Workers = intEnv("MEDIA_WORKERS", cfg.Workers)
+	cfg.QueueSize = intEnv("MEDIA_QUEUE_SIZE", cfg.QueueSize)
+	cfg.MaxPixels = intEnv("MEDIA_MAX_PIXELS", cfg.MaxPixels)
+
+	if value := os.Getenv("THUMBNAIL_SIZES"); value != "" {
+		cfg.ThumbnailSizes = nil
+		for _, field := range strings.Split(value, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || size < 1 {
+				log.Fatalf("Invalid THUMBNAIL_SIZES %q", value)
+			}
+			cfg.ThumbnailSizes = append(cfg.ThumbnailSizes, size)
+		}
+		sort.Ints(cfg.ThumbnailSizes)
+	}
+
+	if cfg.Workers < 1 || cfg.QueueSize < 1 || cfg.MaxPixels < 1 {
+		log.Fatalf("MEDIA_WORKERS, MEDIA_QUEUE_SIZE and MEDIA_MAX_PIXELS must be positive")
+	}
+
+	return cfg
+}
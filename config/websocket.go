@@ -0,0 +1,68 @@
+package config
+
+import (
+	"github/similadayo/chitchat/utils"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// LoadWebSocketConfig reads the websocket settings from the environment,
+// falling back to the defaults for anything unset
+func LoadWebSocketConfig() utils.WebSocketConfig {
+	LoadEnv()
+
+	cfg := utils.DefaultWebSocketConfig()
+	cfg.PingInterval = durationEnv("WS_PING_INTERVAL", cfg.PingInterval)
+	cfg.PongWait = durationEnv("WS_PONG_WAIT", cfg.PongWait)
+	cfg.WriteTimeout = durationEnv("WS_WRITE_TIMEOUT", cfg.WriteTimeout)
+	cfg.MaxMessageSize = int64(intEnv("WS_MAX_MESSAGE_SIZE", int(cfg.MaxMessageSize)))
+	cfg.SendQueueSize = intEnv("WS_SEND_QUEUE_SIZE", cfg.SendQueueSize)
+	cfg.OfflineQueueSize = intEnv("WS_OFFLINE_QUEUE_SIZE", cfg.OfflineQueueSize)
+
+	if name := os.Getenv("WS_SLOW_CONSUMER_POLICY"); name != "" {
+		policy, err := utils.ParseSlowConsumerPolicy(name)
+		if err != nil {
+			log.Fatalf("Invalid WS_SLOW_CONSUMER_POLICY: %v", err)
+		}
+		cfg.SlowConsumerPolicy = policy
+	}
+
+	if cfg.PingInterval >= cfg.PongWait {
+		log.Fatalf("WS_PING_INTERVAL (%s) must be shorter than WS_PONG_WAIT (%s)", cfg.PingInterval, cfg.PongWait)
+	}
+	if cfg.SendQueueSize < 1 {
+		log.Fatalf("WS_SEND_QUEUE_SIZE must be at least 1")
+	}
+
+	return cfg
+}
+
+// durationEnv parses a duration such as "30s" from the environment
+func durationEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid duration for %s: %v", key, err)
+	}
+	return d
+}
+
+// intEnv parses an integer from the environment
+func intEnv(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid integer for %s: %v", key, err)
+	}
+	return i
+}
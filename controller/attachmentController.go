@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// multipartOverhead is allowed on top of the file size for the boundaries
+// and part headers of an upload request
+const multipartOverhead = 64 << 10
+
+var errNoFilePart = errors.New("the request has no file part")
+
+type AttachmentController struct {
+	DB          *gorm.DB
+	Attachments *AttachmentService
+}
+
+// NewAttachmentController creates a new attachment controller
+func NewAttachmentController(attachments *AttachmentService) *AttachmentController {
+	return &AttachmentController{DB: attachments.DB, Attachments: attachments}
+}
+
+// UploadAttachment streams the "file" part of a multipart request into
+// storage. The returned ID goes in attachment_ids when sending a message.
+func (ac *AttachmentController) UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(ac.DB, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, ac.Attachments.Config.MaxUploadSize+multipartOverhead)
+	part, err := multipartFile(r, "file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer part.Close()
+
+	attachment, err := ac.Attachments.Store(r.Context(), user.ID, models.AttachmentMessage, part.FileName(), part)
+	if err != nil {
+		http.Error(w, err.Error(), attachmentErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusCreated, attachment)
+}
+
+// GetAttachment downloads an attachment the user may see
+func (ac *AttachmentController) GetAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := ac.findAttachment(w, r)
+	if !ok {
+		return
+	}
+	ac.serve(w, r, attachment, 0)
+}
+
+// GetThumbnail downloads the thumbnail of an image attachment whose longest
+// side fits {size}
+func (ac *AttachmentController) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := ac.findAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	size, err := strconv.Atoi(mux.Vars(r)["size"])
+	if err != nil {
+		http.Error(w, "Invalid thumbnail size", http.StatusBadRequest)
+		return
+	}
+	ac.serve(w, r, attachment, size)
+}
+
+// GetAttachmentLink returns a signed download link for the attachment, or
+// for one of its thumbnails with ?size=, for clients that can't send the
+// Authorization header such as <img> tags
+func (ac *AttachmentController) GetAttachmentLink(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := ac.findAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	size, err := thumbnailSize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if size != 0 {
+		if _, err := variant(attachment, size); err != nil {
+			http.Error(w, err.Error(), attachmentErrorStatus(err))
+			return
+		}
+	}
+
+	url, expires := ac.Attachments.SignedURL(attachment, size)
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"url":        url,
+		"expires_at": expires,
+	})
+}
+
+// GetSignedFile downloads an attachment through a signed link
+func (ac *AttachmentController) GetSignedFile(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return
+	}
+
+	size, err := thumbnailSize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	attachment, err := ac.Attachments.VerifyLink(id, size, query.Get("expires"), query.Get("signature"))
+	if err != nil {
+		http.Error(w, err.Error(), attachmentErrorStatus(err))
+		return
+	}
+	ac.serve(w, r, attachment, size)
+}
+
+// thumbnailSize parses the optional size query parameter
+func thumbnailSize(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("size")
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 {
+		return 0, errors.New("size must be a positive number")
+	}
+	return size, nil
+}
+
+// findAttachment loads the {id} attachment for the current user, writing
+// the error response when it can't
+func (ac *AttachmentController) findAttachment(w http.ResponseWriter, r *http.Request) (*models.Attachment, bool) {
+	user, err := currentUser(ac.DB, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	id, err := pathID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	attachment, err := ac.Attachments.Find(user.ID, id)
+	if err != nil {
+		http.Error(w, err.Error(), attachmentErrorStatus(err))
+		return nil, false
+	}
+	return attachment, true
+}
+
+// serve streams the attachment, or its thumbnail of the given size, from
+// storage. Objects never change under their key, so the key doubles as a
+// strong ETag.
+func (ac *AttachmentController) serve(w http.ResponseWriter, r *http.Request, attachment *models.Attachment, size int) {
+	key, contentType, length, fileName := attachment.Key, attachment.ContentType, attachment.Size, attachment.FileName
+	if size != 0 {
+		thumbnail, err := variant(attachment, size)
+		if err != nil {
+			http.Error(w, err.Error(), attachmentErrorStatus(err))
+			return
+		}
+		key, contentType, length, fileName = thumbnail.Key, thumbnail.ContentType, thumbnail.Bytes, ""
+	}
+
+	etag := `"` + path.Base(key) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, err := ac.Attachments.Storage.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, utils.ErrObjectNotFound) {
+			http.Error(w, ErrAttachmentNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Could not read the attachment", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	// Only images are shown inline; anything else is a download so
+	// uploaded HTML can't run in the app's origin
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	if fileName != "" {
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": fileName})
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		// The status is already sent, so a failed copy can only be logged
+		if _, err := io.Copy(w, body); err != nil {
+			log.Printf("Error streaming attachment %d: %v", attachment.ID, err)
+		}
+	}
+}
+
+// multipartFile returns the named file part of a multipart request without
+// buffering the parts before it
+func multipartFile(r *http.Request, field string) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errNoFilePart
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == field && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
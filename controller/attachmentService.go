@@ -0,0 +1,340 @@
+package controller
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github/similadayo/chitchat/config"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// maxMessageAttachments caps how many uploads one message may carry
+const maxMessageAttachments = 10
+
+var (
+	ErrAttachmentTooLarge = errors.New("file is too large")
+	ErrEmptyAttachment    = errors.New("file is empty")
+	ErrNotAnImage         = errors.New("file must be an image")
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrInvalidAttachment  = errors.New("attachments must be up to 10 of your own unsent uploads")
+	ErrInvalidLink        = errors.New("download link is invalid or has expired")
+	ErrThumbnailNotFound  = errors.New("thumbnail not found")
+)
+
+// attachmentErrorStatus maps attachment errors to HTTP status codes
+func attachmentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrAttachmentTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrNotAnImage):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrEmptyAttachment):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrAttachmentNotFound), errors.Is(err, ErrThumbnailNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidLink):
+		return http.StatusForbidden
+	}
+	return messageErrorStatus(err)
+}
+
+// AttachmentService streams uploads into storage and decides who may
+// download them. Images are handed to the media processor afterwards.
+type AttachmentService struct {
+	DB      *gorm.DB
+	Storage utils.Storage
+	Config  utils.StorageConfig
+	Media   *MediaProcessor
+}
+
+// NewAttachmentService creates the service with the configured storage
+// backend. It is shared by the controllers that accept uploads; call
+// Media.Start to begin processing images.
+func NewAttachmentService(db *gorm.DB, hub *utils.Hub) *AttachmentService {
+	cfg := config.LoadStorageConfig()
+	storage, err := utils.NewStorage(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	return &AttachmentService{
+		DB:      db,
+		Storage: storage,
+		Config:  cfg,
+		Media:   NewMediaProcessor(db, hub, storage, config.LoadMediaConfig()),
+	}
+}
+
+// maxSize is the upload limit for the purpose
+func (as *AttachmentService) maxSize(purpose string) int64 {
+	if purpose == models.AttachmentAvatar {
+		return as.Config.MaxAvatarSize
+	}
+	return as.Config.MaxUploadSize
+}
+
+// Upload streams a file into storage and returns its unsaved record. The
+// content is spooled to a temporary file while it is hashed, so the key is
+// known before anything reaches storage and identical files are stored once.
+// The content type is sniffed from the bytes; the client's claim is ignored.
+// GPS coordinates are erased from image metadata before the file is stored,
+// and images are marked pending for the media processor.
+func (as *AttachmentService) Upload(ctx context.Context, purpose, fileName string, r io.Reader) (*models.Attachment, error) {
+	limit := as.maxSize(purpose)
+
+	tmp, err := os.CreateTemp("", "chitchat-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, limit+1))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, ErrAttachmentTooLarge
+		}
+		return nil, err
+	}
+	if size > limit {
+		return nil, ErrAttachmentTooLarge
+	}
+	if size == 0 {
+		return nil, ErrEmptyAttachment
+	}
+
+	head := make([]byte, 512)
+	n, err := tmp.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if purpose == models.AttachmentAvatar && !strings.HasPrefix(contentType, "image/") {
+		return nil, ErrNotAnImage
+	}
+
+	scrubbed, err := utils.ScrubGPS(tmp, contentType)
+	if err != nil {
+		return nil, err
+	}
+	if scrubbed {
+		// The key must address the stored bytes, not the uploaded ones
+		hash.Reset()
+		if _, err := io.Copy(hash, io.NewSectionReader(tmp, 0, size)); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	key := "sha256/" + sum[:2] + "/" + sum[2:4] + "/" + sum
+
+	exists, err := as.Storage.Exists(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := as.Storage.Put(ctx, key, tmp, size, contentType); err != nil {
+			return nil, err
+		}
+	}
+
+	attachment := &models.Attachment{
+		Key:         key,
+		Purpose:     purpose,
+		FileName:    cleanFileName(fileName),
+		ContentType: contentType,
+		Size:        size,
+	}
+	if processable(contentType) {
+		attachment.MediaStatus = models.MediaPending
+	}
+	return attachment, nil
+}
+
+// Store uploads a file and records it for the uploader
+func (as *AttachmentService) Store(ctx context.Context, uploaderID uint, purpose, fileName string, r io.Reader) (*models.Attachment, error) {
+	attachment, err := as.Upload(ctx, purpose, fileName, r)
+	if err != nil {
+		return nil, err
+	}
+	attachment.UploaderID = uploaderID
+	if err := as.DB.Create(attachment).Error; err != nil {
+		return nil, err
+	}
+	as.Process(attachment)
+	return attachment, nil
+}
+
+// Process queues a saved attachment for the media processor if it is an
+// image waiting for thumbnails
+func (as *AttachmentService) Process(attachment *models.Attachment) {
+	if attachment.MediaStatus == models.MediaPending && as.Media != nil {
+		as.Media.Enqueue(attachment.ID)
+	}
+}
+
+// cleanFileName keeps the base name of an uploaded file without control
+// characters, for display and Content-Disposition only
+func cleanFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" {
+		return ""
+	}
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	return name
+}
+
+// Find loads an attachment the user may download. Uploaders can always
+// fetch their files, avatars are visible to every signed-in user and
+// message attachments to whoever can see the message.
+func (as *AttachmentService) Find(userID, id uint) (*models.Attachment, error) {
+	var attachment models.Attachment
+	if err := as.DB.Preload("Variants").First(&attachment, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+
+	if attachment.UploaderID == userID || attachment.Purpose == models.AttachmentAvatar {
+		return &attachment, nil
+	}
+	if attachment.MessageID == nil {
+		return nil, ErrAttachmentNotFound
+	}
+
+	var message models.Message
+	if err := as.DB.First(&message, *attachment.MessageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	visible, err := canViewMessage(as.DB, userID, &message)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, ErrAttachmentNotFound
+	}
+	return &attachment, nil
+}
+
+// SignedURL returns a link to the attachment, or to its thumbnail of the
+// given size when size isn't 0, that works without a token until it expires
+func (as *AttachmentService) SignedURL(attachment *models.Attachment, size int) (string, time.Time) {
+	expires := time.Now().Add(as.Config.URLTTL).Truncate(time.Second)
+	signature := as.sign(attachment.ID, size, expires.Unix())
+
+	link := fmt.Sprintf("/files/%d?expires=%d&signature=%s", attachment.ID, expires.Unix(), signature)
+	if size != 0 {
+		link += fmt.Sprintf("&size=%d", size)
+	}
+	return link, expires
+}
+
+// VerifyLink checks the expiry and signature of a signed link and loads its
+// attachment
+func (as *AttachmentService) VerifyLink(id uint, size int, expires, signature string) (*models.Attachment, error) {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, ErrInvalidLink
+	}
+	if !hmac.Equal([]byte(signature), []byte(as.sign(id, size, expiresAt))) {
+		return nil, ErrInvalidLink
+	}
+
+	var attachment models.Attachment
+	if err := as.DB.Preload("Variants").First(&attachment, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+func (as *AttachmentService) sign(id uint, size int, expires int64) string {
+	mac := hmac.New(sha256.New, as.Config.URLSecret)
+	fmt.Fprintf(mac, "%d:%d:%d", id, size, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// variant returns the thumbnail of the given size
+func variant(attachment *models.Attachment, size int) (*models.AttachmentVariant, error) {
+	for i := range attachment.Variants {
+		if attachment.Variants[i].Size == size {
+			return &attachment.Variants[i], nil
+		}
+	}
+	return nil, ErrThumbnailNotFound
+}
+
+// linkAttachments checks that the IDs name the sender's own unsent message
+// uploads and attaches them to the stored message
+func linkAttachments(tx *gorm.DB, senderID uint, message *models.Message, ids []uint) error {
+	var attachments []models.Attachment
+	if err := tx.Preload("Variants").Where("id IN ? AND uploader_id = ? AND purpose = ? AND message_id IS NULL",
+		ids, senderID, models.AttachmentMessage).Order("id").Find(&attachments).Error; err != nil {
+		return err
+	}
+	if len(attachments) != len(ids) {
+		return ErrInvalidAttachment
+	}
+
+	// Guard against the same upload being sent twice at once
+	result := tx.Model(&models.Attachment{}).Where("id IN ? AND message_id IS NULL", ids).
+		Update("message_id", message.ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != int64(len(ids)) {
+		return ErrInvalidAttachment
+	}
+
+	for i := range attachments {
+		attachments[i].MessageID = &message.ID
+	}
+	message.Attachments = attachments
+	return nil
+}
+
+// uniqueIDs drops repeated IDs, keeping the first occurrence
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	unique := ids[:0:0]
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
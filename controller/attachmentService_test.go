@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// testPNG is the start of a PNG file, enough for content sniffing
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// newTestAttachments stores uploads in a temporary directory
+func newTestAttachments(t *testing.T, db *gorm.DB) *AttachmentService {
+	t.Helper()
+	storage, err := utils.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := utils.DefaultStorageConfig()
+	cfg.URLSecret = []byte("secret")
+	return &AttachmentService{DB: db, Storage: storage, Config: cfg}
+}
+
+// storeTestFile uploads content as a message attachment of the user
+func storeTestFile(t *testing.T, as *AttachmentService, user models.User, content []byte) *models.Attachment {
+	t.Helper()
+	attachment, err := as.Store(context.Background(), user.ID, models.AttachmentMessage, "file", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attachment
+}
+
+func TestUpload(t *testing.T) {
+	as := newTestAttachments(t, newTestDB(t))
+	ctx := context.Background()
+
+	image, err := as.Upload(ctx, models.AttachmentMessage, `C:\photos\cat.png`, bytes.NewReader(testPNG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.ContentType != "image/png" || image.Size != int64(len(testPNG)) || image.FileName != "cat.png" {
+		t.Errorf("upload = %s %d %q", image.ContentType, image.Size, image.FileName)
+	}
+	if !strings.HasPrefix(image.Key, "sha256/") {
+		t.Errorf("key = %q, want a content address", image.Key)
+	}
+
+	// The content decides the type and the key, not the name
+	same, err := as.Upload(ctx, models.AttachmentMessage, "page.html", bytes.NewReader(testPNG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.Key != image.Key || same.ContentType != "image/png" {
+		t.Errorf("same content got key %q type %s", same.Key, same.ContentType)
+	}
+
+	as.Config.MaxAvatarSize = 8
+	tests := []struct {
+		name    string
+		purpose string
+		content []byte
+		want    error
+	}{
+		{"empty", models.AttachmentMessage, nil, ErrEmptyAttachment},
+		{"too large", models.AttachmentAvatar, testPNG, ErrAttachmentTooLarge},
+		{"avatar that isn't an image", models.AttachmentAvatar, []byte("text"), ErrNotAnImage},
+	}
+	for _, tt := range tests {
+		if _, err := as.Upload(ctx, tt.purpose, "x", bytes.NewReader(tt.content)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Upload() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestFindAttachment(t *testing.T) {
+	db := newTestDB(t)
+	as := newTestAttachments(t, db)
+	ms := NewMessageService(db, newTestHub())
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+
+	unsent := storeTestFile(t, as, alice, []byte("draft"))
+	sent := storeTestFile(t, as, alice, []byte("sent"))
+	message := models.Message{ReceiverID: &bob.ID, AttachmentIDs: []uint{sent.ID}}
+	if err := ms.Send(alice.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+	avatar, err := as.Store(context.Background(), alice.ID, models.AttachmentAvatar, "me.png", bytes.NewReader(testPNG))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		user       models.User
+		attachment *models.Attachment
+		visible    bool
+	}{
+		{"uploader, unsent", alice, unsent, true},
+		{"peer, unsent", bob, unsent, false},
+		{"peer, sent", bob, sent, true},
+		{"outsider, sent", carol, sent, false},
+		{"outsider, avatar", carol, avatar, true},
+	}
+	for _, tt := range tests {
+		_, err := as.Find(tt.user.ID, tt.attachment.ID)
+		if tt.visible && err != nil {
+			t.Errorf("%s: Find() = %v", tt.name, err)
+		}
+		if !tt.visible && !errors.Is(err, ErrAttachmentNotFound) {
+			t.Errorf("%s: Find() = %v, want %v", tt.name, err, ErrAttachmentNotFound)
+		}
+	}
+}
+
+func TestSendWithAttachments(t *testing.T) {
+	db := newTestDB(t)
+	as := newTestAttachments(t, db)
+	ms := NewMessageService(db, newTestHub())
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	mine := storeTestFile(t, as, alice, []byte("mine"))
+	theirs := storeTestFile(t, as, bob, []byte("theirs"))
+
+	// Repeated IDs count once and the message needs no text
+	message := models.Message{ReceiverID: &bob.ID, AttachmentIDs: []uint{mine.ID, mine.ID}}
+	if err := ms.Send(alice.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+	if len(message.Attachments) != 1 || message.Attachments[0].ID != mine.ID {
+		t.Errorf("attachments = %+v, want [%d]", message.Attachments, mine.ID)
+	}
+
+	for name, id := range map[string]uint{"already sent": mine.ID, "someone else's": theirs.ID, "missing": theirs.ID + 100} {
+		message := models.Message{ReceiverID: &bob.ID, AttachmentIDs: []uint{id}}
+		if err := ms.Send(alice.ID, &message); !errors.Is(err, ErrInvalidAttachment) {
+			t.Errorf("%s: Send() = %v, want %v", name, err, ErrInvalidAttachment)
+		}
+	}
+}
+
+func TestGetSignedFile(t *testing.T) {
+	db := newTestDB(t)
+	as := newTestAttachments(t, db)
+	ac := NewAttachmentController(as)
+	alice := createTestUser(t, db, "alice")
+	attachment := storeTestFile(t, as, alice, []byte("<script>alert(1)</script>"))
+
+	get := func(link string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, link, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		r = mux.SetURLVars(r, map[string]string{"id": strconv.FormatUint(uint64(attachment.ID), 10)})
+		w := httptest.NewRecorder()
+		ac.GetSignedFile(w, r)
+		return w
+	}
+
+	link, _ := as.SignedURL(attachment, 0)
+	w := get(link, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GetSignedFile = %d %s", w.Code, w.Body)
+	}
+	body, _ := io.ReadAll(w.Body)
+	if string(body) != "<script>alert(1)</script>" {
+		t.Errorf("body = %q", body)
+	}
+	// Files that aren't images are never rendered in the app's origin
+	if disposition := w.Header().Get("Content-Disposition"); !strings.HasPrefix(disposition, "attachment") {
+		t.Errorf("Content-Disposition = %q, want an attachment", disposition)
+	}
+
+	if w := get(link, http.Header{"If-None-Match": {w.Header().Get("ETag")}}); w.Code != http.StatusNotModified {
+		t.Errorf("GetSignedFile with the ETag = %d, want 304", w.Code)
+	}
+
+	// Tampered and expired links are refused
+	parsed, _ := url.Parse(link)
+	query := parsed.Query()
+	query.Set("signature", strings.Repeat("0", 64))
+	parsed.RawQuery = query.Encode()
+	if w := get(parsed.String(), nil); w.Code != http.StatusForbidden {
+		t.Errorf("GetSignedFile with a bad signature = %d, want 403", w.Code)
+	}
+	as.Config.URLTTL = -time.Minute
+	expired, _ := as.SignedURL(attachment, 0)
+	if w := get(expired, nil); w.Code != http.StatusForbidden {
+		t.Errorf("GetSignedFile with an expired link = %d, want 403", w.Code)
+	}
+}
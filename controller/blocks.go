@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrBlocked   = errors.New("you can't interact with this user")
+	ErrBlockSelf = errors.New("you can't block yourself")
+)
+
+// BlockedUser is a user on someone's block list
+type BlockedUser struct {
+	models.User
+	BlockedAt time.Time `json:"blocked_at"`
+}
+
+// isBlockedBetween reports whether either user has blocked the other
+func isBlockedBetween(db *gorm.DB, userID, otherID uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.UserBlock{}).
+		Where("(blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)", userID, otherID, otherID, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// blockRelations returns the users the given user blocked or was blocked
+// by, as a set
+func blockRelations(db *gorm.DB, userID uint) (map[uint]bool, error) {
+	var blocks []models.UserBlock
+	if err := db.Where("blocker_id = ? OR blocked_id = ?", userID, userID).Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+
+	related := make(map[uint]bool, len(blocks))
+	for _, block := range blocks {
+		if block.BlockerID == userID {
+			related[block.BlockedID] = true
+		} else {
+			related[block.BlockerID] = true
+		}
+	}
+	return related, nil
+}
+
+// blockersOf is a subquery of the users who blocked the given user
+func blockersOf(db *gorm.DB, userID uint) *gorm.DB {
+	return db.Model(&models.UserBlock{}).Select("blocker_id").Where("blocked_id = ?", userID)
+}
+
+// withoutBlocked drops the users that have a block with userID from ids
+func withoutBlocked(db *gorm.DB, userID uint, ids []uint) ([]uint, error) {
+	related, err := blockRelations(db, userID)
+	if err != nil || len(related) == 0 {
+		return ids, err
+	}
+
+	kept := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !related[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept, nil
+}
+
+// Block adds the user to the blocker's block list; blocking twice changes
+// nothing
+func Block(db *gorm.DB, blockerID uint, username string) error {
+	blocked, err := blockTarget(db, blockerID, username)
+	if err != nil {
+		return err
+	}
+
+	block := models.UserBlock{BlockerID: blockerID, BlockedID: blocked.ID}
+	return db.Where("blocker_id = ? AND blocked_id = ?", blockerID, blocked.ID).FirstOrCreate(&block).Error
+}
+
+// Unblock removes the user from the blocker's block list
+func Unblock(db *gorm.DB, blockerID uint, username string) error {
+	blocked, err := blockTarget(db, blockerID, username)
+	if err != nil {
+		return err
+	}
+	return db.Where("blocker_id = ? AND blocked_id = ?", blockerID, blocked.ID).Delete(&models.UserBlock{}).Error
+}
+
+// blockTarget loads the user named in a block or unblock request
+func blockTarget(db *gorm.DB, blockerID uint, username string) (*models.User, error) {
+	var user models.User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPeerNotFound
+		}
+		return nil, err
+	}
+	if user.ID == blockerID {
+		return nil, ErrBlockSelf
+	}
+	return &user, nil
+}
+
+// BlockedUsers lists the users the blocker has blocked, latest first
+func BlockedUsers(db *gorm.DB, blockerID uint) ([]BlockedUser, error) {
+	var blocks []models.UserBlock
+	if err := db.Where("blocker_id = ?", blockerID).Order("created_at DESC, id DESC").Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, len(blocks))
+	for i, block := range blocks {
+		ids[i] = block.BlockedID
+	}
+	var users []models.User
+	if err := db.Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]models.User, len(users))
+	for _, user := range users {
+		byID[user.ID] = user
+	}
+
+	blocked := make([]BlockedUser, 0, len(blocks))
+	for _, block := range blocks {
+		// Deleted accounts drop off the list
+		if user, ok := byID[block.BlockedID]; ok {
+			blocked = append(blocked, BlockedUser{User: user, BlockedAt: block.CreatedAt})
+		}
+	}
+	return blocked, nil
+}
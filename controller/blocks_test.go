@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// blockTestUser makes blocker block the user through Block
+func blockTestUser(t *testing.T, ms *MessageService, blocker, blocked models.User) {
+	t.Helper()
+	if err := Block(ms.DB, blocker.ID, blocked.Username); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testEnvelope wraps a payload as a client would send it
+func testEnvelope(t *testing.T, eventType utils.EventType, payload interface{}) *utils.Envelope {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &utils.Envelope{Version: utils.ProtocolVersion, Type: eventType, Payload: data}
+}
+
+func TestBlock(t *testing.T) {
+	db := newTestDB(t)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+
+	// Blocking twice keeps one entry
+	for i := 0; i < 2; i++ {
+		if err := Block(db, alice.ID, bob.Username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Block(db, alice.ID, carol.Username); err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := BlockedUsers(db, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocked) != 2 {
+		t.Fatalf("%d blocked users, want 2", len(blocked))
+	}
+
+	// Blocks work both ways
+	for _, pair := range [][2]uint{{alice.ID, bob.ID}, {bob.ID, alice.ID}} {
+		if blocked, _ := isBlockedBetween(db, pair[0], pair[1]); !blocked {
+			t.Errorf("no block between %d and %d", pair[0], pair[1])
+		}
+	}
+	if blocked, _ := isBlockedBetween(db, bob.ID, carol.ID); blocked {
+		t.Error("bob and carol are blocked")
+	}
+
+	if err := Unblock(db, alice.ID, bob.Username); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, _ := isBlockedBetween(db, alice.ID, bob.ID); blocked {
+		t.Error("block remains after Unblock")
+	}
+
+	if err := Block(db, alice.ID, alice.Username); !errors.Is(err, ErrBlockSelf) {
+		t.Errorf("Block() of oneself = %v, want %v", err, ErrBlockSelf)
+	}
+	if err := Block(db, alice.ID, "nobody"); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("Block() of a missing user = %v, want %v", err, ErrPeerNotFound)
+	}
+}
+
+func TestBlockedDirectMessages(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	message := sendTestMessage(t, ms, bob, alice, "hi")
+	blockTestUser(t, ms, alice, bob)
+
+	// Neither side can message or react to the other
+	for _, pair := range [][2]models.User{{alice, bob}, {bob, alice}} {
+		reply := models.Message{Content: "hi", ReceiverID: &pair[1].ID}
+		if err := ms.Send(pair[0].ID, &reply); !errors.Is(err, ErrBlocked) {
+			t.Errorf("Send() from %s = %v, want %v", pair[0].Username, err, ErrBlocked)
+		}
+		if err := ms.React(pair[0].ID, message.ID, "👍"); !errors.Is(err, ErrBlocked) {
+			t.Errorf("React() from %s = %v, want %v", pair[0].Username, err, ErrBlocked)
+		}
+	}
+}
+
+func TestBlockedGroupMembers(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	gc := NewGroupController(ms)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	group := createTestGroup(t, gc, alice, bob, carol)
+	blockTestUser(t, ms, carol, bob)
+
+	// Nobody is put in a group with someone across a block
+	if w := serveAs(gc.CreateGroup, carol, nil, map[string]interface{}{"name": "x", "member_ids": []uint{bob.ID}}); w.Code != http.StatusForbidden {
+		t.Errorf("CreateGroup with a blocked member = %d, want 403", w.Code)
+	}
+	other := createTestGroup(t, gc, bob)
+	if w := serveAs(gc.AddMember, bob, groupVars(other.ID), map[string]uint{"user_id": carol.ID}); w.Code != http.StatusForbidden {
+		t.Errorf("AddMember of a blocker = %d, want 403", w.Code)
+	}
+
+	// Group messages, reactions and typing skip the other side of the block
+	owner := connectTestClient(hub, alice.ID)
+	sender := connectTestClient(hub, bob.ID)
+	blocker := connectTestClient(hub, carol.ID)
+	message := models.Message{Content: "hi", GroupID: group.ID}
+	if err := ms.Send(bob.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Publish(&message, sender); err != nil {
+		t.Fatal(err)
+	}
+	if env := nextEvent(t, owner); env.Type != utils.EventMessageNew {
+		t.Errorf("owner got %s, want %s", env.Type, utils.EventMessageNew)
+	}
+	expectNoEvent(t, hub, blocker)
+
+	if err := ms.React(alice.ID, message.ID, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.React(carol.ID, message.ID, "👍"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("React() on a blocked sender's message = %v, want %v", err, ErrBlocked)
+	}
+	for _, client := range []*utils.Client{owner, sender, blocker} {
+		if env := nextEvent(t, client); env.Type != utils.EventReactionAdded {
+			t.Errorf("got %s, want %s", env.Type, utils.EventReactionAdded)
+		}
+	}
+
+	wc := NewWebSocketController(ms, NewSessionService(newTestRevocationStore(db, time.Hour)))
+	typing := testEnvelope(t, utils.EventTyping, utils.TypingPayload{GroupID: group.ID, Typing: true})
+	if err := wc.handleTyping(sender, typing); err != nil {
+		t.Fatal(err)
+	}
+	if env := nextEvent(t, owner); env.Type != utils.EventTyping {
+		t.Errorf("owner got %s, want %s", env.Type, utils.EventTyping)
+	}
+	expectNoEvent(t, hub, blocker)
+}
+
+func TestBlockedTypingAndPresence(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	wc := NewWebSocketController(ms, NewSessionService(newTestRevocationStore(db, time.Hour)))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	aliceClient := connectTestClient(hub, alice.ID)
+	bobClient := connectTestClient(hub, bob.ID)
+	connectTestClient(hub, carol.ID)
+	blockTestUser(t, ms, alice, bob)
+
+	typing := testEnvelope(t, utils.EventTyping, utils.TypingPayload{ReceiverID: alice.ID, Typing: true})
+	if err := wc.handleTyping(bobClient, typing); err == nil {
+		t.Error("typing to a blocker succeeded")
+	}
+	expectNoEvent(t, hub, aliceClient)
+
+	// Each side sees the other offline
+	presence := testEnvelope(t, utils.EventPresence, utils.PresencePayload{UserIDs: []uint{alice.ID, carol.ID}})
+	if err := wc.handlePresence(bobClient, presence); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []utils.PresenceStatus
+	nextEvent(t, bobClient).DecodePayload(&statuses)
+	want := []utils.PresenceStatus{{UserID: alice.ID, Online: false}, {UserID: carol.ID, Online: true}}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("presence = %+v, want %+v", statuses, want)
+	}
+}
+
+func TestBlockedUserLookup(t *testing.T) {
+	db := newTestDB(t)
+	uc := newTestUserController(t, db)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	if err := Block(db, alice.ID, bob.Username); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whoever blocked you can't be looked up, but you can still find them
+	if w := serveAs(uc.GetUserByUserName, bob, map[string]string{"username": "alice"}, nil); w.Code != http.StatusNotFound {
+		t.Errorf("GetUserByUserName of a blocker = %d, want 404", w.Code)
+	}
+	if w := serveAs(uc.GetUserByUserName, alice, map[string]string{"username": "bob"}, nil); w.Code != http.StatusOK {
+		t.Errorf("GetUserByUserName of a blocked user = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github/similadayo/chitchat/models"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrInvalidConversation = errors.New("invalid conversation ID")
+
+// conversationRef identifies a conversation from the point of view of the
+// current user: either a direct conversation with PeerID or a group.
+// On the wire it is written "u<peer ID>" or "g<group ID>"; a bare number is a peer.
+type conversationRef struct {
+	PeerID  uint
+	GroupID uint
+}
+
+// parseConversationID parses a conversation ID from a path variable
+func parseConversationID(id string) (conversationRef, error) {
+	prefix, digits := "u", id
+	if strings.HasPrefix(id, "u") || strings.HasPrefix(id, "g") {
+		prefix, digits = id[:1], id[1:]
+	}
+
+	n, err := strconv.ParseUint(digits, 10, 0)
+	if err != nil || n == 0 {
+		return conversationRef{}, ErrInvalidConversation
+	}
+
+	if prefix == "g" {
+		return conversationRef{GroupID: uint(n)}, nil
+	}
+	return conversationRef{PeerID: uint(n)}, nil
+}
+
+// String formats the conversation ID for responses
+func (c conversationRef) String() string {
+	if c.GroupID != 0 {
+		return fmt.Sprintf("g%d", c.GroupID)
+	}
+	return fmt.Sprintf("u%d", c.PeerID)
+}
+
+// conversationOf returns the conversation a message belongs to, as seen by the user
+func conversationOf(message *models.Message, userID uint) conversationRef {
+	if message.GroupID != 0 {
+		return conversationRef{GroupID: message.GroupID}
+	}
+	if message.SenderID == userID {
+		return conversationRef{PeerID: *message.ReceiverID}
+	}
+	return conversationRef{PeerID: message.SenderID}
+}
+
+// scope restricts a message query to the conversation between the user and
+// the peer, or to the group
+func (c conversationRef) scope(db *gorm.DB, userID uint) *gorm.DB {
+	if c.GroupID != 0 {
+		return db.Where("group_id = ?", c.GroupID)
+	}
+	return db.Where("((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))",
+		userID, c.PeerID, c.PeerID, userID)
+}
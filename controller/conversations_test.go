@@ -0,0 +1,34 @@
+package controller
+
+import "testing"
+
+func TestParseConversationID(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    conversationRef
+		wantErr bool
+	}{
+		{"u7", conversationRef{PeerID: 7}, false},
+		{"7", conversationRef{PeerID: 7}, false},
+		{"g3", conversationRef{GroupID: 3}, false},
+		{"g0", conversationRef{}, true},
+		{"u", conversationRef{}, true},
+		{"x7", conversationRef{}, true},
+		{"u-1", conversationRef{}, true},
+		{"", conversationRef{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseConversationID(tt.id)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseConversationID(%q) = %+v, %v; want %+v, error %v", tt.id, got, err, tt.want, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		// The canonical form parses back to the same conversation
+		if again, err := parseConversationID(got.String()); err != nil || again != got {
+			t.Errorf("%q doesn't round-trip: %+v, %v", got.String(), again, err)
+		}
+	}
+}
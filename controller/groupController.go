@@ -0,0 +1,547 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type GroupController struct {
+	DB       *gorm.DB
+	Messages *MessageService
+}
+
+// NewGroupController creates a new group controller
+func NewGroupController(messages *MessageService) *GroupController {
+	return &GroupController{DB: messages.DB, Messages: messages}
+}
+
+// isGroupMember reports whether the user belongs to the group
+func isGroupMember(db *gorm.DB, groupID, userID uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", groupID, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// groupMemberIDs returns the IDs of every member of the group
+func groupMemberIDs(db *gorm.DB, groupID uint) ([]uint, error) {
+	var ids []uint
+	err := db.Model(&models.GroupMember{}).
+		Where("group_id = ?", groupID).
+		Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// groupMembership loads a group and the user's membership of it
+func groupMembership(db *gorm.DB, groupID, userID uint) (*models.Group, *models.GroupMember, error) {
+	var group models.Group
+	if err := db.First(&group, groupID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrGroupNotFound
+		}
+		return nil, nil, err
+	}
+
+	var member models.GroupMember
+	if err := db.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrNotGroupMember
+		}
+		return nil, nil, err
+	}
+
+	return &group, &member, nil
+}
+
+// loadGroupForMember fetches a group from the {id} path variable along with
+// the user's membership. It writes the error response itself.
+func (gc *GroupController) loadGroupForMember(w http.ResponseWriter, r *http.Request, userID uint) (*models.Group, *models.GroupMember, bool) {
+	groupID, err := pathID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid group ID", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	group, member, err := groupMembership(gc.DB, groupID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return nil, nil, false
+	}
+
+	return group, member, true
+}
+
+// requirePermission writes a 403 response unless the member may perform the action
+func requirePermission(w http.ResponseWriter, group *models.Group, member *models.GroupMember, perm GroupPermission) bool {
+	if !canInGroup(group, member, perm) {
+		http.Error(w, "You don't have permission to do this in this group", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// CreateGroup creates a group owned by the current user with the given members
+func (gc *GroupController) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Name             string `json:"name"`
+		AvatarURL        string `json:"avatar_url"`
+		AnnouncementOnly bool   `json:"announcement_only"`
+		MemberIDs        []uint `json:"member_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(body.Name) == "" {
+		http.Error(w, "Group name is required", http.StatusBadRequest)
+		return
+	}
+
+	// The owner is always a member, and nobody is added twice
+	memberIDs := []uint{user.ID}
+	seen := map[uint]bool{user.ID: true}
+	for _, id := range body.MemberIDs {
+		if !seen[id] {
+			seen[id] = true
+			memberIDs = append(memberIDs, id)
+		}
+	}
+
+	var found int64
+	if err := gc.DB.Model(&models.User{}).Where("id IN ?", memberIDs).Count(&found).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if int(found) != len(memberIDs) {
+		http.Error(w, "One or more members not found", http.StatusNotFound)
+		return
+	}
+
+	// Nobody can be put in a group with someone on either side of a block
+	related, err := blockRelations(gc.DB, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, id := range memberIDs {
+		if related[id] {
+			http.Error(w, ErrBlocked.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	group := models.Group{
+		Name:             body.Name,
+		AvatarURL:        body.AvatarURL,
+		OwnerID:          user.ID,
+		AnnouncementOnly: body.AnnouncementOnly,
+	}
+	now := time.Now()
+	for _, id := range memberIDs {
+		role := models.RoleMember
+		if id == user.ID {
+			role = models.RoleOwner
+		}
+		group.Members = append(group.Members, models.GroupMember{UserID: id, Role: role, JoinedAt: now})
+	}
+
+	if err := gc.DB.Create(&group).Error; err != nil {
+		http.Error(w, "Could not create the group", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusCreated, group)
+}
+
+// GetGroups returns the groups the current user belongs to
+func (gc *GroupController) GetGroups(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var groups []models.Group
+	if err := gc.DB.
+		Where("id IN (?)", gc.DB.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", user.ID)).
+		Order("name").
+		Find(&groups).Error; err != nil {
+		http.Error(w, "Could not get the groups", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, groups)
+}
+
+// GetGroup returns a group and its members
+func (gc *GroupController) GetGroup(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	group, _, ok := gc.loadGroupForMember(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	if err := gc.DB.Preload("Members.User").First(group, group.ID).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range group.Members {
+		group.Members[i].Role = effectiveRole(group, &group.Members[i])
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, group)
+}
+
+// UpdateGroup changes a group's name, avatar or announcement-only setting
+func (gc *GroupController) UpdateGroup(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	group, member, ok := gc.loadGroupForMember(w, r, user.ID)
+	if !ok || !requirePermission(w, group, member, PermEditGroup) {
+		return
+	}
+
+	var body struct {
+		Name             *string `json:"name"`
+		AvatarURL        *string `json:"avatar_url"`
+		AnnouncementOnly *bool   `json:"announcement_only"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if body.Name != nil {
+		if strings.TrimSpace(*body.Name) == "" {
+			http.Error(w, "Group name is required", http.StatusBadRequest)
+			return
+		}
+		group.Name = *body.Name
+	}
+	if body.AvatarURL != nil {
+		group.AvatarURL = *body.AvatarURL
+	}
+	if body.AnnouncementOnly != nil {
+		group.AnnouncementOnly = *body.AnnouncementOnly
+	}
+
+	if err := gc.DB.Save(group).Error; err != nil {
+		http.Error(w, "Could not update the group", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, group)
+}
+
+// AddMember adds a user to a group. A user on either side of a block with
+// the actor can't be added.
+func (gc *GroupController) AddMember(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	group, member, ok := gc.loadGroupForMember(w, r, user.ID)
+	if !ok || !requirePermission(w, group, member, PermManageMembers) {
+		return
+	}
+
+	var body struct {
+		UserID uint `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var newMember models.User
+	if err := gc.DB.First(&newMember, body.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	isMember, err := isGroupMember(gc.DB, group.ID, newMember.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isMember {
+		http.Error(w, "User is already a member of this group", http.StatusConflict)
+		return
+	}
+
+	blocked, err := isBlockedBetween(gc.DB, user.ID, newMember.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, ErrBlocked.Error(), http.StatusForbidden)
+		return
+	}
+
+	added := models.GroupMember{GroupID: group.ID, UserID: newMember.ID, Role: models.RoleMember, JoinedAt: time.Now()}
+	if err := gc.DB.Create(&added).Error; err != nil {
+		http.Error(w, "Could not add the member", http.StatusInternalServerError)
+		return
+	}
+	added.User = newMember
+
+	utils.RespondWithJSON(w, http.StatusCreated, added)
+}
+
+// RemoveMember removes a user from a group. Members can only be removed by
+// someone with a higher role, so the owner can never be removed.
+func (gc *GroupController) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	group, member, ok := gc.loadGroupForMember(w, r, user.ID)
+	if !ok || !requirePermission(w, group, member, PermManageMembers) {
+		return
+	}
+
+	memberID, err := pathID(r, "userID")
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var target models.GroupMember
+	if err := gc.DB.Where("group_id = ? AND user_id = ?", group.ID, memberID).First(&target).Error; err != nil {
+		http.Error(w, "User is not a member of this group", http.StatusNotFound)
+		return
+	}
+	if !outranks(group, member, &target) {
+		http.Error(w, "You can't remove a member with the same or a higher role", http.StatusForbidden)
+		return
+	}
+
+	if err := gc.DB.Delete(&target).Error; err != nil {
+		http.Error(w, "Could not remove the member", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Member removed successfully"})
+}
+
+// ChangeRole sets a member's role. Only the owner can change roles; making
+// someone else the owner hands over ownership and demotes the old owner to
+// admin. Every change is audited and posted to the group timeline.
+func (gc *GroupController) ChangeRole(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	group, member, ok := gc.loadGroupForMember(w, r, user.ID)
+	if !ok || !requirePermission(w, group, member, PermChangeRoles) {
+		return
+	}
+
+	memberID, err := pathID(r, "userID")
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !isValidRole(body.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	var target models.GroupMember
+	if err := gc.DB.Preload("User").Where("group_id = ? AND user_id = ?", group.ID, memberID).First(&target).Error; err != nil {
+		http.Error(w, "User is not a member of this group", http.StatusNotFound)
+		return
+	}
+	if target.UserID == user.ID {
+		http.Error(w, "You can't change your own role", http.StatusBadRequest)
+		return
+	}
+
+	oldRole := effectiveRole(group, &target)
+	if oldRole == body.Role {
+		utils.RespondWithJSON(w, http.StatusOK, target)
+		return
+	}
+
+	err = gc.DB.Transaction(func(tx *gorm.DB) error {
+		if body.Role == models.RoleOwner {
+			if err := tx.Model(group).Update("owner_id", target.UserID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(member).Update("role", models.RoleAdmin).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&models.GroupAuditLog{
+				GroupID: group.ID, ActorID: user.ID, TargetUserID: user.ID,
+				Action: "role_changed", OldRole: models.RoleOwner, NewRole: models.RoleAdmin,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&target).Update("role", body.Role).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.GroupAuditLog{
+			GroupID: group.ID, ActorID: user.ID, TargetUserID: target.UserID,
+			Action: "role_changed", OldRole: oldRole, NewRole: body.Role,
+		}).Error
+	})
+	if err != nil {
+		http.Error(w, "Could not change the role", http.StatusInternalServerError)
+		return
+	}
+
+	event := fmt.Sprintf("%s changed %s's role from %s to %s", user.Username, target.User.Username, oldRole, body.Role)
+	if err := gc.Messages.SendSystem(group.ID, user.ID, event); err != nil {
+		log.Printf("Error posting role change to the group: %v", err)
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, target)
+}
+
+// GetAuditLog returns the role change history of a group to its owner and admins
+func (gc *GroupController) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	group, member, ok := gc.loadGroupForMember(w, r, user.ID)
+	if !ok || !requirePermission(w, group, member, PermManageMembers) {
+		return
+	}
+
+	var entries []models.GroupAuditLog
+	if err := gc.DB.Where("group_id = ?", group.ID).Order("id DESC").Find(&entries).Error; err != nil {
+		http.Error(w, "Could not get the audit log", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, entries)
+}
+
+// PinMessage pins a message of the group, or unpins it when message_id is null
+func (gc *GroupController) PinMessage(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	group, member, ok := gc.loadGroupForMember(w, r, user.ID)
+	if !ok || !requirePermission(w, group, member, PermPinMessages) {
+		return
+	}
+
+	var body struct {
+		MessageID *uint `json:"message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if body.MessageID != nil {
+		var message models.Message
+		if err := gc.DB.Where("id = ? AND group_id = ?", *body.MessageID, group.ID).First(&message).Error; err != nil {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if err := gc.DB.Model(group).Update("pinned_message_id", body.MessageID).Error; err != nil {
+		http.Error(w, "Could not pin the message", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, group)
+}
+
+// LeaveGroup removes the current user from a group. When the owner leaves,
+// ownership passes to the longest-standing admin, or member if there is no
+// admin; the last member to leave deletes the group.
+func (gc *GroupController) LeaveGroup(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(gc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	group, member, ok := gc.loadGroupForMember(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	err = gc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(member).Error; err != nil {
+			return err
+		}
+		if group.OwnerID != user.ID {
+			return nil
+		}
+
+		var next models.GroupMember
+		// Order only takes raw strings; an Expr would be dropped by First
+		err := tx.Where("group_id = ?", group.ID).
+			Order("CASE WHEN role = '" + models.RoleAdmin + "' THEN 0 ELSE 1 END, joined_at, id").
+			First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Delete(group).Error
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&next).Update("role", models.RoleOwner).Error; err != nil {
+			return err
+		}
+		return tx.Model(group).Update("owner_id", next.UserID).Error
+	})
+	if err != nil {
+		http.Error(w, "Could not leave the group", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Left the group successfully"})
+}
@@ -0,0 +1,363 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// serveAs calls the handler as the given user, with vars as the path
+// variables and body encoded as JSON
+func serveAs(handler http.HandlerFunc, user models.User, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", &buf)
+	r = r.WithContext(utils.SetUserInContext(r.Context(), user.Username))
+	r = mux.SetURLVars(r, vars)
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// groupVars are the path variables naming the group and, optionally, a member
+func groupVars(groupID uint, userID ...uint) map[string]string {
+	vars := map[string]string{"id": strconv.FormatUint(uint64(groupID), 10)}
+	if len(userID) > 0 {
+		vars["userID"] = strconv.FormatUint(uint64(userID[0]), 10)
+	}
+	return vars
+}
+
+// createTestGroup creates a group owned by owner through the handler
+func createTestGroup(t *testing.T, gc *GroupController, owner models.User, members ...models.User) models.Group {
+	t.Helper()
+	ids := []uint{}
+	for _, member := range members {
+		ids = append(ids, member.ID)
+	}
+
+	w := serveAs(gc.CreateGroup, owner, nil, map[string]interface{}{"name": "friends", "member_ids": ids})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("CreateGroup = %d %s", w.Code, w.Body)
+	}
+	var group models.Group
+	if err := json.NewDecoder(w.Body).Decode(&group); err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+// memberIDs lists the IDs of the group's members in joining order
+func memberIDs(t *testing.T, db *gorm.DB, groupID uint) []uint {
+	t.Helper()
+	var ids []uint
+	if err := db.Model(&models.GroupMember{}).Where("group_id = ?", groupID).Order("joined_at, id").Pluck("user_id", &ids).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestCreateGroup(t *testing.T) {
+	db := newTestDB(t)
+	gc := NewGroupController(NewMessageService(db, nil))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	// The owner is added once even when listed, duplicates are ignored
+	w := serveAs(gc.CreateGroup, alice, nil, map[string]interface{}{
+		"name":       "friends",
+		"member_ids": []uint{bob.ID, alice.ID, bob.ID},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("CreateGroup = %d %s", w.Code, w.Body)
+	}
+	var group models.Group
+	json.NewDecoder(w.Body).Decode(&group)
+	if group.OwnerID != alice.ID {
+		t.Errorf("owner = %d, want %d", group.OwnerID, alice.ID)
+	}
+	if got := memberIDs(t, db, group.ID); len(got) != 2 || got[0] != alice.ID || got[1] != bob.ID {
+		t.Errorf("members = %v, want [%d %d]", got, alice.ID, bob.ID)
+	}
+
+	tests := []struct {
+		name string
+		body map[string]interface{}
+		want int
+	}{
+		{"no name", map[string]interface{}{"name": " "}, http.StatusBadRequest},
+		{"unknown member", map[string]interface{}{"name": "x", "member_ids": []uint{bob.ID + 100}}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serveAs(gc.CreateGroup, alice, nil, tt.body); w.Code != tt.want {
+			t.Errorf("%s: CreateGroup = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestGroupMembership(t *testing.T) {
+	db := newTestDB(t)
+	gc := NewGroupController(NewMessageService(db, nil))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	group := createTestGroup(t, gc, alice, bob)
+
+	// Outsiders can neither see nor change the group
+	if w := serveAs(gc.GetGroup, carol, groupVars(group.ID), nil); w.Code != http.StatusForbidden {
+		t.Errorf("GetGroup by an outsider = %d, want 403", w.Code)
+	}
+	if w := serveAs(gc.AddMember, carol, groupVars(group.ID), map[string]uint{"user_id": carol.ID}); w.Code != http.StatusForbidden {
+		t.Errorf("AddMember by an outsider = %d, want 403", w.Code)
+	}
+
+	// Plain members can't manage the group's members
+	if w := serveAs(gc.AddMember, bob, groupVars(group.ID), map[string]uint{"user_id": carol.ID}); w.Code != http.StatusForbidden {
+		t.Errorf("AddMember by a member = %d, want 403", w.Code)
+	}
+
+	if w := serveAs(gc.AddMember, alice, groupVars(group.ID), map[string]uint{"user_id": carol.ID}); w.Code != http.StatusCreated {
+		t.Fatalf("AddMember = %d %s", w.Code, w.Body)
+	}
+	if w := serveAs(gc.AddMember, alice, groupVars(group.ID), map[string]uint{"user_id": carol.ID}); w.Code != http.StatusConflict {
+		t.Errorf("adding a member twice = %d, want 409", w.Code)
+	}
+
+	if w := serveAs(gc.RemoveMember, bob, groupVars(group.ID, alice.ID), nil); w.Code != http.StatusForbidden {
+		t.Errorf("removing the owner = %d, want 403", w.Code)
+	}
+	if w := serveAs(gc.RemoveMember, alice, groupVars(group.ID, carol.ID), nil); w.Code != http.StatusOK {
+		t.Fatalf("RemoveMember = %d %s", w.Code, w.Body)
+	}
+	if w := serveAs(gc.RemoveMember, alice, groupVars(group.ID, carol.ID), nil); w.Code != http.StatusNotFound {
+		t.Errorf("removing a non-member = %d, want 404", w.Code)
+	}
+	if got := memberIDs(t, db, group.ID); len(got) != 2 {
+		t.Errorf("members = %v, want alice and bob", got)
+	}
+}
+
+func TestLeaveGroup(t *testing.T) {
+	db := newTestDB(t)
+	gc := NewGroupController(NewMessageService(db, nil))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	group := createTestGroup(t, gc, alice, bob, carol)
+
+	// Ownership passes to the longest-standing member
+	if w := serveAs(gc.LeaveGroup, alice, groupVars(group.ID), nil); w.Code != http.StatusOK {
+		t.Fatalf("LeaveGroup = %d %s", w.Code, w.Body)
+	}
+	db.First(&group, group.ID)
+	if group.OwnerID != bob.ID {
+		t.Errorf("owner after the owner left = %d, want %d", group.OwnerID, bob.ID)
+	}
+	if w := serveAs(gc.GetGroup, alice, groupVars(group.ID), nil); w.Code != http.StatusForbidden {
+		t.Errorf("GetGroup after leaving = %d, want 403", w.Code)
+	}
+
+	// A member leaving keeps the owner
+	serveAs(gc.LeaveGroup, carol, groupVars(group.ID), nil)
+	db.First(&group, group.ID)
+	if group.OwnerID != bob.ID {
+		t.Errorf("owner after a member left = %d, want %d", group.OwnerID, bob.ID)
+	}
+
+	// The last member to leave deletes the group
+	serveAs(gc.LeaveGroup, bob, groupVars(group.ID), nil)
+	if err := db.First(&models.Group{}, group.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("the empty group still exists: %v", err)
+	}
+}
+
+func TestSendToGroup(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	gc := NewGroupController(ms)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	group := createTestGroup(t, gc, alice, bob)
+
+	outsider := models.Message{Content: "hi", GroupID: group.ID}
+	if err := ms.Send(carol.ID, &outsider); !errors.Is(err, ErrNotGroupMember) {
+		t.Fatalf("Send() by an outsider = %v, want %v", err, ErrNotGroupMember)
+	}
+	missing := models.Message{Content: "hi", GroupID: group.ID + 100}
+	if err := ms.Send(alice.ID, &missing); !errors.Is(err, ErrGroupNotFound) {
+		t.Fatalf("Send() to a missing group = %v, want %v", err, ErrGroupNotFound)
+	}
+
+	member := connectTestClient(hub, bob.ID)
+	other := connectTestClient(hub, carol.ID)
+	message := models.Message{Content: "hi", GroupID: group.ID}
+	if err := ms.Send(alice.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Publish(&message, nil); err != nil {
+		t.Fatal(err)
+	}
+	if env := nextEvent(t, member); env.Type != utils.EventMessageNew {
+		t.Errorf("member got %s, want %s", env.Type, utils.EventMessageNew)
+	}
+	expectNoEvent(t, hub, other)
+}
+
+// setRole changes the member's role through the handler as actor
+func setRole(gc *GroupController, actor models.User, groupID, userID uint, role string) *httptest.ResponseRecorder {
+	return serveAs(gc.ChangeRole, actor, groupVars(groupID, userID), map[string]string{"role": role})
+}
+
+func TestGroupRoles(t *testing.T) {
+	db := newTestDB(t)
+	gc := NewGroupController(NewMessageService(db, newTestHub()))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	dave := createTestUser(t, db, "dave")
+	group := createTestGroup(t, gc, alice, bob, carol, dave)
+
+	// Only the owner changes roles, and never their own
+	if w := setRole(gc, bob, group.ID, carol.ID, models.RoleAdmin); w.Code != http.StatusForbidden {
+		t.Errorf("ChangeRole by a member = %d, want 403", w.Code)
+	}
+	if w := setRole(gc, alice, group.ID, alice.ID, models.RoleAdmin); w.Code != http.StatusBadRequest {
+		t.Errorf("changing one's own role = %d, want 400", w.Code)
+	}
+	if w := setRole(gc, alice, group.ID, bob.ID, "superuser"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown role = %d, want 400", w.Code)
+	}
+	if w := setRole(gc, alice, group.ID, bob.ID, models.RoleAdmin); w.Code != http.StatusOK {
+		t.Fatalf("ChangeRole = %d %s", w.Code, w.Body)
+	}
+	if w := setRole(gc, alice, group.ID, dave.ID, models.RoleReadOnly); w.Code != http.StatusOK {
+		t.Fatalf("ChangeRole = %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name   string
+		actor  models.User
+		action http.HandlerFunc
+		vars   map[string]string
+		body   interface{}
+		want   int
+	}{
+		{"admin renames", bob, gc.UpdateGroup, groupVars(group.ID), map[string]string{"name": "team"}, http.StatusOK},
+		{"member renames", carol, gc.UpdateGroup, groupVars(group.ID), map[string]string{"name": "x"}, http.StatusForbidden},
+		{"member reads the audit log", carol, gc.GetAuditLog, groupVars(group.ID), nil, http.StatusForbidden},
+		{"admin reads the audit log", bob, gc.GetAuditLog, groupVars(group.ID), nil, http.StatusOK},
+		{"member pins", carol, gc.PinMessage, groupVars(group.ID), map[string]interface{}{"message_id": nil}, http.StatusForbidden},
+		{"admin removes the owner", bob, gc.RemoveMember, groupVars(group.ID, alice.ID), nil, http.StatusForbidden},
+		{"admin removes a member", bob, gc.RemoveMember, groupVars(group.ID, carol.ID), nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := serveAs(tt.action, tt.actor, tt.vars, tt.body); w.Code != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	// Read-only members can't post, members can
+	ms := gc.Messages
+	readOnly := models.Message{Content: "hi", GroupID: group.ID}
+	if err := ms.Send(dave.ID, &readOnly); !errors.Is(err, ErrPostNotAllowed) {
+		t.Errorf("Send() by a read-only member = %v, want %v", err, ErrPostNotAllowed)
+	}
+	posted := models.Message{Content: "hi", GroupID: group.ID}
+	if err := ms.Send(bob.ID, &posted); err != nil {
+		t.Errorf("Send() by an admin = %v", err)
+	}
+
+	var audit []models.GroupAuditLog
+	db.Where("group_id = ?", group.ID).Order("id").Find(&audit)
+	if len(audit) != 2 || audit[0].TargetUserID != bob.ID || audit[0].OldRole != models.RoleMember || audit[0].NewRole != models.RoleAdmin {
+		t.Errorf("audit log = %+v, want bob's and dave's role changes", audit)
+	}
+
+	// Each role change is posted to the timeline as a system message
+	var system int64
+	db.Model(&models.Message{}).Where("group_id = ? AND is_system = ?", group.ID, true).Count(&system)
+	if system != 2 {
+		t.Errorf("%d system messages, want 2", system)
+	}
+}
+
+func TestAnnouncementGroup(t *testing.T) {
+	db := newTestDB(t)
+	gc := NewGroupController(NewMessageService(db, newTestHub()))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	w := serveAs(gc.CreateGroup, alice, nil, map[string]interface{}{
+		"name":              "news",
+		"member_ids":        []uint{bob.ID},
+		"announcement_only": true,
+	})
+	var group models.Group
+	json.NewDecoder(w.Body).Decode(&group)
+
+	member := models.Message{Content: "hi", GroupID: group.ID}
+	if err := gc.Messages.Send(bob.ID, &member); !errors.Is(err, ErrPostNotAllowed) {
+		t.Errorf("Send() by a member = %v, want %v", err, ErrPostNotAllowed)
+	}
+	owner := models.Message{Content: "news", GroupID: group.ID}
+	if err := gc.Messages.Send(alice.ID, &owner); err != nil {
+		t.Errorf("Send() by the owner = %v", err)
+	}
+}
+
+func TestTransferOwnership(t *testing.T) {
+	db := newTestDB(t)
+	gc := NewGroupController(NewMessageService(db, newTestHub()))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	group := createTestGroup(t, gc, alice, bob, carol)
+
+	if w := setRole(gc, alice, group.ID, bob.ID, models.RoleOwner); w.Code != http.StatusOK {
+		t.Fatalf("ChangeRole = %d %s", w.Code, w.Body)
+	}
+	db.First(&group, group.ID)
+	if group.OwnerID != bob.ID {
+		t.Fatalf("owner = %d, want %d", group.OwnerID, bob.ID)
+	}
+	var old models.GroupMember
+	db.Where("group_id = ? AND user_id = ?", group.ID, alice.ID).First(&old)
+	if old.Role != models.RoleAdmin {
+		t.Errorf("the old owner is %s, want %s", old.Role, models.RoleAdmin)
+	}
+
+	// The new owner holds the owner's permissions, the old one doesn't
+	if w := setRole(gc, alice, group.ID, carol.ID, models.RoleAdmin); w.Code != http.StatusForbidden {
+		t.Errorf("ChangeRole by the old owner = %d, want 403", w.Code)
+	}
+	if w := setRole(gc, bob, group.ID, carol.ID, models.RoleAdmin); w.Code != http.StatusOK {
+		t.Errorf("ChangeRole by the new owner = %d", w.Code)
+	}
+	if w := setRole(gc, bob, group.ID, alice.ID, models.RoleMember); w.Code != http.StatusOK {
+		t.Fatalf("demoting the old owner = %d %s", w.Code, w.Body)
+	}
+
+	// When the owner leaves, an admin takes over before longer-standing
+	// plain members
+	if w := serveAs(gc.LeaveGroup, bob, groupVars(group.ID), nil); w.Code != http.StatusOK {
+		t.Fatalf("LeaveGroup = %d %s", w.Code, w.Body)
+	}
+	db.First(&group, group.ID)
+	if group.OwnerID != carol.ID {
+		t.Errorf("owner after the owner left = %d, want the admin %d", group.OwnerID, carol.ID)
+	}
+}
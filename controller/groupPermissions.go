@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"github/similadayo/chitchat/models"
+)
+
+// GroupPermission is an action a group member may be allowed to take
+type GroupPermission string
+
+const (
+	PermPost                 GroupPermission = "post"
+	PermManageMembers        GroupPermission = "manage_members"
+	PermEditGroup            GroupPermission = "edit_group"
+	PermPinMessages          GroupPermission = "pin_messages"
+	PermDeleteOthersMessages GroupPermission = "delete_others_messages"
+	PermChangeRoles          GroupPermission = "change_roles"
+)
+
+// rolePermissions lists what each role may do, before group settings apply
+var rolePermissions = map[string][]GroupPermission{
+	models.RoleOwner: {
+		PermPost, PermManageMembers, PermEditGroup, PermPinMessages,
+		PermDeleteOthersMessages, PermChangeRoles,
+	},
+	models.RoleAdmin: {
+		PermPost, PermManageMembers, PermEditGroup, PermPinMessages,
+		PermDeleteOthersMessages,
+	},
+	models.RoleMember:   {PermPost},
+	models.RoleReadOnly: {},
+}
+
+// roleRank orders roles from least to most privileged
+var roleRank = map[string]int{
+	models.RoleReadOnly: 0,
+	models.RoleMember:   1,
+	models.RoleAdmin:    2,
+	models.RoleOwner:    3,
+}
+
+// isValidRole reports whether role is one of the known group roles
+func isValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// effectiveRole returns the member's role. The group's OwnerID always wins so
+// memberships created before roles existed still resolve correctly.
+func effectiveRole(group *models.Group, member *models.GroupMember) string {
+	if group.OwnerID == member.UserID {
+		return models.RoleOwner
+	}
+	if !isValidRole(member.Role) || member.Role == models.RoleOwner {
+		return models.RoleMember
+	}
+	return member.Role
+}
+
+// canInGroup decides whether a member may perform an action in the group
+func canInGroup(group *models.Group, member *models.GroupMember, perm GroupPermission) bool {
+	role := effectiveRole(group, member)
+
+	// Announcement channels only let the owner and admins post
+	if perm == PermPost && group.AnnouncementOnly && roleRank[role] < roleRank[models.RoleAdmin] {
+		return false
+	}
+
+	for _, allowed := range rolePermissions[role] {
+		if allowed == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// outranks reports whether the actor's role is strictly above the target's,
+// which is required to remove someone from the group
+func outranks(group *models.Group, actor, target *models.GroupMember) bool {
+	return roleRank[effectiveRole(group, actor)] > roleRank[effectiveRole(group, target)]
+}
@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+var errNoUserInContext = errors.New("could not extract user from context")
+
+// currentUser loads the authenticated user from the request context
+func currentUser(db *gorm.DB, r *http.Request) (*models.User, error) {
+	username, ok := utils.GetUserFromContext(r.Context())
+	if !ok {
+		return nil, errNoUserInContext
+	}
+
+	var user models.User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// pathID parses a numeric path variable such as {id}
+func pathID(r *http.Request, name string) (uint, error) {
+	return utils.ConvertToUint(mux.Vars(r)[name])
+}
@@ -0,0 +1,302 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ConversationSummary is one entry of a user's inbox. Exactly one of Peer and
+// Group is set.
+type ConversationSummary struct {
+	ID           string          `json:"id"`
+	Peer         *models.User    `json:"peer,omitempty"`
+	Group        *models.Group   `json:"group,omitempty"`
+	LastMessage  *models.Message `json:"last_message"`
+	LastActivity *time.Time      `json:"last_activity,omitempty"`
+	UnreadCount  int64           `json:"unread_count"`
+	Muted        bool            `json:"muted"`
+	Pinned       bool            `json:"pinned"`
+	Archived     bool            `json:"archived"`
+
+	conv          conversationRef
+	lastMessageID uint
+}
+
+// InboxPage is one page of a user's conversations
+type InboxPage struct {
+	Conversations []ConversationSummary `json:"conversations"`
+	NextCursor    string                `json:"next_cursor,omitempty"`
+}
+
+// inboxRow is a conversation as aggregated by the inbox queries, with the
+// user's settings for it
+type inboxRow struct {
+	PeerID        uint `gorm:"column:conv_peer_id"`
+	GroupID       uint
+	LastMessageID uint
+	Unread        int64
+	Muted         bool
+	IsPinned      bool
+	Archived      bool
+}
+
+// inboxCursor is the position of a conversation in the inbox ordering
+type inboxCursor struct {
+	Pinned        bool `json:"p,omitempty"`
+	LastMessageID uint `json:"m"`
+	GroupID       uint `json:"g,omitempty"`
+	PeerID        uint `json:"u,omitempty"`
+}
+
+func (c inboxCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeInboxCursor(s string) (*inboxCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, utils.ErrInvalidCursor
+	}
+	var cursor inboxCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || (cursor.GroupID == 0) == (cursor.PeerID == 0) {
+		return nil, utils.ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// before reports whether a conversation at position c is listed ahead of
+// one at position o: pinned conversations first, then the most recently
+// active. Message IDs grow with time, so the last message ID stands in for
+// the activity time; groups without messages go last. It must agree with
+// inboxOrder.
+func (c inboxCursor) before(o inboxCursor) bool {
+	if c.Pinned != o.Pinned {
+		return c.Pinned
+	}
+	if c.LastMessageID != o.LastMessageID {
+		return c.LastMessageID > o.LastMessageID
+	}
+	if c.GroupID != o.GroupID {
+		return c.GroupID > o.GroupID
+	}
+	return c.PeerID > o.PeerID
+}
+
+func (s *ConversationSummary) position() inboxCursor {
+	return inboxCursor{Pinned: s.Pinned, LastMessageID: s.lastMessageID, GroupID: s.conv.GroupID, PeerID: s.conv.PeerID}
+}
+
+// inboxOrder is the SQL form of inboxCursor.before
+const inboxOrder = "is_pinned DESC, c.last_message_id DESC, c.group_id DESC, c.conv_peer_id DESC"
+
+// Inbox lists the direct conversations and groups of the user, with their
+// last message and unread count. Archived conversations are listed only when
+// archived is set, and only those. Direct conversations and groups are each
+// paged in SQL and the two pages merged; messages, peers and groups are then
+// loaded for the returned page only.
+func (ms *MessageService) Inbox(userID uint, after string, limit int, archived bool) (*InboxPage, error) {
+	var position *inboxCursor
+	if after != "" {
+		var err error
+		if position, err = decodeInboxCursor(after); err != nil {
+			return nil, err
+		}
+	}
+
+	hidden := hiddenMessageIDs(ms.DB, userID)
+	unread := "SUM(CASE WHEN m.sender_id <> ? AND m.is_deleted = ? AND m.id > COALESCE(w.last_read_message_id, 0) THEN 1 ELSE 0 END)"
+
+	// The peer of a direct message. It is aliased conv_peer_id because a
+	// bare peer_id would group by read_watermarks.peer_id.
+	peer := "CASE WHEN m.sender_id = ? THEN m.receiver_id ELSE m.sender_id END"
+
+	direct := ms.DB.Table("messages AS m").
+		Select(peer+" AS conv_peer_id, 0 AS group_id, MAX(m.id) AS last_message_id, "+unread+" AS unread", userID, userID, false).
+		Joins("LEFT JOIN read_watermarks w ON w.user_id = ? AND w.group_id = 0 AND w.peer_id = "+peer, userID, userID).
+		Where("m.group_id = 0 AND (m.sender_id = ? OR m.receiver_id = ?)", userID, userID).
+		Where("m.deleted_at IS NULL AND m.id NOT IN (?)", hidden).
+		Group("conv_peer_id")
+
+	groups := ms.DB.Table("group_members AS gm").
+		Select("0 AS conv_peer_id, gm.group_id, COALESCE(MAX(m.id), 0) AS last_message_id, "+unread+" AS unread", userID, false).
+		Joins("LEFT JOIN messages m ON m.group_id = gm.group_id AND m.deleted_at IS NULL AND m.id NOT IN (?)", hidden).
+		Joins("LEFT JOIN read_watermarks w ON w.user_id = gm.user_id AND w.group_id = gm.group_id AND w.peer_id = 0").
+		Where("gm.user_id = ? AND gm.group_id IN (?)", userID, ms.DB.Model(&models.Group{}).Select("id")).
+		Group("gm.group_id")
+
+	var rows []inboxRow
+	for _, convs := range []*gorm.DB{direct, groups} {
+		page, err := ms.inboxRows(convs, userID, position, limit+1, archived)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, page...)
+	}
+
+	summaries := make([]ConversationSummary, 0, len(rows))
+	for _, row := range rows {
+		conv := conversationRef{PeerID: row.PeerID, GroupID: row.GroupID}
+		summaries = append(summaries, ConversationSummary{
+			ID:            conv.String(),
+			UnreadCount:   row.Unread,
+			Muted:         row.Muted,
+			Pinned:        row.IsPinned,
+			Archived:      row.Archived,
+			conv:          conv,
+			lastMessageID: row.LastMessageID,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].position().before(summaries[j].position())
+	})
+
+	page := &InboxPage{Conversations: summaries}
+	if len(summaries) > limit {
+		page.Conversations = summaries[:limit]
+		page.NextCursor = page.Conversations[limit-1].position().encode()
+	}
+
+	if err := ms.loadSummaries(page.Conversations); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// inboxRows joins the user's settings onto the aggregated conversations and
+// returns the first limit of them after position in inbox order
+func (ms *MessageService) inboxRows(convs *gorm.DB, userID uint, position *inboxCursor, limit int, archived bool) ([]inboxRow, error) {
+	pinned := "COALESCE(s.pinned, ?)"
+	query := ms.DB.Table("(?) AS c", convs).
+		Select("c.*, COALESCE(s.muted, ?) AS muted, "+pinned+" AS is_pinned, COALESCE(s.archived, ?) AS archived", false, false, false).
+		Joins("LEFT JOIN conversation_settings s ON s.user_id = ? AND s.peer_id = c.conv_peer_id AND s.group_id = c.group_id", userID).
+		Where("COALESCE(s.archived, ?) = ?", false, archived)
+
+	if position != nil {
+		query = query.Where(pinned+" < ? OR ("+pinned+" = ? AND (c.last_message_id < ? OR (c.last_message_id = ? AND "+
+			"(c.group_id < ? OR (c.group_id = ? AND c.conv_peer_id < ?)))))",
+			false, position.Pinned, false, position.Pinned,
+			position.LastMessageID, position.LastMessageID,
+			position.GroupID, position.GroupID, position.PeerID)
+	}
+
+	var rows []inboxRow
+	err := query.Order(inboxOrder).Limit(limit).Scan(&rows).Error
+	return rows, err
+}
+
+// loadSummaries fills in the last message, peer and group of each summary
+func (ms *MessageService) loadSummaries(summaries []ConversationSummary) error {
+	var messageIDs, peerIDs, groupIDs []uint
+	for _, summary := range summaries {
+		if summary.lastMessageID != 0 {
+			messageIDs = append(messageIDs, summary.lastMessageID)
+		}
+		if summary.conv.GroupID != 0 {
+			groupIDs = append(groupIDs, summary.conv.GroupID)
+		} else {
+			peerIDs = append(peerIDs, summary.conv.PeerID)
+		}
+	}
+
+	messages := make(map[uint]*models.Message)
+	if len(messageIDs) > 0 {
+		var found []models.Message
+		if err := ms.DB.Preload("Sender").Preload("Attachments.Variants").Where("id IN ?", messageIDs).Find(&found).Error; err != nil {
+			return err
+		}
+		for i := range found {
+			messages[found[i].ID] = &found[i]
+		}
+	}
+
+	peers := make(map[uint]*models.User)
+	if len(peerIDs) > 0 {
+		var found []models.User
+		if err := ms.DB.Where("id IN ?", peerIDs).Find(&found).Error; err != nil {
+			return err
+		}
+		for i := range found {
+			peers[found[i].ID] = &found[i]
+		}
+	}
+
+	groups := make(map[uint]*models.Group)
+	if len(groupIDs) > 0 {
+		var found []models.Group
+		if err := ms.DB.Where("id IN ?", groupIDs).Find(&found).Error; err != nil {
+			return err
+		}
+		for i := range found {
+			groups[found[i].ID] = &found[i]
+		}
+	}
+
+	for i := range summaries {
+		summary := &summaries[i]
+		summary.LastMessage = messages[summary.lastMessageID]
+		if summary.LastMessage != nil {
+			summary.LastActivity = &summary.LastMessage.Timestamp
+		}
+		if summary.conv.GroupID != 0 {
+			summary.Group = groups[summary.conv.GroupID]
+		} else {
+			summary.Peer = peers[summary.conv.PeerID]
+		}
+	}
+	return nil
+}
+
+// ConversationSettingsUpdate changes the flags that are set and leaves the
+// others alone
+type ConversationSettingsUpdate struct {
+	Muted    *bool `json:"muted"`
+	Pinned   *bool `json:"pinned"`
+	Archived *bool `json:"archived"`
+}
+
+// UpdateSettings changes the user's mute, pin and archive flags for a
+// conversation they can see
+func (ms *MessageService) UpdateSettings(userID uint, conv conversationRef, update ConversationSettingsUpdate) (*models.ConversationSetting, error) {
+	if conv.GroupID != 0 {
+		if err := ms.checkGroupMember(conv.GroupID, userID); err != nil {
+			return nil, err
+		}
+	} else {
+		var peer models.User
+		if err := ms.DB.First(&peer, conv.PeerID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrPeerNotFound
+			}
+			return nil, err
+		}
+	}
+
+	setting := models.ConversationSetting{UserID: userID, PeerID: conv.PeerID, GroupID: conv.GroupID}
+	if err := ms.DB.Where("user_id = ? AND peer_id = ? AND group_id = ?", userID, conv.PeerID, conv.GroupID).
+		FirstOrInit(&setting).Error; err != nil {
+		return nil, err
+	}
+
+	if update.Muted != nil {
+		setting.Muted = *update.Muted
+	}
+	if update.Pinned != nil {
+		setting.Pinned = *update.Pinned
+	}
+	if update.Archived != nil {
+		setting.Archived = *update.Archived
+	}
+
+	if err := ms.DB.Save(&setting).Error; err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
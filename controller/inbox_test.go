@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"reflect"
+	"testing"
+)
+
+// inboxIDs lists the conversation IDs of an inbox page in order
+func inboxIDs(page *InboxPage) []string {
+	ids := []string{}
+	for _, summary := range page.Conversations {
+		ids = append(ids, summary.ID)
+	}
+	return ids
+}
+
+func TestInbox(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	gc := NewGroupController(ms)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	group := createTestGroup(t, gc, bob, alice)
+
+	sendTestMessage(t, ms, bob, alice, "one")
+	first := sendTestMessage(t, ms, bob, alice, "two")
+	sendTestMessage(t, ms, bob, alice, "three")
+	last := sendTestMessage(t, ms, alice, bob, "mine")
+	groupMessage := models.Message{Content: "hi all", GroupID: group.ID}
+	if err := ms.Send(bob.ID, &groupMessage); err != nil {
+		t.Fatal(err)
+	}
+	sendTestMessage(t, ms, bob, carol, "not alice's")
+	if _, err := ms.MarkRead(alice.ID, conversationRef{PeerID: bob.ID}, first.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := ms.Inbox(alice.ID, "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobConv := conversationRef{PeerID: bob.ID}.String()
+	groupConv := conversationRef{GroupID: group.ID}.String()
+	if got, want := inboxIDs(page), []string{groupConv, bobConv}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("inbox = %v, want %v", got, want)
+	}
+
+	// Only messages from the peer after the watermark are unread
+	direct := page.Conversations[1]
+	if direct.UnreadCount != 1 || direct.Peer == nil || direct.Peer.ID != bob.ID {
+		t.Errorf("direct conversation = unread %d, peer %v", direct.UnreadCount, direct.Peer)
+	}
+	if direct.LastMessage == nil || direct.LastMessage.ID != last.ID || direct.LastActivity == nil {
+		t.Errorf("last message = %v, want %d", direct.LastMessage, last.ID)
+	}
+	if summary := page.Conversations[0]; summary.UnreadCount != 1 || summary.Group == nil || summary.Group.ID != group.ID {
+		t.Errorf("group conversation = unread %d, group %v", summary.UnreadCount, summary.Group)
+	}
+
+	// Settings show up on the summary; archiving moves it to the archive
+	yes := true
+	if _, err := ms.UpdateSettings(alice.ID, conversationRef{PeerID: bob.ID}, ConversationSettingsUpdate{Muted: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ = ms.Inbox(alice.ID, "", 10, false); !page.Conversations[1].Muted {
+		t.Error("muted conversation isn't muted")
+	}
+	if _, err := ms.UpdateSettings(alice.ID, conversationRef{GroupID: group.ID}, ConversationSettingsUpdate{Archived: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ = ms.Inbox(alice.ID, "", 10, false); !reflect.DeepEqual(inboxIDs(page), []string{bobConv}) {
+		t.Errorf("inbox = %v, want only %s", inboxIDs(page), bobConv)
+	}
+	if page, _ = ms.Inbox(alice.ID, "", 10, true); !reflect.DeepEqual(inboxIDs(page), []string{groupConv}) || !page.Conversations[0].Archived {
+		t.Errorf("archive = %v, want only %s", inboxIDs(page), groupConv)
+	}
+
+	// Settings only apply to conversations the user can see
+	if _, err := ms.UpdateSettings(carol.ID, conversationRef{GroupID: group.ID}, ConversationSettingsUpdate{Muted: &yes}); !errors.Is(err, ErrNotGroupMember) {
+		t.Errorf("UpdateSettings() by an outsider = %v, want %v", err, ErrNotGroupMember)
+	}
+	if _, err := ms.UpdateSettings(alice.ID, conversationRef{PeerID: carol.ID + 100}, ConversationSettingsUpdate{Muted: &yes}); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("UpdateSettings() with a missing peer = %v, want %v", err, ErrPeerNotFound)
+	}
+}
+
+func TestInboxPaging(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	gc := NewGroupController(ms)
+	alice := createTestUser(t, db, "alice")
+
+	// Two empty groups, then a conversation with each peer in turn
+	quiet := createTestGroup(t, gc, alice)
+	quieter := createTestGroup(t, gc, alice)
+	var peers []models.User
+	for _, name := range []string{"bob", "carol", "dave", "erin"} {
+		peer := createTestUser(t, db, name)
+		sendTestMessage(t, ms, peer, alice, "hi")
+		peers = append(peers, peer)
+	}
+	yes := true
+	if _, err := ms.UpdateSettings(alice.ID, conversationRef{PeerID: peers[0].ID}, ConversationSettingsUpdate{Pinned: &yes}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		conversationRef{PeerID: peers[0].ID}.String(),
+		conversationRef{PeerID: peers[3].ID}.String(),
+		conversationRef{PeerID: peers[2].ID}.String(),
+		conversationRef{PeerID: peers[1].ID}.String(),
+		conversationRef{GroupID: quieter.ID}.String(),
+		conversationRef{GroupID: quiet.ID}.String(),
+	}
+
+	var got []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("paging doesn't end")
+		}
+		page, err := ms.Inbox(alice.ID, after, 2, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, inboxIDs(page)...)
+		if page.NextCursor == "" {
+			break
+		}
+		after = page.NextCursor
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paged inbox = %v, want %v", got, want)
+	}
+
+	if _, err := ms.Inbox(alice.ID, "bogus", 2, false); !errors.Is(err, utils.ErrInvalidCursor) {
+		t.Errorf("Inbox() with a bad cursor = %v, want %v", err, utils.ErrInvalidCursor)
+	}
+}
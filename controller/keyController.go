@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"github/similadayo/chitchat/utils"
+	"net/http"
+)
+
+type KeyController struct {
+	Keys *KeyStore
+}
+
+// NewKeyController creates a new key controller
+func NewKeyController(keys *KeyStore) *KeyController {
+	return &KeyController{Keys: keys}
+}
+
+// GetJWKS publishes the public keys tokens are signed with, so other
+// services can verify chitchat tokens without sharing a secret. HS256 keys
+// are secret and never listed.
+func (kc *KeyController) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	// Verifiers may cache the keys briefly; new keys are published before
+	// they start signing
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.RespondWithJSON(w, http.StatusOK, kc.Keys.Manager.JWKS())
+}
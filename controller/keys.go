@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github/similadayo/chitchat/config"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrKeyNotFound      = errors.New("signing key not found")
+	ErrRetireSigningKey = errors.New("the key is signing tokens, rotate in a new key before retiring it")
+)
+
+// LegacyKid names the JWT_KEY secret in the keys command. Its tokens carry
+// no kid, so retiring it is recorded under this name instead.
+const LegacyKid = "legacy"
+
+// KeyStore loads the JWT signing keys from the database into the key
+// manager that GenerateJwt and ParseJwt use, and reloads them every
+// KeyRefresh to pick up keys rotated by the keys command
+type KeyStore struct {
+	DB      *gorm.DB
+	Config  utils.AuthConfig
+	Manager *utils.KeyManager
+
+	// legacy is the JWT_KEY secret, if set
+	legacy *utils.SigningKey
+	// warnedPlaintext is set once stored keys that aren't encrypted have
+	// been reported
+	warnedPlaintext bool
+}
+
+// NewKeyStore loads the keys and installs them for GenerateJwt and
+// ParseJwt. Call Start to keep them up to date.
+func NewKeyStore(db *gorm.DB) *KeyStore {
+	ks := &KeyStore{DB: db, Config: config.LoadAuthConfig(), Manager: utils.NewKeyManager()}
+	if len(ks.Config.JWTSecret) > 0 {
+		ks.legacy = utils.NewHMACKey("", ks.Config.JWTSecret)
+	}
+	if err := ks.Load(); err != nil {
+		panic(err)
+	}
+	utils.UseKeyManager(ks.Manager)
+	return ks
+}
+
+// Start reloads the keys every KeyRefresh
+func (ks *KeyStore) Start() {
+	go func() {
+		ticker := time.NewTicker(ks.Config.KeyRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := ks.Load(); err != nil {
+				log.Printf("Error loading signing keys: %v", err)
+			}
+		}
+	}()
+}
+
+// Load reads the keys that aren't retired. The newest active one signs;
+// the legacy secret only signs while there's none. Without any key to sign
+// with, tokens couldn't outlive the process, so Load fails instead.
+func (ks *KeyStore) Load() error {
+	var rows []models.SigningKey
+	if err := ks.DB.Where("retired_at IS NULL AND kid <> ?", LegacyKid).
+		Order("activates_at, id").Find(&rows).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var keys []*utils.SigningKey
+	var signing *utils.SigningKey
+	plaintext := 0
+	for _, row := range rows {
+		if !utils.IsSealed(row.PrivateKey) {
+			plaintext++
+		}
+		encoded, err := utils.OpenSigningKey(ks.Config.KeyEncryptionKey, row.Kid, row.PrivateKey)
+		if err != nil {
+			return err
+		}
+		key, err := utils.ParseSigningKey(row.Kid, row.Algorithm, encoded)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		if !row.ActivatesAt.After(now) {
+			signing = key
+		}
+	}
+	if plaintext > 0 && !ks.warnedPlaintext {
+		log.Printf("%d signing keys are stored unencrypted, rotate and retire them", plaintext)
+		ks.warnedPlaintext = true
+	}
+
+	legacy := ks.legacy
+	if legacy != nil {
+		retired, err := legacyRetired(ks.DB)
+		if err != nil {
+			return err
+		}
+		if retired {
+			legacy = nil
+		}
+	}
+	if legacy != nil {
+		keys = append(keys, legacy)
+		if signing == nil {
+			signing = legacy
+		}
+	}
+
+	if signing == nil {
+		return fmt.Errorf("%w: set JWT_KEY or run \"chitchat keys rotate -activate-in 0\"", utils.ErrNoSigningKey)
+	}
+	ks.Manager.SetKeys(keys, signing)
+	return nil
+}
+
+// legacyRetired reports whether the JWT_KEY secret was retired
+func legacyRetired(db *gorm.DB) (bool, error) {
+	var count int64
+	err := db.Model(&models.SigningKey{}).
+		Where("kid = ? AND retired_at IS NOT NULL", LegacyKid).Count(&count).Error
+	return count > 0, err
+}
+
+// RotateKey generates a key for the algorithm that starts signing tokens
+// after activateIn, and stores it encrypted with the key encryption key. The
+// previous keys keep verifying tokens until they are retired, which is safe
+// once the access tokens they signed have expired.
+func RotateKey(db *gorm.DB, kek []byte, algorithm string, activateIn time.Duration) (*models.SigningKey, error) {
+	key, encoded, err := utils.GenerateSigningKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := utils.SealSigningKey(kek, key.Kid, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	row := &models.SigningKey{
+		Kid:         key.Kid,
+		Algorithm:   key.Algorithm,
+		PrivateKey:  sealed,
+		ActivatesAt: time.Now().Add(activateIn),
+	}
+	if err := db.Create(row).Error; err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// RetireKey stops a key from verifying tokens. The key currently signing
+// can't be retired. LegacyKid retires the JWT_KEY secret on every server,
+// once a rotated key signs in its place.
+func RetireKey(db *gorm.DB, kid string) error {
+	var signing models.SigningKey
+	err := db.Where("retired_at IS NULL AND activates_at <= ? AND kid <> ?", time.Now(), LegacyKid).
+		Order("activates_at DESC, id DESC").First(&signing).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	hasSigning := err == nil
+
+	if kid == LegacyKid {
+		if !hasSigning {
+			return ErrRetireSigningKey
+		}
+		now := time.Now()
+		legacy := models.SigningKey{Kid: LegacyKid, Algorithm: utils.AlgHS256, ActivatesAt: now}
+		return db.Where("kid = ?", LegacyKid).
+			Assign(models.SigningKey{RetiredAt: &now}).FirstOrCreate(&legacy).Error
+	}
+
+	var key models.SigningKey
+	if err := db.Where("kid = ? AND retired_at IS NULL", kid).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+	if hasSigning && signing.ID == key.ID {
+		return ErrRetireSigningKey
+	}
+
+	return db.Model(&key).Update("retired_at", time.Now()).Error
+}
+
+// ListKeys returns every key, newest first
+func ListKeys(db *gorm.DB) ([]models.SigningKey, error) {
+	var keys []models.SigningKey
+	if err := db.Order("activates_at DESC, id DESC").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// parseHeader decodes a token without verifying it
+func parseHeader(t *testing.T, token string) *jwt.Token {
+	t.Helper()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &utils.Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestKeyStore(t *testing.T) {
+	db := newTestDB(t)
+	kek := bytes.Repeat([]byte{7}, utils.KeyEncryptionKeySize)
+	// NewKeyStore reads the settings from the environment
+	newStore := func(secret string) *KeyStore {
+		ks := &KeyStore{DB: db, Config: utils.AuthConfig{KeyEncryptionKey: kek}, Manager: utils.NewKeyManager()}
+		if secret != "" {
+			ks.legacy = utils.NewHMACKey("", []byte(secret))
+		}
+		return ks
+	}
+	sign := func(ks *KeyStore) (string, error) {
+		return ks.Manager.Sign(&utils.Claims{SessionID: "s1"})
+	}
+
+	if err := newStore("").Load(); !errors.Is(err, utils.ErrNoSigningKey) {
+		t.Fatalf("loading without any key = %v, want ErrNoSigningKey", err)
+	}
+
+	ks := newStore("legacy secret")
+	if err := ks.Load(); err != nil {
+		t.Fatal(err)
+	}
+	legacyToken, err := sign(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing else signs yet, so the legacy secret can't be retired
+	if err := RetireKey(db, LegacyKid); !errors.Is(err, ErrRetireSigningKey) {
+		t.Fatalf("retiring the only signing key = %v, want ErrRetireSigningKey", err)
+	}
+
+	if _, err := RotateKey(db, nil, utils.AlgEdDSA, 0); !errors.Is(err, utils.ErrNoKeyEncryptionKey) {
+		t.Errorf("rotating without an encryption key = %v, want ErrNoKeyEncryptionKey", err)
+	}
+	row, err := RotateKey(db, kek, utils.AlgEdDSA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.IsSealed(row.PrivateKey) {
+		t.Error("the rotated key was stored unencrypted")
+	}
+
+	if err := ks.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Manager.Keyfunc(parseHeader(t, legacyToken)); err != nil {
+		t.Errorf("legacy tokens stopped verifying after the rotation: %v", err)
+	}
+	if err := RetireKey(db, row.Kid); !errors.Is(err, ErrRetireSigningKey) {
+		t.Errorf("retiring the signing key = %v, want ErrRetireSigningKey", err)
+	}
+
+	// With the rotated key signing, the legacy secret retires on every
+	// server that loads the keys, even those still configured with it
+	if err := RetireKey(db, LegacyKid); err != nil {
+		t.Fatal(err)
+	}
+	other := newStore("legacy secret")
+	if err := other.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Manager.Keyfunc(parseHeader(t, legacyToken)); err == nil {
+		t.Error("a retired legacy token still verifies")
+	}
+	token, err := sign(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := parseHeader(t, token).Header["kid"]; kid != row.Kid {
+		t.Errorf("signed with kid %v, want %s", kid, row.Kid)
+	}
+
+	t.Run("key moved to another row", func(t *testing.T) {
+		moved := models.SigningKey{Kid: "moved", Algorithm: row.Algorithm, PrivateKey: row.PrivateKey, ActivatesAt: time.Now().Add(time.Hour)}
+		if err := db.Create(&moved).Error; err != nil {
+			t.Fatal(err)
+		}
+		defer db.Delete(&moved)
+		if err := newStore("").Load(); err == nil {
+			t.Error("a sealed key opened under another kid")
+		}
+	})
+
+	t.Run("wrong encryption key", func(t *testing.T) {
+		ks := newStore("")
+		ks.Config.KeyEncryptionKey = bytes.Repeat([]byte{8}, utils.KeyEncryptionKeySize)
+		if err := ks.Load(); err == nil {
+			t.Error("keys loaded with the wrong encryption key")
+		}
+	})
+}
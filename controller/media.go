@@ -0,0 +1,279 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// thumbnailQuality is the JPEG quality of opaque thumbnails
+const thumbnailQuality = 82
+
+var errImageTooLarge = errors.New("image has too many pixels to process")
+
+// processable reports whether the media workers can decode the content type
+func processable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// MediaProcessor generates thumbnails and image metadata for uploads on a
+// pool of background workers, so uploads return as soon as the file is
+// stored. Attachments are queued by ID and stay pending until processed.
+type MediaProcessor struct {
+	DB      *gorm.DB
+	Hub     *utils.Hub
+	Storage utils.Storage
+	Config  utils.MediaConfig
+
+	jobs chan uint
+}
+
+// NewMediaProcessor creates a processor; Start launches its workers
+func NewMediaProcessor(db *gorm.DB, hub *utils.Hub, storage utils.Storage, cfg utils.MediaConfig) *MediaProcessor {
+	return &MediaProcessor{DB: db, Hub: hub, Storage: storage, Config: cfg, jobs: make(chan uint, cfg.QueueSize)}
+}
+
+// Start launches the workers and requeues the images left pending by a
+// previous run
+func (mp *MediaProcessor) Start() {
+	for i := 0; i < mp.Config.Workers; i++ {
+		go mp.work()
+	}
+
+	go func() {
+		var pending []uint
+		if err := mp.DB.Model(&models.Attachment{}).Where("media_status = ?", models.MediaPending).
+			Order("id").Pluck("id", &pending).Error; err != nil {
+			log.Printf("Error loading pending attachments: %v", err)
+			return
+		}
+		for _, id := range pending {
+			mp.jobs <- id
+		}
+	}()
+}
+
+// Enqueue schedules an attachment for processing. When the queue is full
+// the attachment stays pending and is picked up on the next start.
+func (mp *MediaProcessor) Enqueue(id uint) {
+	select {
+	case mp.jobs <- id:
+	default:
+		log.Printf("Media queue is full, attachment %d stays pending", id)
+	}
+}
+
+func (mp *MediaProcessor) work() {
+	for id := range mp.jobs {
+		if err := mp.process(id); err != nil {
+			log.Printf("Error processing attachment %d: %v", id, err)
+			mp.DB.Model(&models.Attachment{}).Where("id = ?", id).Update("media_status", models.MediaFailed)
+		}
+	}
+}
+
+// process decodes a pending image, stores its thumbnails next to the
+// original and records its dimensions and blurhash
+func (mp *MediaProcessor) process(id uint) error {
+	var attachment models.Attachment
+	if err := mp.DB.First(&attachment, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if attachment.MediaStatus != models.MediaPending {
+		return nil
+	}
+
+	done, err := mp.copyProcessed(&attachment)
+	if err != nil || done {
+		return err
+	}
+
+	ctx := context.Background()
+	body, err := mp.Storage.Get(ctx, attachment.Key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, attachment.Size))
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	header, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if header.Width*header.Height > mp.Config.MaxPixels {
+		return errImageTooLarge
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	img := utils.ToNRGBA(decoded, utils.ImageOrientation(bytes.NewReader(data), attachment.ContentType))
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	opaque := utils.IsOpaque(img)
+
+	var variants []models.AttachmentVariant
+	for _, size := range mp.Config.ThumbnailSizes {
+		// Thumbnails are never larger than the original
+		if size >= width && size >= height {
+			continue
+		}
+		variant, err := mp.storeThumbnail(ctx, &attachment, img, size, opaque)
+		if err != nil {
+			return err
+		}
+		variants = append(variants, *variant)
+	}
+
+	hashWidth, hashHeight := utils.FitSize(width, height, 32)
+	blurHash := utils.BlurHash(utils.Resize(img, hashWidth, hashHeight), 4, 3)
+
+	err = mp.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("attachment_id = ?", attachment.ID).Delete(&models.AttachmentVariant{}).Error; err != nil {
+			return err
+		}
+		if len(variants) > 0 {
+			if err := tx.Create(&variants).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&attachment).Updates(map[string]interface{}{
+			"width":        width,
+			"height":       height,
+			"blur_hash":    blurHash,
+			"media_status": models.MediaReady,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	return mp.notify(attachment.ID)
+}
+
+// copyProcessed reuses the results of an earlier upload of the same file,
+// reporting whether there was one
+func (mp *MediaProcessor) copyProcessed(attachment *models.Attachment) (bool, error) {
+	var original models.Attachment
+	err := mp.DB.Preload("Variants").
+		Where(&models.Attachment{Key: attachment.Key, MediaStatus: models.MediaReady}).
+		Where("id <> ?", attachment.ID).
+		First(&original).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = mp.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("attachment_id = ?", attachment.ID).Delete(&models.AttachmentVariant{}).Error; err != nil {
+			return err
+		}
+		for _, variant := range original.Variants {
+			variant.ID = 0
+			variant.AttachmentID = attachment.ID
+			if err := tx.Create(&variant).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(attachment).Updates(map[string]interface{}{
+			"width":        original.Width,
+			"height":       original.Height,
+			"blur_hash":    original.BlurHash,
+			"media_status": models.MediaReady,
+		}).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, mp.notify(attachment.ID)
+}
+
+// storeThumbnail scales the image to fit size and stores it under a key
+// derived from the original's, so duplicate uploads share thumbnails too.
+// Images with transparency stay PNG, everything else becomes JPEG.
+func (mp *MediaProcessor) storeThumbnail(ctx context.Context, attachment *models.Attachment, img *image.NRGBA, size int, opaque bool) (*models.AttachmentVariant, error) {
+	width, height := utils.FitSize(img.Bounds().Dx(), img.Bounds().Dy(), size)
+	thumbnail := utils.Resize(img, width, height)
+
+	var buf bytes.Buffer
+	contentType := "image/jpeg"
+	if opaque {
+		if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return nil, err
+		}
+	} else {
+		contentType = "image/png"
+		if err := png.Encode(&buf, thumbnail); err != nil {
+			return nil, err
+		}
+	}
+
+	key := fmt.Sprintf("%s-%d", attachment.Key, size)
+	exists, err := mp.Storage.Exists(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := mp.Storage.Put(ctx, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), contentType); err != nil {
+			return nil, err
+		}
+	}
+
+	return &models.AttachmentVariant{
+		AttachmentID: attachment.ID,
+		Size:         size,
+		Key:          key,
+		ContentType:  contentType,
+		Width:        width,
+		Height:       height,
+		Bytes:        int64(buf.Len()),
+	}, nil
+}
+
+// notify sends the processed attachment to its uploader and, once it is
+// linked to a message, to everyone in that conversation
+func (mp *MediaProcessor) notify(id uint) error {
+	var attachment models.Attachment
+	if err := mp.DB.Preload("Variants").First(&attachment, id).Error; err != nil {
+		return err
+	}
+
+	userIDs := []uint{attachment.UploaderID}
+	if attachment.MessageID != nil {
+		var message models.Message
+		if err := mp.DB.First(&message, *attachment.MessageID).Error; err == nil {
+			if message.GroupID != 0 {
+				members, err := groupMemberIDs(mp.DB, message.GroupID)
+				if err != nil {
+					log.Printf("Error loading the members of group %d: %v", message.GroupID, err)
+				}
+				userIDs = append(userIDs, members...)
+			} else if message.ReceiverID != nil {
+				userIDs = append(userIDs, *message.ReceiverID)
+			}
+		}
+	}
+	mp.Hub.SendEvent(utils.EventAttachmentProcessed, attachment, uniqueIDs(userIDs)...)
+	return nil
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testImage encodes a width×height PNG
+func testImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestMedia processes the uploads of as, without workers
+func newTestMedia(as *AttachmentService, hub *utils.Hub) *MediaProcessor {
+	cfg := utils.DefaultMediaConfig()
+	cfg.ThumbnailSizes = []int{40, 100, 1000}
+	return NewMediaProcessor(as.DB, hub, as.Storage, cfg)
+}
+
+func TestProcessImage(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	as := newTestAttachments(t, db)
+	mp := newTestMedia(as, hub)
+	alice := createTestUser(t, db, "alice")
+	uploader := connectTestClient(hub, alice.ID)
+
+	upload := storeTestFile(t, as, alice, testImage(t, 200, 100))
+	if upload.MediaStatus != models.MediaPending {
+		t.Fatalf("media status = %s, want %s", upload.MediaStatus, models.MediaPending)
+	}
+	if err := mp.process(upload.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var processed models.Attachment
+	db.Preload("Variants").First(&processed, upload.ID)
+	if processed.MediaStatus != models.MediaReady || processed.Width != 200 || processed.Height != 100 || processed.BlurHash == "" {
+		t.Errorf("processed = %s %dx%d %q", processed.MediaStatus, processed.Width, processed.Height, processed.BlurHash)
+	}
+
+	// Thumbnails keep the aspect ratio and are never larger than the original
+	if len(processed.Variants) != 2 {
+		t.Fatalf("%d variants, want 2", len(processed.Variants))
+	}
+	for i, want := range [][2]int{{40, 20}, {100, 50}} {
+		variant := processed.Variants[i]
+		if variant.Width != want[0] || variant.Height != want[1] || variant.ContentType != "image/jpeg" {
+			t.Errorf("variant %d = %dx%d %s, want %dx%d", variant.Size, variant.Width, variant.Height, variant.ContentType, want[0], want[1])
+		}
+		if exists, _ := as.Storage.Exists(context.Background(), variant.Key); !exists {
+			t.Errorf("variant %d isn't stored", variant.Size)
+		}
+	}
+	if env := nextEvent(t, uploader); env.Type != utils.EventAttachmentProcessed {
+		t.Errorf("uploader got %s, want %s", env.Type, utils.EventAttachmentProcessed)
+	}
+
+	// A second upload of the same file reuses the results
+	again := storeTestFile(t, as, alice, testImage(t, 200, 100))
+	if err := mp.process(again.ID); err != nil {
+		t.Fatal(err)
+	}
+	var copied models.Attachment
+	db.Preload("Variants").First(&copied, again.ID)
+	if copied.MediaStatus != models.MediaReady || copied.BlurHash != processed.BlurHash || len(copied.Variants) != 2 ||
+		copied.Variants[0].Key != processed.Variants[0].Key {
+		t.Errorf("copy = %s %q with %d variants", copied.MediaStatus, copied.BlurHash, len(copied.Variants))
+	}
+	nextEvent(t, uploader)
+
+	mp.Config.MaxPixels = 100
+	large := storeTestFile(t, as, alice, testImage(t, 20, 10))
+	if err := mp.process(large.ID); !errors.Is(err, errImageTooLarge) {
+		t.Errorf("process() of a large image = %v, want %v", err, errImageTooLarge)
+	}
+}
+
+func TestRegisterUserWithAvatar(t *testing.T) {
+	db := newTestDB(t)
+	uc := newTestUserController(t, db)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("username", "alice")
+	form.WriteField("email", "alice@example.com")
+	form.WriteField("password", "secret")
+	// Server-owned fields are ignored
+	form.WriteField("profile_pic", "https://example.com/evil.png")
+	form.WriteField("is_moderator", "true")
+	part, _ := form.CreateFormFile("profile_pic", "me.png")
+	part.Write(testImage(t, 8, 8))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/register", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	uc.RegisterUser(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("RegisterUser = %d %s", w.Code, w.Body)
+	}
+
+	var user models.User
+	db.Preload("Avatar").Where("username = ?", "alice").First(&user)
+	if user.IsModerator || user.Avatar == nil || user.ProfilePic != user.Avatar.URL() {
+		t.Errorf("user = moderator %v, avatar %v, profile_pic %q", user.IsModerator, user.Avatar, user.ProfilePic)
+	}
+	if user.Avatar != nil && (user.Avatar.Purpose != models.AttachmentAvatar || user.Avatar.UploaderID != user.ID) {
+		t.Errorf("avatar = %s by %d", user.Avatar.Purpose, user.Avatar.UploaderID)
+	}
+
+	// JSON bodies can't point the profile at someone else's file either
+	w = serveAs(uc.UpdateUserProfile, user, nil, map[string]interface{}{
+		"first_name":  "Alice",
+		"profile_pic": "https://example.com/evil.png",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("UpdateUserProfile = %d %s", w.Code, w.Body)
+	}
+	var updated models.User
+	db.First(&updated, user.ID)
+	if updated.FirstName != "Alice" || updated.ProfilePic != user.ProfilePic {
+		t.Errorf("updated = %q with profile_pic %q", updated.FirstName, updated.ProfilePic)
+	}
+}
@@ -2,28 +2,26 @@ package controller
 
 import (
 	"encoding/json"
-	"github/similadayo/chitchat/config"
+	"errors"
 	"github/similadayo/chitchat/models"
 	"github/similadayo/chitchat/utils"
+	"io"
+	"log"
 	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 )
 
 type MessageController struct {
-	DB *gorm.DB
+	DB       *gorm.DB
+	Messages *MessageService
 }
 
-func NewMessageController() *MessageController {
-	db, err := config.ConnectDB()
-	if err != nil {
-		panic(err)
-	}
-
-	config.MigrateDB(db)
-
-	return &MessageController{DB: db}
+// NewMessageController creates a new message controller
+func NewMessageController(messages *MessageService) *MessageController {
+	return &MessageController{DB: messages.DB, Messages: messages}
 }
 
 // Func SendMessage is used to send a message to a user or a group
@@ -46,57 +44,439 @@ func (mc *MessageController) SendMessage(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	message.SenderID = sender.ID
-	message.Timestamp = time.Now()
-
-	//validate receiver
-	var receiver models.User
-	if err := mc.DB.First(&receiver, message.ReceiverID).Error; err != nil {
-		http.Error(w, "Receiver not found", http.StatusNotFound)
+	if err := mc.Messages.Send(sender.ID, &message); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
 		return
 	}
 
-	if err := mc.DB.Create(&message).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Push the committed message to the recipients and the sender's devices
+	if err := mc.Messages.Publish(&message, nil); err != nil {
+		log.Printf("Error publishing message: %v", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Message sent successfully"})
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Message sent successfully", "id": message.ID})
 }
 
-// Func GetMessages is used to get all messages sent to a user or a group
+// Func GetMessages is the legacy history endpoint, kept for older clients.
+// The conversation is resolved against the authenticated user: the other
+// party is whichever of sender_id and receiver_id isn't the caller, or the
+// group given by group_id.
 func (mc *MessageController) GetMessages(w http.ResponseWriter, r *http.Request) {
-	senderID := r.URL.Query().Get("sender_id")
-	receiverID := r.URL.Query().Get("receiver_id")
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 
-	receiverIDuint, err := utils.ConvertToUint(receiverID)
+	query := r.URL.Query()
+	var conv conversationRef
+	if groupID := query.Get("group_id"); groupID != "" {
+		conv.GroupID, err = utils.ConvertToUint(groupID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		senderID, err := utils.ConvertToUint(query.Get("sender_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		receiverID, err := utils.ConvertToUint(query.Get("receiver_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch user.ID {
+		case senderID:
+			conv.PeerID = receiverID
+		case receiverID:
+			conv.PeerID = senderID
+		default:
+			http.Error(w, "You can only read your own conversations", http.StatusForbidden)
+			return
+		}
+	}
+
+	mc.respondWithHistory(w, r, user, conv)
+}
+
+// GetConversationMessages returns the history of a conversation the current
+// user takes part in. {peer} is a user ID, or a conversation ID such as "g3".
+func (mc *MessageController) GetConversationMessages(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	conv, err := parseConversationID(mux.Vars(r)["peer"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var messages []models.Message
-	if err := mc.DB.Where("(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)", senderID, receiverID, receiverID, senderID).
-		Preload("Sender").
-		Preload("Receiver").
-		Find(&messages).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	mc.respondWithHistory(w, r, user, conv)
+}
+
+// respondWithHistory writes a page of the user's view of a conversation,
+// paginated with the before, after, around and limit query parameters
+func (mc *MessageController) respondWithHistory(w http.ResponseWriter, r *http.Request, user *models.User, conv conversationRef) {
+	params, err := utils.ParsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Update the IsDelivered field for messages sent to the current user
-	for i := range messages {
-		if messages[i].ReceiverID == uint(receiverIDuint) && !messages[i].IsDelivered {
-			messages[i].IsDelivered = true
-			if err := mc.DB.Model(&messages[i]).Update("is_delivered", true).Error; err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}
+	page, err := mc.Messages.History(user.ID, conv, params)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(page)
+}
+
+// EditMessage changes the content of a message sent by the current user
+func (mc *MessageController) EditMessage(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	messageID, err := pathID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	message, err := mc.Messages.Edit(user.ID, messageID, body.Content)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, message)
+}
+
+// GetMessageRevisions returns the edit history of a message to moderators
+func (mc *MessageController) GetMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	messageID, err := pathID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	revisions, err := mc.Messages.Revisions(user, messageID)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, revisions)
+}
+
+// DeleteMessage deletes a message for the current user (?scope=me, the
+// default) or retracts it for everyone in the conversation (?scope=everyone)
+func (mc *MessageController) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	messageID, err := pathID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = utils.DeleteForMe
+	}
+
+	if err := mc.Messages.Delete(user, messageID, scope); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Message deleted successfully"})
+}
+
+// GetConversations lists the current user's conversations, pinned first and
+// then by recent activity. ?archived=true lists the archived ones instead.
+func (mc *MessageController) GetConversations(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	params, err := utils.ParsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Before != "" || params.Around != 0 {
+		http.Error(w, "Conversations can only be paged forward with after", http.StatusBadRequest)
+		return
+	}
+
+	page, err := mc.Messages.Inbox(user.ID, params.After, params.Limit, r.URL.Query().Get("archived") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, page)
+}
+
+// UpdateConversationSettings mutes, pins or archives a conversation for the
+// current user
+func (mc *MessageController) UpdateConversationSettings(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	conv, err := parseConversationID(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var update ConversationSettingsUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	setting, err := mc.Messages.UpdateSettings(user.ID, conv, update)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, setting)
+}
+
+// MarkConversationRead records that the current user has read a conversation
+// up to message_id, or up to its latest message when message_id is omitted
+func (mc *MessageController) MarkConversationRead(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	conv, err := parseConversationID(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		MessageID uint `json:"message_id"`
+	}
+	// The body is optional; an empty one, chunked or not, reads the whole
+	// conversation
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	watermark, err := mc.Messages.MarkRead(user.ID, conv, body.MessageID)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, watermark)
+}
+
+// GetMessageThread returns the thread a message belongs to, paginated with
+// after and limit
+func (mc *MessageController) GetMessageThread(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	messageID, err := pathID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	params, err := utils.ParsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Before != "" || params.Around != 0 {
+		http.Error(w, "Threads can only be paged forward with after", http.StatusBadRequest)
+		return
+	}
+
+	page, err := mc.Messages.Thread(user.ID, messageID, params.After, params.Limit)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, page)
+}
+
+// AddReaction adds the emoji in the path to a message for the current user
+func (mc *MessageController) AddReaction(w http.ResponseWriter, r *http.Request) {
+	mc.changeReaction(w, r, mc.Messages.React, "Reaction added successfully")
+}
+
+// RemoveReaction removes the current user's emoji from a message
+func (mc *MessageController) RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	mc.changeReaction(w, r, mc.Messages.Unreact, "Reaction removed successfully")
+}
+
+// changeReaction runs AddReaction and RemoveReaction, which only differ in
+// the service call
+func (mc *MessageController) changeReaction(w http.ResponseWriter, r *http.Request, change func(userID, messageID uint, emoji string) error, done string) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	messageID, err := pathID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := change(user.ID, messageID, mux.Vars(r)["emoji"]); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": done})
+}
+
+// GetMessageReceipts returns the users who have read a message
+func (mc *MessageController) GetMessageReceipts(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	messageID, err := pathID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	readers, err := mc.Messages.ReadBy(user.ID, messageID)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, readers)
+}
+
+// SearchMessages searches the current user's conversations. q is required;
+// from (a user ID), in (a conversation ID), since and until (RFC 3339 or
+// YYYY-MM-DD), has=attachment, before and limit narrow it down.
+func (mc *MessageController) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(mc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	params, err := utils.ParsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.After != "" || params.Around != 0 {
+		http.Error(w, "Search results can only be paged with before", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	search := MessageSearch{
+		Text:          query.Get("q"),
+		HasAttachment: query.Get("has") == "attachment",
+		Limit:         params.Limit,
+	}
+	if params.Before != "" {
+		if search.Before, err = utils.IDFromCursorParam(params.Before); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if from := query.Get("from"); from != "" {
+		if search.SenderID, err = utils.ConvertToUint(from); err != nil {
+			http.Error(w, "from must be a user ID", http.StatusBadRequest)
+			return
+		}
+	}
+	if in := query.Get("in"); in != "" {
+		conv, err := parseConversationID(in)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		search.Conversation = &conv
+	}
+	if search.Since, err = parseSearchDate(query.Get("since")); err != nil {
+		http.Error(w, "since must be a date", http.StatusBadRequest)
+		return
+	}
+	if search.Until, err = parseSearchDate(query.Get("until")); err != nil {
+		http.Error(w, "until must be a date", http.StatusBadRequest)
+		return
+	}
+
+	page, err := mc.Messages.Search(user.ID, search)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, page)
+}
+
+// parseSearchDate accepts an RFC 3339 time or a YYYY-MM-DD date; an empty
+// string is the zero time
+func parseSearchDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
 }
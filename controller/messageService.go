@@ -0,0 +1,796 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/config"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrEmptyMessage     = errors.New("message content is required")
+	ErrInvalidTarget    = errors.New("exactly one of receiver_id or group_id is required")
+	ErrReceiverNotFound = errors.New("receiver not found")
+	ErrPeerNotFound     = errors.New("user not found")
+	ErrGroupNotFound    = errors.New("group not found")
+	ErrNotGroupMember   = errors.New("you are not a member of this group")
+	ErrPostNotAllowed   = errors.New("you are not allowed to post in this group")
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrNotMessageSender = errors.New("only the sender can change this message")
+	ErrEditWindowClosed = errors.New("this message can no longer be edited")
+	ErrNotEditable      = errors.New("this message can't be edited")
+	ErrNotModerator     = errors.New("you are not allowed to moderate this message")
+	ErrInvalidScope     = errors.New("scope must be \"me\" or \"everyone\"")
+	ErrInvalidReply     = errors.New("replies must answer a message in the same conversation")
+)
+
+// messageErrorStatus maps message service errors to HTTP status codes
+func messageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrEmptyMessage), errors.Is(err, ErrInvalidTarget), errors.Is(err, ErrNotEditable),
+		errors.Is(err, ErrInvalidScope), errors.Is(err, ErrInvalidConversation), errors.Is(err, utils.ErrInvalidCursor),
+		errors.Is(err, ErrEmptySearch), errors.Is(err, ErrInvalidReply), errors.Is(err, ErrInvalidEmoji),
+		errors.Is(err, ErrInvalidAttachment), errors.Is(err, ErrBlockSelf):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotGroupMember), errors.Is(err, ErrPostNotAllowed), errors.Is(err, ErrNotMessageSender),
+		errors.Is(err, ErrEditWindowClosed), errors.Is(err, ErrNotModerator), errors.Is(err, ErrBlocked):
+		return http.StatusForbidden
+	case errors.Is(err, ErrReceiverNotFound), errors.Is(err, ErrPeerNotFound), errors.Is(err, ErrGroupNotFound),
+		errors.Is(err, ErrMessageNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// messageProtocolError maps message service errors to websocket error frames
+func messageProtocolError(err error) error {
+	switch messageErrorStatus(err) {
+	case http.StatusBadRequest:
+		return utils.NewProtocolError(utils.ErrCodeInvalidPayload, err.Error())
+	case http.StatusForbidden:
+		return utils.NewProtocolError(utils.ErrCodeForbidden, err.Error())
+	case http.StatusNotFound:
+		return utils.NewProtocolError(utils.ErrCodeNotFound, err.Error())
+	}
+	return err
+}
+
+// MessageService validates, stores and publishes messages. It is shared by
+// the REST handlers and the websocket dispatcher so both paths behave the same.
+type MessageService struct {
+	DB  *gorm.DB
+	Hub *utils.Hub
+
+	// EditWindow is how long after sending a message its sender may edit it
+	EditWindow time.Duration
+
+	// Index serves Search; it is set up once in InitRoutes
+	Index SearchIndex
+}
+
+// NewMessageService creates a new message service
+func NewMessageService(db *gorm.DB, hub *utils.Hub) *MessageService {
+	return &MessageService{DB: db, Hub: hub, EditWindow: config.MessageEditWindow()}
+}
+
+// Send validates a message from the given sender and stores it, filling in
+// its ID and Timestamp. The message goes either to a user or to a group the
+// sender belongs to. AttachmentIDs name the sender's uploads to link to it.
+func (ms *MessageService) Send(senderID uint, message *models.Message) error {
+	attachmentIDs := uniqueIDs(message.AttachmentIDs)
+	if strings.TrimSpace(message.Content) == "" && len(attachmentIDs) == 0 {
+		return ErrEmptyMessage
+	}
+	if len(attachmentIDs) > maxMessageAttachments {
+		return ErrInvalidAttachment
+	}
+	if (message.ReceiverID == nil) == (message.GroupID == 0) {
+		return ErrInvalidTarget
+	}
+
+	// Delivery state is owned by the server, never by the client
+	message.ID = 0
+	message.IsSystem = false
+	message.IsDelivered = false
+	message.IsRead = false
+	message.IsEdited = false
+	message.IsDeleted = false
+	message.ThreadRootID = nil
+	message.Thread = nil
+	message.ImageURL = ""
+	message.Attachments = nil
+	message.AttachmentIDs = nil
+
+	message.SenderID = senderID
+	message.Timestamp = time.Now()
+
+	if message.GroupID != 0 {
+		group, member, err := groupMembership(ms.DB, message.GroupID, senderID)
+		if err != nil {
+			return err
+		}
+		if !canInGroup(group, member, PermPost) {
+			return ErrPostNotAllowed
+		}
+	} else {
+		//validate receiver
+		var receiver models.User
+		if err := ms.DB.First(&receiver, *message.ReceiverID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrReceiverNotFound
+			}
+			return err
+		}
+
+		blocked, err := isBlockedBetween(ms.DB, senderID, receiver.ID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return ErrBlocked
+		}
+	}
+
+	if message.ReplyToID != nil {
+		if err := ms.threadReply(message); err != nil {
+			return err
+		}
+	}
+
+	if len(attachmentIDs) == 0 {
+		return ms.DB.Create(message).Error
+	}
+	return ms.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		return linkAttachments(tx, senderID, message, attachmentIDs)
+	})
+}
+
+// checkGroupMember makes sure the group exists and the user belongs to it
+func (ms *MessageService) checkGroupMember(groupID, userID uint) error {
+	_, _, err := groupMembership(ms.DB, groupID, userID)
+	return err
+}
+
+// SendSystem stores a system event in the group timeline on behalf of the
+// actor and pushes it to the members
+func (ms *MessageService) SendSystem(groupID, actorID uint, content string) error {
+	message := models.Message{
+		Content:   content,
+		IsSystem:  true,
+		SenderID:  actorID,
+		GroupID:   groupID,
+		Timestamp: time.Now(),
+	}
+	if err := ms.DB.Create(&message).Error; err != nil {
+		return err
+	}
+	return ms.Publish(&message, nil)
+}
+
+// Recipients returns the users that should see a message: both sides of a
+// direct conversation, or every member of the group
+func (ms *MessageService) Recipients(message *models.Message) ([]uint, error) {
+	if message.GroupID != 0 {
+		return groupMemberIDs(ms.DB, message.GroupID)
+	}
+	return []uint{*message.ReceiverID, message.SenderID}, nil
+}
+
+// Publish pushes a stored message to the recipients' connections and to the
+// sender's other devices. except is the connection the message came from, if any.
+func (ms *MessageService) Publish(message *models.Message, except *utils.Client) error {
+	if err := ms.PublishEventFrom(message.SenderID, utils.EventMessageNew, message, message, except); err != nil {
+		return err
+	}
+	if message.ThreadRootID != nil {
+		return ms.publishThreadReply(message)
+	}
+	return nil
+}
+
+// PublishEvent pushes an event about a message to everyone in its conversation
+func (ms *MessageService) PublishEvent(eventType utils.EventType, message *models.Message, payload interface{}, except *utils.Client) error {
+	recipients, err := ms.Recipients(message)
+	if err != nil {
+		return err
+	}
+	return ms.broadcastEvent(eventType, recipients, payload, except)
+}
+
+// PublishEventFrom pushes an event the actor caused, such as a new message
+// or a reaction, to the conversation. Group members on either side of a
+// block with the actor don't get it; the group's history still shows them
+// everything, as it is shared by all members.
+func (ms *MessageService) PublishEventFrom(actorID uint, eventType utils.EventType, message *models.Message, payload interface{}, except *utils.Client) error {
+	recipients, err := ms.Recipients(message)
+	if err != nil {
+		return err
+	}
+	if message.GroupID != 0 {
+		if recipients, err = withoutBlocked(ms.DB, actorID, recipients); err != nil {
+			return err
+		}
+	}
+	return ms.broadcastEvent(eventType, recipients, payload, except)
+}
+
+// broadcastEvent encodes an event and hands it to the hub for the users
+func (ms *MessageService) broadcastEvent(eventType utils.EventType, recipients []uint, payload interface{}, except *utils.Client) error {
+	data, err := utils.EncodeEvent(eventType, payload)
+	if err != nil {
+		return err
+	}
+
+	ms.Hub.Broadcast(&utils.Delivery{
+		UserIDs: recipients,
+		Data:    data,
+		Except:  except,
+	})
+	return nil
+}
+
+// MarkDelivered records that one of the receiver's connections got a direct
+// message and notifies the sender. Repeated confirmations are ignored.
+func (ms *MessageService) MarkDelivered(receiverID, messageID uint) error {
+	var message models.Message
+	if err := ms.DB.Where("id = ? AND receiver_id = ?", messageID, receiverID).First(&message).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrMessageNotFound
+		}
+		return err
+	}
+
+	result := ms.DB.Model(&models.Message{}).
+		Where("id = ? AND is_delivered = ?", message.ID, false).
+		Update("is_delivered", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	ms.Hub.SendEvent(utils.EventReceipt, utils.ReceiptPayload{
+		MessageID: message.ID,
+		Status:    utils.ReceiptDelivered,
+		UserID:    receiverID,
+	}, message.SenderID)
+	return nil
+}
+
+// findMessage loads a message by ID
+func (ms *MessageService) findMessage(messageID uint) (*models.Message, error) {
+	var message models.Message
+	if err := ms.DB.First(&message, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Edit replaces the content of a message on behalf of its sender, keeping the
+// previous content as a revision, and pushes the change to the conversation
+func (ms *MessageService) Edit(userID, messageID uint, content string) (*models.Message, error) {
+	if strings.TrimSpace(content) == "" {
+		return nil, ErrEmptyMessage
+	}
+
+	message, err := ms.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.SenderID != userID {
+		return nil, ErrNotMessageSender
+	}
+	if message.IsDeleted || message.IsSystem {
+		return nil, ErrNotEditable
+	}
+	if time.Since(message.Timestamp) > ms.EditWindow {
+		return nil, ErrEditWindowClosed
+	}
+
+	err = ms.DB.Transaction(func(tx *gorm.DB) error {
+		revision := models.MessageRevision{
+			MessageID: message.ID,
+			EditorID:  userID,
+			Content:   message.Content,
+			EditedAt:  time.Now(),
+		}
+		if err := tx.Create(&revision).Error; err != nil {
+			return err
+		}
+		return tx.Model(message).Updates(map[string]interface{}{"content": content, "is_edited": true}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ms.PublishEvent(utils.EventMessageEdited, message, message, nil); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// canModerate reports whether the user may investigate a message: site
+// moderators can see everything, group owners and admins their group's messages
+func (ms *MessageService) canModerate(user *models.User, message *models.Message) (bool, error) {
+	if user.IsModerator {
+		return true, nil
+	}
+	if message.GroupID == 0 {
+		return false, nil
+	}
+
+	group, member, err := groupMembership(ms.DB, message.GroupID, user.ID)
+	if errors.Is(err, ErrNotGroupMember) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return canInGroup(group, member, PermDeleteOthersMessages), nil
+}
+
+// Revisions returns the edit history of a message to a moderator
+func (ms *MessageService) Revisions(user *models.User, messageID uint) ([]models.MessageRevision, error) {
+	message, err := ms.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := ms.canModerate(user, message)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrNotModerator
+	}
+
+	var revisions []models.MessageRevision
+	err = ms.DB.Where("message_id = ?", message.ID).Order("edited_at, id").Find(&revisions).Error
+	return revisions, err
+}
+
+// canView reports whether the user takes part in the message's conversation
+func (ms *MessageService) canView(userID uint, message *models.Message) (bool, error) {
+	return canViewMessage(ms.DB, userID, message)
+}
+
+// canViewMessage reports whether the user takes part in the message's conversation
+func canViewMessage(db *gorm.DB, userID uint, message *models.Message) (bool, error) {
+	if message.GroupID != 0 {
+		return isGroupMember(db, message.GroupID, userID)
+	}
+	return message.SenderID == userID || (message.ReceiverID != nil && *message.ReceiverID == userID), nil
+}
+
+// hiddenMessageIDs is a subquery of the messages the user deleted for themselves
+func hiddenMessageIDs(db *gorm.DB, userID uint) *gorm.DB {
+	return db.Model(&models.HiddenMessage{}).Select("message_id").Where("user_id = ?", userID)
+}
+
+// Delete removes a message for the user only ("me"), or retracts it for the
+// whole conversation ("everyone"). Retracted messages keep their row, ID and
+// timestamp as a tombstone so clients don't renumber threads; only the sender
+// and group moderators may retract.
+func (ms *MessageService) Delete(user *models.User, messageID uint, scope string) error {
+	message, err := ms.findMessage(messageID)
+	if err != nil {
+		return err
+	}
+
+	visible, err := ms.canView(user.ID, message)
+	if err != nil {
+		return err
+	}
+	if !visible {
+		return ErrMessageNotFound
+	}
+
+	payload := utils.MessageDeletedPayload{MessageID: message.ID, Scope: scope, DeletedBy: user.ID}
+
+	switch scope {
+	case utils.DeleteForMe:
+		hidden := models.HiddenMessage{MessageID: message.ID, UserID: user.ID, HiddenAt: time.Now()}
+		if err := ms.DB.Where(models.HiddenMessage{MessageID: message.ID, UserID: user.ID}).
+			FirstOrCreate(&hidden).Error; err != nil {
+			return err
+		}
+
+		// Only the user's other devices need to hide it
+		ms.Hub.SendEvent(utils.EventMessageDeleted, payload, user.ID)
+		return nil
+
+	case utils.DeleteForEveryone:
+		if message.SenderID != user.ID {
+			allowed, err := ms.canModerate(user, message)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				return ErrNotMessageSender
+			}
+		}
+		if message.IsDeleted {
+			return nil
+		}
+
+		err := ms.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(message).Updates(map[string]interface{}{
+				"content":    "",
+				"image_url":  "",
+				"is_deleted": true,
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("message_id = ?", message.ID).Delete(&models.Reaction{}).Error; err != nil {
+				return err
+			}
+			// The stored objects stay, other uploads may share them
+			attachmentIDs := tx.Model(&models.Attachment{}).Select("id").Where("message_id = ?", message.ID)
+			if err := tx.Where("attachment_id IN (?)", attachmentIDs).Delete(&models.AttachmentVariant{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("message_id = ?", message.ID).Delete(&models.Attachment{}).Error
+		})
+		if err != nil {
+			return err
+		}
+		return ms.PublishEvent(utils.EventMessageDeleted, message, payload, nil)
+	}
+
+	return ErrInvalidScope
+}
+
+// MarkRead moves the user's read watermark in a conversation forward to
+// upToID, or to the latest message when upToID is 0. Direct messages covered
+// by it are flagged IsRead, and the senders of newly read messages as well as
+// the user's other devices get a read receipt.
+func (ms *MessageService) MarkRead(userID uint, conv conversationRef, upToID uint) (*models.ReadWatermark, error) {
+	if conv.GroupID != 0 {
+		if err := ms.checkGroupMember(conv.GroupID, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	var target models.Message
+	query := conv.scope(ms.DB.Model(&models.Message{}), userID)
+	if upToID != 0 {
+		query = query.Where("id = ?", upToID)
+	}
+	if err := query.Order("id DESC").First(&target).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	watermark := models.ReadWatermark{UserID: userID, PeerID: conv.PeerID, GroupID: conv.GroupID}
+	if err := ms.DB.Where("user_id = ? AND peer_id = ? AND group_id = ?", userID, conv.PeerID, conv.GroupID).
+		FirstOrInit(&watermark).Error; err != nil {
+		return nil, err
+	}
+	previous := watermark.LastReadMessageID
+	if target.ID <= previous {
+		// Watermarks never move backwards
+		return &watermark, nil
+	}
+
+	// Senders whose messages were not read before this call
+	var senderIDs []uint
+	if err := conv.scope(ms.DB.Model(&models.Message{}), userID).
+		Where("id > ? AND id <= ? AND sender_id <> ?", previous, target.ID, userID).
+		Distinct().Pluck("sender_id", &senderIDs).Error; err != nil {
+		return nil, err
+	}
+
+	err := ms.DB.Transaction(func(tx *gorm.DB) error {
+		watermark.LastReadMessageID = target.ID
+		if err := tx.Save(&watermark).Error; err != nil {
+			return err
+		}
+		if conv.PeerID == 0 {
+			return nil
+		}
+		return tx.Model(&models.Message{}).
+			Where("sender_id = ? AND receiver_id = ? AND id <= ? AND is_read = ?", conv.PeerID, userID, target.ID, false).
+			Updates(map[string]interface{}{"is_read": true, "is_delivered": true}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := utils.ReceiptPayload{
+		MessageID: target.ID,
+		Status:    utils.ReceiptRead,
+		UserID:    userID,
+		GroupID:   conv.GroupID,
+	}
+	ms.Hub.SendEvent(utils.EventReceipt, receipt, append(senderIDs, userID)...)
+	return &watermark, nil
+}
+
+// MarkReadMessage moves the read watermark up to a message, wherever it is
+func (ms *MessageService) MarkReadMessage(userID, messageID uint) error {
+	message, err := ms.findMessage(messageID)
+	if err != nil {
+		return err
+	}
+
+	visible, err := ms.canView(userID, message)
+	if err != nil {
+		return err
+	}
+	if !visible {
+		return ErrMessageNotFound
+	}
+
+	_, err = ms.MarkRead(userID, conversationOf(message, userID), message.ID)
+	return err
+}
+
+// ReadBy returns the users who have read a message, apart from its sender
+func (ms *MessageService) ReadBy(userID, messageID uint) ([]models.User, error) {
+	message, err := ms.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	visible, err := ms.canView(userID, message)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, ErrMessageNotFound
+	}
+
+	readers := ms.DB.Model(&models.ReadWatermark{}).Select("user_id").
+		Where("last_read_message_id >= ? AND user_id <> ?", message.ID, message.SenderID)
+	if message.GroupID != 0 {
+		readers = readers.Where("group_id = ?", message.GroupID)
+	} else {
+		readers = readers.Where("user_id = ? AND peer_id = ?", *message.ReceiverID, message.SenderID)
+	}
+
+	var users []models.User
+	err = ms.DB.Where("id IN (?)", readers).Find(&users).Error
+	return users, err
+}
+
+// MessagePage is one page of a conversation, oldest message first.
+// PrevCursor fetches older messages (?before=), NextCursor newer ones (?after=).
+type MessagePage struct {
+	Messages   []models.Message `json:"messages"`
+	PrevCursor string           `json:"prev_cursor,omitempty"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// messageCursor returns the pagination cursor of a message
+func messageCursor(message *models.Message) string {
+	return utils.Cursor{Timestamp: message.Timestamp, ID: message.ID}.Encode()
+}
+
+// resolveMessageCursor turns a before/after parameter into a cursor. Bare
+// message IDs are looked up within the conversation to find their timestamp.
+func (ms *MessageService) resolveMessageCursor(userID uint, conv conversationRef, param string) (*utils.Cursor, error) {
+	if cursor, err := utils.DecodeCursor(param); err == nil && !cursor.Timestamp.IsZero() {
+		return cursor, nil
+	}
+
+	id, err := utils.IDFromCursorParam(param)
+	if err != nil {
+		return nil, err
+	}
+	message, err := ms.conversationMessage(userID, conv, id)
+	if err != nil {
+		return nil, err
+	}
+	return &utils.Cursor{Timestamp: message.Timestamp, ID: message.ID}, nil
+}
+
+// conversationMessage loads a message of the conversation. Messages of
+// other conversations are reported as not found, so their IDs reveal
+// nothing about them. The caller must have checked the user takes part.
+func (ms *MessageService) conversationMessage(userID uint, conv conversationRef, messageID uint) (*models.Message, error) {
+	var message models.Message
+	if err := conv.scope(ms.DB, userID).Where("id = ?", messageID).First(&message).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	return &message, nil
+}
+
+// History returns a page of a conversation as the user sees them, minus
+// those they deleted for themselves. Without a cursor the latest messages are
+// returned; with around, a window centred on that message. Direct messages
+// the user receives are marked delivered in a single update, and the peer
+// gets a delivery receipt for each of them as with MarkDelivered.
+func (ms *MessageService) History(userID uint, conv conversationRef, params utils.PageParams) (*MessagePage, error) {
+	if conv.GroupID != 0 {
+		if err := ms.checkGroupMember(conv.GroupID, userID); err != nil {
+			return nil, err
+		}
+	} else {
+		var peer models.User
+		if err := ms.DB.First(&peer, conv.PeerID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrPeerNotFound
+			}
+			return nil, err
+		}
+	}
+
+	base := func() *gorm.DB {
+		return conv.scope(ms.DB, userID).
+			Where("id NOT IN (?)", hiddenMessageIDs(ms.DB, userID)).
+			Preload("Sender").
+			Preload("Receiver").
+			Preload("Attachments.Variants")
+	}
+	// older fetches the messages before c, or the latest ones when c is nil
+	older := func(c *utils.Cursor, inclusive bool, limit int) ([]models.Message, error) {
+		query := base()
+		if c != nil {
+			op := "<"
+			if inclusive {
+				op = "<="
+			}
+			query = query.Where("(timestamp < ? OR (timestamp = ? AND id "+op+" ?))", c.Timestamp, c.Timestamp, c.ID)
+		}
+		var messages []models.Message
+		err := query.Order("timestamp DESC, id DESC").Limit(limit).Find(&messages).Error
+		// Fetched newest first, return them oldest first
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+		return messages, err
+	}
+	newer := func(c *utils.Cursor, limit int) ([]models.Message, error) {
+		var messages []models.Message
+		err := base().
+			Where("(timestamp > ? OR (timestamp = ? AND id > ?))", c.Timestamp, c.Timestamp, c.ID).
+			Order("timestamp, id").Limit(limit).Find(&messages).Error
+		return messages, err
+	}
+
+	// Every query asks for one extra row to learn whether there is more
+	var messages []models.Message
+	hasOlder, hasNewer := false, false
+	switch {
+	case params.After != "":
+		cursor, err := ms.resolveMessageCursor(userID, conv, params.After)
+		if err != nil {
+			return nil, err
+		}
+		if messages, err = newer(cursor, params.Limit+1); err != nil {
+			return nil, err
+		}
+		hasOlder = true
+		if len(messages) > params.Limit {
+			messages, hasNewer = messages[:params.Limit], true
+		}
+
+	case params.Around != 0:
+		target, err := ms.conversationMessage(userID, conv, params.Around)
+		if err != nil {
+			return nil, err
+		}
+		cursor := &utils.Cursor{Timestamp: target.Timestamp, ID: target.ID}
+
+		// Centre the window on the target, giving any room one side can't
+		// fill to the other
+		head, err := older(cursor, true, params.Limit+1)
+		if err != nil {
+			return nil, err
+		}
+		tail, err := newer(cursor, params.Limit)
+		if err != nil {
+			return nil, err
+		}
+		before := (params.Limit - 1) / 2
+		if len(head) < before+1 {
+			before = len(head) - 1
+		}
+		tailN := params.Limit - before - 1
+		if len(tail) < tailN {
+			tailN = len(tail)
+		}
+		headN := params.Limit - tailN
+		if len(head) < headN {
+			headN = len(head)
+		}
+		hasOlder, hasNewer = len(head) > headN, len(tail) > tailN
+		head, tail = head[len(head)-headN:], tail[:tailN]
+		messages = append(head, tail...)
+
+	default:
+		var cursor *utils.Cursor
+		var err error
+		if params.Before != "" {
+			if cursor, err = ms.resolveMessageCursor(userID, conv, params.Before); err != nil {
+				return nil, err
+			}
+			hasNewer = true
+		}
+		if messages, err = older(cursor, false, params.Limit+1); err != nil {
+			return nil, err
+		}
+		if len(messages) > params.Limit {
+			messages, hasOlder = messages[1:], true
+		}
+	}
+
+	if err := ms.attachThreads(userID, messages); err != nil {
+		return nil, err
+	}
+	if err := ms.attachReactions(userID, messages); err != nil {
+		return nil, err
+	}
+
+	if conv.PeerID != 0 {
+		if err := ms.markHistoryDelivered(userID, conv.PeerID); err != nil {
+			return nil, err
+		}
+		for i := range messages {
+			if messages[i].SenderID == conv.PeerID {
+				messages[i].IsDelivered = true
+			}
+		}
+	}
+
+	page := &MessagePage{Messages: messages}
+	if page.Messages == nil {
+		page.Messages = []models.Message{}
+	}
+	if len(messages) > 0 {
+		if hasOlder {
+			page.PrevCursor = messageCursor(&messages[0])
+		}
+		if hasNewer {
+			page.NextCursor = messageCursor(&messages[len(messages)-1])
+		}
+	}
+	return page, nil
+}
+
+// markHistoryDelivered marks every message the peer sent to the user as
+// delivered and sends the peer a receipt for those that weren't yet
+func (ms *MessageService) markHistoryDelivered(userID, peerID uint) error {
+	var pending []uint
+	if err := ms.DB.Model(&models.Message{}).
+		Where("sender_id = ? AND receiver_id = ? AND is_delivered = ?", peerID, userID, false).
+		Order("id").
+		Pluck("id", &pending).Error; err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := ms.DB.Model(&models.Message{}).
+		Where("id IN ? AND is_delivered = ?", pending, false).
+		Update("is_delivered", true).Error; err != nil {
+		return err
+	}
+
+	for _, messageID := range pending {
+		ms.Hub.SendEvent(utils.EventReceipt, utils.ReceiptPayload{
+			MessageID: messageID,
+			Status:    utils.ReceiptDelivered,
+			UserID:    userID,
+		}, peerID)
+	}
+	return nil
+}
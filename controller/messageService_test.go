@@ -0,0 +1,826 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/similadayo/chitchat/config"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB opens a migrated in-memory database private to the test
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := gorm.Open(sqlite.Open("file:"+name+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The database lives as long as a connection to it is open
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	config.MigrateDB(db)
+	return db
+}
+
+// createTestUser stores a user with the given name
+func createTestUser(t *testing.T, db *gorm.DB, name string) models.User {
+	t.Helper()
+	user := models.User{Username: name, Email: name + "@example.com", Password: "x"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// newTestHub starts a hub
+func newTestHub() *utils.Hub {
+	hub := utils.NewHub(utils.DefaultWebSocketConfig())
+	go hub.Run()
+	return hub
+}
+
+// connectTestClient registers a client without a connection with the hub;
+// frames sent to it are read from its Send queue
+func connectTestClient(hub *utils.Hub, userID uint) *utils.Client {
+	client := utils.NewClient(nil, utils.RandomID(), userID, "user")
+	hub.Register(client)
+	return client
+}
+
+// nextEvent waits for the next frame queued for the client
+func nextEvent(t *testing.T, client *utils.Client) *utils.Envelope {
+	t.Helper()
+	select {
+	case data := <-client.Send:
+		var env utils.Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Fatal(err)
+		}
+		return &env
+	case <-time.After(time.Second):
+		t.Fatal("no frame received")
+		return nil
+	}
+}
+
+// expectNoEvent checks that nothing is queued for the client once the hub
+// has handled everything sent to it before
+func expectNoEvent(t *testing.T, hub *utils.Hub, client *utils.Client) {
+	t.Helper()
+	// Run handles one request at a time, so once it takes this delivery
+	// the earlier ones are done
+	hub.Broadcast(&utils.Delivery{})
+	select {
+	case data := <-client.Send:
+		t.Fatalf("unexpected frame %s", data)
+	default:
+	}
+}
+
+func TestSend(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, nil)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	message := models.Message{
+		Content:     "hello",
+		ReceiverID:  &bob.ID,
+		SenderID:    bob.ID,
+		IsDelivered: true,
+		IsRead:      true,
+	}
+	message.ID = 99
+	if err := ms.Send(alice.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.ID == 0 || message.ID == 99 {
+		t.Fatalf("ID = %d, want a server-assigned ID", message.ID)
+	}
+	if message.Timestamp.IsZero() {
+		t.Fatal("Timestamp was not set")
+	}
+
+	var stored models.Message
+	if err := db.First(&stored, message.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.SenderID != alice.ID || stored.ReceiverID == nil || *stored.ReceiverID != bob.ID || stored.Content != "hello" {
+		t.Fatalf("stored %+v", stored)
+	}
+	if stored.IsDelivered || stored.IsRead {
+		t.Fatal("client-supplied delivery state was stored")
+	}
+}
+
+func TestSendRejectsInvalidMessages(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, nil)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	unknown := bob.ID + 100
+	tests := []struct {
+		name    string
+		message models.Message
+		want    error
+	}{
+		{"empty", models.Message{Content: "  ", ReceiverID: &bob.ID}, ErrEmptyMessage},
+		{"unknown receiver", models.Message{Content: "hi", ReceiverID: &unknown}, ErrReceiverNotFound},
+		{"no target", models.Message{Content: "hi"}, ErrInvalidTarget},
+		{"two targets", models.Message{Content: "hi", ReceiverID: &bob.ID, GroupID: 1}, ErrInvalidTarget},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := tt.message
+			if err := ms.Send(alice.ID, &message); !errors.Is(err, tt.want) {
+				t.Fatalf("Send() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	var count int64
+	db.Model(&models.Message{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("%d messages stored, want 0", count)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	phone := connectTestClient(hub, alice.ID)
+	laptop := connectTestClient(hub, alice.ID)
+	receiver := connectTestClient(hub, bob.ID)
+
+	message := models.Message{Content: "hello", ReceiverID: &bob.ID}
+	if err := ms.Send(alice.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Publish(&message, phone); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, client := range map[string]*utils.Client{"receiver": receiver, "other device": laptop} {
+		env := nextEvent(t, client)
+		var got models.Message
+		if err := env.DecodePayload(&got); err != nil {
+			t.Fatal(err)
+		}
+		if env.Type != utils.EventMessageNew || got.ID != message.ID {
+			t.Errorf("%s got %s for message %d", name, env.Type, got.ID)
+		}
+	}
+	expectNoEvent(t, hub, phone)
+}
+
+func TestMarkDelivered(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	sender := connectTestClient(hub, alice.ID)
+
+	message := models.Message{Content: "hello", ReceiverID: &bob.ID}
+	if err := ms.Send(alice.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the receiver can confirm delivery
+	if err := ms.MarkDelivered(alice.ID, message.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("MarkDelivered() by the sender = %v, want %v", err, ErrMessageNotFound)
+	}
+
+	if err := ms.MarkDelivered(bob.ID, message.ID); err != nil {
+		t.Fatal(err)
+	}
+	env := nextEvent(t, sender)
+	var receipt utils.ReceiptPayload
+	if err := env.DecodePayload(&receipt); err != nil {
+		t.Fatal(err)
+	}
+	want := utils.ReceiptPayload{MessageID: message.ID, Status: utils.ReceiptDelivered, UserID: bob.ID}
+	if env.Type != utils.EventReceipt || receipt != want {
+		t.Fatalf("got %s %+v, want receipt %+v", env.Type, receipt, want)
+	}
+
+	var stored models.Message
+	db.First(&stored, message.ID)
+	if !stored.IsDelivered {
+		t.Fatal("message not marked delivered")
+	}
+
+	// A repeated confirmation sends no second receipt
+	if err := ms.MarkDelivered(bob.ID, message.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectNoEvent(t, hub, sender)
+}
+
+// sendTestMessage stores a direct message from sender to receiver
+func sendTestMessage(t *testing.T, ms *MessageService, sender, receiver models.User, content string) models.Message {
+	t.Helper()
+	message := models.Message{Content: content, ReceiverID: &receiver.ID}
+	if err := ms.Send(sender.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestEdit(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	ms.EditWindow = time.Hour
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	receiver := connectTestClient(hub, bob.ID)
+
+	message := sendTestMessage(t, ms, alice, bob, "helo")
+
+	if _, err := ms.Edit(bob.ID, message.ID, "hijacked"); !errors.Is(err, ErrNotMessageSender) {
+		t.Errorf("Edit() by the receiver = %v, want %v", err, ErrNotMessageSender)
+	}
+	if _, err := ms.Edit(alice.ID, message.ID, " "); !errors.Is(err, ErrEmptyMessage) {
+		t.Errorf("Edit() to nothing = %v, want %v", err, ErrEmptyMessage)
+	}
+	if _, err := ms.Edit(alice.ID, message.ID+100, "x"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Edit() of a missing message = %v, want %v", err, ErrMessageNotFound)
+	}
+
+	for _, content := range []string{"hello", "hello!"} {
+		edited, err := ms.Edit(alice.ID, message.ID, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edited.Content != content || !edited.IsEdited {
+			t.Errorf("Edit() = %q, edited %v; want %q, edited", edited.Content, edited.IsEdited, content)
+		}
+		if env := nextEvent(t, receiver); env.Type != utils.EventMessageEdited {
+			t.Errorf("receiver got %s, want %s", env.Type, utils.EventMessageEdited)
+		}
+	}
+
+	// Each edit keeps the content it replaced
+	var revisions []models.MessageRevision
+	db.Where("message_id = ?", message.ID).Order("id").Find(&revisions)
+	if len(revisions) != 2 || revisions[0].Content != "helo" || revisions[1].Content != "hello" {
+		t.Errorf("revisions = %+v, want helo and hello", revisions)
+	}
+}
+
+func TestEditWindow(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, nil)
+	ms.EditWindow = time.Minute
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	message := sendTestMessage(t, ms, alice, bob, "hello")
+	db.Model(&message).Update("timestamp", time.Now().Add(-2*time.Minute))
+
+	if _, err := ms.Edit(alice.ID, message.ID, "too late"); !errors.Is(err, ErrEditWindowClosed) {
+		t.Fatalf("Edit() after the window = %v, want %v", err, ErrEditWindowClosed)
+	}
+	var stored models.Message
+	db.First(&stored, message.ID)
+	if stored.Content != "hello" || stored.IsEdited {
+		t.Errorf("stored %q, edited %v; want it unchanged", stored.Content, stored.IsEdited)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	ms.EditWindow = time.Hour
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	moderator := createTestUser(t, db, "mod")
+	db.Model(&moderator).Update("is_moderator", true)
+
+	message := sendTestMessage(t, ms, alice, bob, "helo")
+	if _, err := ms.Edit(alice.ID, message.ID, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The history of a direct message is for site moderators only
+	if _, err := ms.Revisions(&bob, message.ID); !errors.Is(err, ErrNotModerator) {
+		t.Errorf("Revisions() by the receiver = %v, want %v", err, ErrNotModerator)
+	}
+	revisions, err := ms.Revisions(&moderator, message.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].Content != "helo" || revisions[0].EditorID != alice.ID {
+		t.Errorf("Revisions() = %+v, want the original content", revisions)
+	}
+}
+
+func TestDeleteForMe(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	laptop := connectTestClient(hub, alice.ID)
+	receiver := connectTestClient(hub, bob.ID)
+
+	message := sendTestMessage(t, ms, alice, bob, "hello")
+	if err := ms.Delete(&carol, message.ID, utils.DeleteForMe); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Delete() by an outsider = %v, want %v", err, ErrMessageNotFound)
+	}
+	if err := ms.Delete(&alice, message.ID, "nobody"); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("Delete() with an unknown scope = %v, want %v", err, ErrInvalidScope)
+	}
+
+	// Deleting twice is harmless
+	for i := 0; i < 2; i++ {
+		if err := ms.Delete(&alice, message.ID, utils.DeleteForMe); err != nil {
+			t.Fatal(err)
+		}
+		if env := nextEvent(t, laptop); env.Type != utils.EventMessageDeleted {
+			t.Errorf("the sender's device got %s, want %s", env.Type, utils.EventMessageDeleted)
+		}
+	}
+	expectNoEvent(t, hub, receiver)
+
+	var hidden int64
+	db.Model(&models.HiddenMessage{}).Where("message_id = ? AND user_id = ?", message.ID, alice.ID).Count(&hidden)
+	if hidden != 1 {
+		t.Errorf("%d hidden rows, want 1", hidden)
+	}
+	var stored models.Message
+	db.First(&stored, message.ID)
+	if stored.IsDeleted || stored.Content != "hello" {
+		t.Error("deleting for oneself changed the message for everyone")
+	}
+}
+
+func TestDeleteForEveryone(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	ms.EditWindow = time.Hour
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	receiver := connectTestClient(hub, bob.ID)
+
+	message := sendTestMessage(t, ms, alice, bob, "hello")
+
+	if err := ms.Delete(&bob, message.ID, utils.DeleteForEveryone); !errors.Is(err, ErrNotMessageSender) {
+		t.Errorf("Delete() by the receiver = %v, want %v", err, ErrNotMessageSender)
+	}
+	if err := ms.Delete(&alice, message.ID, utils.DeleteForEveryone); err != nil {
+		t.Fatal(err)
+	}
+	env := nextEvent(t, receiver)
+	var payload utils.MessageDeletedPayload
+	env.DecodePayload(&payload)
+	if env.Type != utils.EventMessageDeleted || payload.MessageID != message.ID || payload.Scope != utils.DeleteForEveryone {
+		t.Errorf("receiver got %s %+v", env.Type, payload)
+	}
+
+	// The row stays as a tombstone with its ID and timestamp
+	var stored models.Message
+	if err := db.First(&stored, message.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !stored.IsDeleted || stored.Content != "" || !stored.Timestamp.Equal(message.Timestamp) {
+		t.Errorf("tombstone = %+v", stored)
+	}
+
+	if _, err := ms.Edit(alice.ID, message.ID, "back"); !errors.Is(err, ErrNotEditable) {
+		t.Errorf("Edit() of a retracted message = %v, want %v", err, ErrNotEditable)
+	}
+
+	// Retracting again publishes nothing
+	if err := ms.Delete(&alice, message.ID, utils.DeleteForEveryone); err != nil {
+		t.Fatal(err)
+	}
+	expectNoEvent(t, hub, receiver)
+}
+
+func TestGroupModeratorDeletesForEveryone(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	gc := NewGroupController(ms)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	group := createTestGroup(t, gc, alice, bob, carol)
+
+	message := models.Message{Content: "spam", GroupID: group.ID}
+	if err := ms.Send(bob.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ms.Delete(&carol, message.ID, utils.DeleteForEveryone); !errors.Is(err, ErrNotMessageSender) {
+		t.Errorf("Delete() by a member = %v, want %v", err, ErrNotMessageSender)
+	}
+	if err := ms.Delete(&alice, message.ID, utils.DeleteForEveryone); err != nil {
+		t.Errorf("Delete() by the owner = %v", err)
+	}
+}
+
+// readFlags returns the IsRead flag of each message, by ID
+func readFlags(t *testing.T, db *gorm.DB, messages ...models.Message) []bool {
+	t.Helper()
+	flags := []bool{}
+	for _, message := range messages {
+		var stored models.Message
+		if err := db.First(&stored, message.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		flags = append(flags, stored.IsRead)
+	}
+	return flags
+}
+
+func TestMarkRead(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	sender := connectTestClient(hub, alice.ID)
+	laptop := connectTestClient(hub, bob.ID)
+
+	first := sendTestMessage(t, ms, alice, bob, "one")
+	second := sendTestMessage(t, ms, alice, bob, "two")
+	third := sendTestMessage(t, ms, alice, bob, "three")
+	conv := conversationRef{PeerID: alice.ID}
+
+	watermark, err := ms.MarkRead(bob.ID, conv, second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watermark.LastReadMessageID != second.ID {
+		t.Errorf("watermark = %d, want %d", watermark.LastReadMessageID, second.ID)
+	}
+	if got := readFlags(t, db, first, second, third); !got[0] || !got[1] || got[2] {
+		t.Errorf("read flags = %v, want the first two read", got)
+	}
+
+	// The sender and the reader's other devices get the receipt
+	for name, client := range map[string]*utils.Client{"sender": sender, "reader": laptop} {
+		env := nextEvent(t, client)
+		var receipt utils.ReceiptPayload
+		env.DecodePayload(&receipt)
+		if env.Type != utils.EventReceipt || receipt.Status != utils.ReceiptRead || receipt.MessageID != second.ID || receipt.UserID != bob.ID {
+			t.Errorf("%s got %s %+v", name, env.Type, receipt)
+		}
+	}
+
+	// Watermarks never move backwards, and a no-op sends no receipt
+	watermark, err = ms.MarkRead(bob.ID, conv, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watermark.LastReadMessageID != second.ID {
+		t.Errorf("watermark moved back to %d", watermark.LastReadMessageID)
+	}
+	expectNoEvent(t, hub, sender)
+
+	// Without a message the watermark moves to the latest one
+	if watermark, err = ms.MarkRead(bob.ID, conv, 0); err != nil {
+		t.Fatal(err)
+	}
+	if watermark.LastReadMessageID != third.ID {
+		t.Errorf("watermark = %d, want the latest %d", watermark.LastReadMessageID, third.ID)
+	}
+	if got := readFlags(t, db, third); !got[0] {
+		t.Error("the latest message isn't read")
+	}
+
+	// Messages from another conversation can't be used
+	carol := createTestUser(t, db, "carol")
+	other := sendTestMessage(t, ms, carol, bob, "hi")
+	if _, err := ms.MarkRead(bob.ID, conv, other.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("MarkRead() with another conversation's message = %v, want %v", err, ErrMessageNotFound)
+	}
+
+	// The sender reading their own messages doesn't flag them read
+	if _, err := ms.MarkRead(alice.ID, conversationRef{PeerID: bob.ID}, 0); err != nil {
+		t.Fatal(err)
+	}
+	var unread int64
+	db.Model(&models.Message{}).Where("sender_id = ? AND receiver_id = ? AND is_read = ?", bob.ID, alice.ID, true).Count(&unread)
+	if unread != 0 {
+		t.Errorf("%d messages to alice flagged read", unread)
+	}
+}
+
+func TestReadBy(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	gc := NewGroupController(ms)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	dave := createTestUser(t, db, "dave")
+	group := createTestGroup(t, gc, alice, bob, carol)
+
+	message := models.Message{Content: "hi", GroupID: group.ID}
+	if err := ms.Send(alice.ID, &message); err != nil {
+		t.Fatal(err)
+	}
+	later := models.Message{Content: "later", GroupID: group.ID}
+	if err := ms.Send(alice.ID, &later); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob read up to the later message, carol hasn't read anything
+	if err := ms.MarkReadMessage(bob.ID, later.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	readers, err := ms.ReadBy(alice.ID, message.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readers) != 1 || readers[0].ID != bob.ID {
+		t.Errorf("ReadBy() = %v, want bob", readers)
+	}
+
+	if _, err := ms.ReadBy(dave.ID, message.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("ReadBy() by an outsider = %v, want %v", err, ErrMessageNotFound)
+	}
+	if err := ms.MarkReadMessage(dave.ID, message.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("MarkReadMessage() by an outsider = %v, want %v", err, ErrMessageNotFound)
+	}
+}
+
+// messageIDs lists the IDs of the messages in order
+func messageIDs(messages []models.Message) []uint {
+	ids := []uint{}
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+	return ids
+}
+
+func TestHistory(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+
+	first := sendTestMessage(t, ms, alice, bob, "one")
+	second := sendTestMessage(t, ms, bob, alice, "two")
+	sendTestMessage(t, ms, alice, carol, "elsewhere")
+	third := sendTestMessage(t, ms, alice, bob, "three")
+	if err := ms.Delete(&bob, second.ID, utils.DeleteForMe); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := ms.History(bob.ID, conversationRef{PeerID: alice.ID}, utils.PageParams{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := messageIDs(page.Messages); !reflect.DeepEqual(ids, []uint{first.ID, third.ID}) {
+		t.Errorf("bob's history = %v, want %v without the hidden message", ids, []uint{first.ID, third.ID})
+	}
+	page, _ = ms.History(alice.ID, conversationRef{PeerID: bob.ID}, utils.PageParams{Limit: 10})
+	if ids := messageIDs(page.Messages); !reflect.DeepEqual(ids, []uint{first.ID, second.ID, third.ID}) {
+		t.Errorf("alice's history = %v, want all three", ids)
+	}
+
+	if _, err := ms.History(bob.ID, conversationRef{PeerID: carol.ID + 100}, utils.PageParams{Limit: 10}); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("History() with a missing peer = %v, want %v", err, ErrPeerNotFound)
+	}
+	if _, err := ms.History(bob.ID, conversationRef{GroupID: 1}, utils.PageParams{Limit: 10}); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("History() of a missing group = %v, want %v", err, ErrGroupNotFound)
+	}
+}
+
+func TestHistoryPaging(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+
+	// Seven messages between alice and bob, the 4th and 5th sent in the
+	// same instant so only their IDs order them
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	offsets := []int{0, 1, 2, 3, 3, 4, 5}
+	var all []uint
+	for i, offset := range offsets {
+		sender, receiver := alice.ID, bob.ID
+		if i%2 == 1 {
+			sender, receiver = bob.ID, alice.ID
+		}
+		message := models.Message{
+			Content:    fmt.Sprintf("m%d", i),
+			SenderID:   sender,
+			ReceiverID: &receiver,
+			Timestamp:  base.Add(time.Duration(offset) * time.Second),
+		}
+		if err := db.Create(&message).Error; err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, message.ID)
+	}
+	other := models.Message{Content: "elsewhere", SenderID: carol.ID, ReceiverID: &alice.ID, Timestamp: base.Add(2 * time.Second)}
+	if err := db.Create(&other).Error; err != nil {
+		t.Fatal(err)
+	}
+	conv := conversationRef{PeerID: bob.ID}
+	id := func(i int) string { return fmt.Sprint(all[i]) }
+
+	tests := []struct {
+		name     string
+		params   utils.PageParams
+		want     []uint
+		wantPrev bool
+		wantNext bool
+	}{
+		{"latest", utils.PageParams{Limit: 3}, all[4:], true, false},
+		{"everything", utils.PageParams{Limit: 10}, all, false, false},
+		{"before", utils.PageParams{Before: id(4), Limit: 3}, all[1:4], true, true},
+		{"before the start", utils.PageParams{Before: id(2), Limit: 3}, all[:2], false, true},
+		{"after", utils.PageParams{After: id(1), Limit: 3}, all[2:5], true, true},
+		{"after the end", utils.PageParams{After: id(4), Limit: 3}, all[5:], true, false},
+		{"around", utils.PageParams{Around: all[3], Limit: 3}, all[2:5], true, true},
+		{"around an even window", utils.PageParams{Around: all[3], Limit: 4}, all[2:6], true, true},
+		{"around the first", utils.PageParams{Around: all[0], Limit: 3}, all[:3], false, true},
+		{"around the last", utils.PageParams{Around: all[6], Limit: 3}, all[4:], true, false},
+		{"around everything", utils.PageParams{Around: all[3], Limit: 10}, all, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := ms.History(alice.ID, conv, tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := messageIDs(page.Messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got messages %v, want %v", got, tt.want)
+			}
+			if (page.PrevCursor != "") != tt.wantPrev || (page.NextCursor != "") != tt.wantNext {
+				t.Errorf("got prev cursor %q, next cursor %q; want prev %v, next %v", page.PrevCursor, page.NextCursor, tt.wantPrev, tt.wantNext)
+			}
+		})
+	}
+
+	t.Run("walking the cursors", func(t *testing.T) {
+		// Paging back from the latest and forward again visits every
+		// message once, including both sent in the same instant
+		var back []uint
+		params := utils.PageParams{Limit: 2}
+		for {
+			page, err := ms.History(alice.ID, conv, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			back = append(messageIDs(page.Messages), back...)
+			if page.PrevCursor == "" {
+				break
+			}
+			params = utils.PageParams{Before: page.PrevCursor, Limit: 2}
+		}
+		if !reflect.DeepEqual(back, all) {
+			t.Errorf("paging back visited %v, want %v", back, all)
+		}
+
+		var forward []uint
+		params = utils.PageParams{After: id(0), Limit: 2}
+		for {
+			page, err := ms.History(alice.ID, conv, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			forward = append(forward, messageIDs(page.Messages)...)
+			if page.NextCursor == "" {
+				break
+			}
+			params = utils.PageParams{After: page.NextCursor, Limit: 2}
+		}
+		if !reflect.DeepEqual(forward, all[1:]) {
+			t.Errorf("paging forward visited %v, want %v", forward, all[1:])
+		}
+	})
+
+	t.Run("message of another conversation", func(t *testing.T) {
+		// A bare ID from another conversation must not leak its timestamp
+		// through the page it would select
+		for _, params := range []utils.PageParams{
+			{Before: fmt.Sprint(other.ID), Limit: 3},
+			{After: fmt.Sprint(other.ID), Limit: 3},
+			{Around: other.ID, Limit: 3},
+		} {
+			if _, err := ms.History(alice.ID, conv, params); !errors.Is(err, ErrMessageNotFound) {
+				t.Errorf("History(%+v) = %v, want ErrMessageNotFound", params, err)
+			}
+		}
+	})
+
+	t.Run("invalid cursor", func(t *testing.T) {
+		if _, err := ms.History(alice.ID, conv, utils.PageParams{Before: "not a cursor", Limit: 3}); !errors.Is(err, utils.ErrInvalidCursor) {
+			t.Errorf("got %v, want ErrInvalidCursor", err)
+		}
+	})
+}
+
+func TestHistoryMarksDelivered(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	sender := connectTestClient(hub, alice.ID)
+
+	first := sendTestMessage(t, ms, alice, bob, "one")
+	second := sendTestMessage(t, ms, alice, bob, "two")
+	if err := ms.MarkDelivered(bob.ID, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, sender)
+
+	// Alice reading her own history delivers nothing
+	if _, err := ms.History(alice.ID, conversationRef{PeerID: bob.ID}, utils.PageParams{Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+	expectNoEvent(t, hub, sender)
+
+	page, err := ms.History(bob.ID, conversationRef{PeerID: alice.ID}, utils.PageParams{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range page.Messages {
+		if !message.IsDelivered {
+			t.Errorf("message %d isn't delivered in the response", message.ID)
+		}
+	}
+
+	// Only the message that wasn't delivered yet gets a receipt
+	env := nextEvent(t, sender)
+	var receipt utils.ReceiptPayload
+	env.DecodePayload(&receipt)
+	want := utils.ReceiptPayload{MessageID: second.ID, Status: utils.ReceiptDelivered, UserID: bob.ID}
+	if env.Type != utils.EventReceipt || receipt != want {
+		t.Errorf("sender got %s %+v, want receipt %+v", env.Type, receipt, want)
+	}
+	expectNoEvent(t, hub, sender)
+
+	var undelivered int64
+	db.Model(&models.Message{}).Where("is_delivered = ?", false).Count(&undelivered)
+	if undelivered != 0 {
+		t.Errorf("%d messages still undelivered", undelivered)
+	}
+}
+
+func TestGetMessagesIsScopedToTheCaller(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	mc := NewMessageController(ms)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	sendTestMessage(t, ms, alice, bob, "private")
+
+	get := func(user models.User, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/getmessage?"+query, nil)
+		r = r.WithContext(utils.SetUserInContext(r.Context(), user.Username))
+		w := httptest.NewRecorder()
+		mc.GetMessages(w, r)
+		return w
+	}
+
+	query := fmt.Sprintf("sender_id=%d&receiver_id=%d", alice.ID, bob.ID)
+	if w := get(carol, query); w.Code != http.StatusForbidden {
+		t.Errorf("a third party reading the conversation = %d, want 403", w.Code)
+	}
+
+	w := get(bob, query)
+	var page MessagePage
+	json.NewDecoder(w.Body).Decode(&page)
+	if w.Code != http.StatusOK || len(page.Messages) != 1 {
+		t.Errorf("GetMessages() = %d with %d messages, want 200 with 1", w.Code, len(page.Messages))
+	}
+}
@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"unicode"
+)
+
+var ErrInvalidEmoji = errors.New("reaction must be a single emoji")
+
+// maxEmojiLength is in bytes; it leaves room for ZWJ sequences such as
+// family emojis, which are several code points long
+const maxEmojiLength = 32
+
+// validEmoji accepts emojis, including ZWJ sequences, flags, keycaps and
+// skin tone variants, but no text
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLength {
+		return false
+	}
+	symbol := false
+	for _, r := range emoji {
+		switch {
+		case unicode.Is(unicode.So, r), r == '\u20e3':
+			// Pictographs, and the combining keycap mark
+			symbol = true
+		case unicode.Is(unicode.Sk, r), unicode.Is(unicode.Mn, r), unicode.Is(unicode.Cf, r):
+			// Skin tones, variation selectors and ZWJ
+		case r == '#' || r == '*' || (r >= '0' && r <= '9'):
+			// Keycap bases
+		default:
+			return false
+		}
+	}
+	return symbol
+}
+
+// reactableMessage loads a message the user can see and that still exists.
+// Messages can't be reacted to once the user and the other side of a direct
+// conversation, or the sender of a group message, blocked one another.
+func (ms *MessageService) reactableMessage(userID, messageID uint) (*models.Message, error) {
+	message, err := ms.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	visible, err := ms.canView(userID, message)
+	if err != nil {
+		return nil, err
+	}
+	if !visible || message.IsDeleted {
+		return nil, ErrMessageNotFound
+	}
+
+	peerID := message.SenderID
+	if peerID == userID && message.GroupID == 0 {
+		peerID = *message.ReceiverID
+	}
+	if peerID != userID {
+		blocked, err := isBlockedBetween(ms.DB, userID, peerID)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return nil, ErrBlocked
+		}
+	}
+	return message, nil
+}
+
+// React adds the user's reaction to a message and tells the conversation.
+// Reacting twice with the same emoji changes nothing.
+func (ms *MessageService) React(userID, messageID uint, emoji string) error {
+	if !validEmoji(emoji) {
+		return ErrInvalidEmoji
+	}
+	message, err := ms.reactableMessage(userID, messageID)
+	if err != nil {
+		return err
+	}
+
+	reaction := models.Reaction{MessageID: message.ID, UserID: userID, Emoji: emoji}
+	result := ms.DB.Where("message_id = ? AND user_id = ? AND emoji = ?", message.ID, userID, emoji).
+		FirstOrCreate(&reaction)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	payload := utils.ReactionPayload{MessageID: message.ID, UserID: userID, Emoji: emoji}
+	return ms.PublishEventFrom(userID, utils.EventReactionAdded, message, payload, nil)
+}
+
+// Unreact removes the user's reaction from a message and tells the conversation
+func (ms *MessageService) Unreact(userID, messageID uint, emoji string) error {
+	message, err := ms.reactableMessage(userID, messageID)
+	if err != nil {
+		return err
+	}
+
+	result := ms.DB.Where("message_id = ? AND user_id = ? AND emoji = ?", message.ID, userID, emoji).
+		Delete(&models.Reaction{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	payload := utils.ReactionPayload{MessageID: message.ID, UserID: userID, Emoji: emoji}
+	return ms.PublishEventFrom(userID, utils.EventReactionRemoved, message, payload, nil)
+}
+
+// attachReactions fills in the reaction counts of messages with a single
+// query, each message's emojis in the order they were first used
+func (ms *MessageService) attachReactions(userID uint, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID
+	}
+
+	var rows []struct {
+		MessageID uint
+		Emoji     string
+		Count     int64
+		Mine      int64
+	}
+	if err := ms.DB.Model(&models.Reaction{}).
+		Select("message_id, emoji, COUNT(*) AS count, SUM(CASE WHEN user_id = ? THEN 1 ELSE 0 END) AS mine", userID).
+		Where("message_id IN ?", ids).
+		Group("message_id, emoji").
+		Order("MIN(id)").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	counts := make(map[uint][]models.ReactionCount)
+	for _, row := range rows {
+		counts[row.MessageID] = append(counts[row.MessageID], models.ReactionCount{
+			Emoji: row.Emoji,
+			Count: row.Count,
+			Me:    row.Mine > 0,
+		})
+	}
+	for i := range messages {
+		messages[i].Reactions = counts[messages[i].ID]
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"reflect"
+	"testing"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		want  bool
+	}{
+		{"👍", true},
+		{"👍🏽", true},
+		{"❤️", true},
+		{"👨‍👩‍👧", true},
+		{"🇳🇬", true},
+		{"1️⃣", true},
+		{"", false},
+		{"a", false},
+		{"👍 nice", false},
+		{"7", false},
+		{"👍👍👍👍👍👍👍👍👍", false},
+	}
+	for _, tt := range tests {
+		if got := validEmoji(tt.emoji); got != tt.want {
+			t.Errorf("validEmoji(%q) = %v, want %v", tt.emoji, got, tt.want)
+		}
+	}
+}
+
+func TestReact(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	sender := connectTestClient(hub, alice.ID)
+
+	message := sendTestMessage(t, ms, alice, bob, "hello")
+	if err := ms.React(bob.ID, message.ID, "hi"); !errors.Is(err, ErrInvalidEmoji) {
+		t.Errorf("React() with text = %v, want %v", err, ErrInvalidEmoji)
+	}
+	if err := ms.React(carol.ID, message.ID, "👍"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("React() by an outsider = %v, want %v", err, ErrMessageNotFound)
+	}
+
+	// Reacting twice announces the reaction once
+	for i := 0; i < 2; i++ {
+		if err := ms.React(bob.ID, message.ID, "👍"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env := nextEvent(t, sender)
+	var payload utils.ReactionPayload
+	env.DecodePayload(&payload)
+	if env.Type != utils.EventReactionAdded || payload.MessageID != message.ID || payload.UserID != bob.ID || payload.Emoji != "👍" {
+		t.Errorf("sender got %s %+v", env.Type, payload)
+	}
+	expectNoEvent(t, hub, sender)
+
+	if err := ms.React(alice.ID, message.ID, "❤️"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.React(alice.ID, message.ID, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, sender)
+	nextEvent(t, sender)
+
+	// Counts come in first-use order and flag the caller's own reactions
+	page, err := ms.History(alice.ID, conversationRef{PeerID: bob.ID}, utils.PageParams{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.ReactionCount{{Emoji: "👍", Count: 2, Me: true}, {Emoji: "❤️", Count: 1, Me: true}}
+	if got := page.Messages[0].Reactions; !reflect.DeepEqual(got, want) {
+		t.Errorf("reactions = %+v, want %+v", got, want)
+	}
+
+	// Removing a reaction that isn't there is a no-op
+	if err := ms.Unreact(bob.ID, message.ID, "❤️"); err != nil {
+		t.Fatal(err)
+	}
+	expectNoEvent(t, hub, sender)
+	if err := ms.Unreact(bob.ID, message.ID, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	if env := nextEvent(t, sender); env.Type != utils.EventReactionRemoved {
+		t.Errorf("sender got %s, want %s", env.Type, utils.EventReactionRemoved)
+	}
+
+	// Retracted messages take no reactions
+	if err := ms.Delete(&alice, message.ID, utils.DeleteForEveryone); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.React(bob.ID, message.ID, "😮"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("React() on a retracted message = %v, want %v", err, ErrMessageNotFound)
+	}
+}
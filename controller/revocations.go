@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"github/similadayo/chitchat/config"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RevocationStore records logged out sessions and users in the database and
+// keeps the unexpired revocations in memory, so checking a token costs no
+// query. The cache is reloaded every RevocationRefresh to pick up logouts
+// made through other servers; this server's own apply immediately. Websocket
+// connections are closed the same way: right away on the server that handled
+// the logout, and on the others when Start's reload sees the revocation.
+type RevocationStore struct {
+	DB     *gorm.DB
+	Hub    *utils.Hub
+	Config utils.AuthConfig
+
+	mu sync.RWMutex
+	// sessions maps a revoked session to the time its revocation expires
+	sessions map[string]time.Time
+	// users maps a user ID to the time, in seconds, before which all of the
+	// user's tokens were revoked
+	users    map[string]int64
+	loadedAt time.Time
+	// first makes the checks made before the first load wait for it
+	first sync.Once
+}
+
+// NewRevocationStore creates the store; revocations are loaded on the first
+// check. Call Start to close revoked connections opened on this server.
+func NewRevocationStore(db *gorm.DB, hub *utils.Hub) *RevocationStore {
+	return &RevocationStore{
+		DB:       db,
+		Hub:      hub,
+		Config:   config.LoadAuthConfig(),
+		sessions: make(map[string]time.Time),
+		users:    make(map[string]int64),
+	}
+}
+
+// IsRevoked reports whether the token's session was logged out, or the
+// token was issued before its user logged out of every device
+func (rs *RevocationStore) IsRevoked(claims *utils.Claims) bool {
+	rs.reloadIfStale()
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.revoked(claims.SessionID, claims.Subject, claims.IssuedAt)
+}
+
+// revoked reports whether a token of the session and subject issued at the
+// given time, in seconds, was revoked. The caller must hold rs.mu.
+func (rs *RevocationStore) revoked(sessionID, subject string, issuedAt int64) bool {
+	// Tokens issued before sessions existed are rejected, since they
+	// couldn't be logged out
+	if sessionID == "" {
+		return true
+	}
+	if _, ok := rs.sessions[sessionID]; ok {
+		return true
+	}
+	cutoff, ok := rs.users[subject]
+	return ok && issuedAt < cutoff
+}
+
+// Start reloads the revocations every RevocationRefresh and closes this
+// server's websocket connections whose tokens they cover, which picks up
+// logouts made through other servers. It also deletes the expired
+// revocations, so requests never wait on the cleanup.
+func (rs *RevocationStore) Start() {
+	go func() {
+		ticker := time.NewTicker(rs.Config.RevocationRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := rs.purge(); err != nil {
+				log.Printf("Error deleting expired token revocations: %v", err)
+			}
+			rs.refresh()
+		}
+	}()
+}
+
+// refresh reloads the revocations and closes the connections they cover
+func (rs *RevocationStore) refresh() {
+	if err := rs.reload(); err != nil {
+		log.Printf("Error loading token revocations: %v", err)
+		return
+	}
+	rs.Hub.DisconnectRevoked(rs.clientRevoked)
+}
+
+// purge deletes the revocations whose tokens have all expired
+func (rs *RevocationStore) purge() error {
+	return rs.DB.Where("expires_at <= ?", time.Now()).Delete(&models.TokenRevocation{}).Error
+}
+
+// clientRevoked reports whether the token a websocket connection was
+// opened with has been revoked
+func (rs *RevocationStore) clientRevoked(client *utils.Client) bool {
+	subject := strconv.FormatUint(uint64(client.UserID), 10)
+	issuedAt, _ := client.TokenTimes()
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.revoked(client.SessionID, subject, issuedAt.Unix())
+}
+
+// RevokeSession logs out one session of the user, marking it revoked along
+// with its refresh tokens, and closes the websocket connections opened with
+// its tokens
+func (rs *RevocationStore) RevokeSession(userID uint, sessionID string) error {
+	err := rs.save(models.RevokeSession, sessionID, func(tx *gorm.DB, now time.Time) error {
+		if err := tx.Model(&models.Session{}).Where("id = ? AND revoked_at IS NULL", sessionID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.RefreshToken{}).Where("session_id = ? AND revoked_at IS NULL", sessionID).
+			Update("revoked_at", now).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	rs.sessions[sessionID] = time.Now().Add(rs.Config.AccessTokenTTL)
+	rs.mu.Unlock()
+
+	rs.Hub.DisconnectSession(userID, sessionID)
+	return nil
+}
+
+// RevokeUser logs the user out of every device: tokens issued until now
+// stop working, sessions and refresh tokens are revoked and all of the
+// user's websocket connections are closed. Tokens carry their issue time in
+// seconds, so callers should also revoke the session they are acting for.
+func (rs *RevocationStore) RevokeUser(userID uint) error {
+	subject := strconv.FormatUint(uint64(userID), 10)
+	err := rs.save(models.RevokeUser, subject, func(tx *gorm.DB, now time.Time) error {
+		if err := tx.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.RefreshToken{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	rs.users[subject] = time.Now().Unix()
+	rs.mu.Unlock()
+
+	rs.Hub.DisconnectUser(userID)
+	return nil
+}
+
+// save records a revocation, which is kept until every access token it
+// covers has expired, and runs revoke in the same transaction to revoke the
+// sessions and refresh tokens it covers, so no new access tokens are issued
+func (rs *RevocationStore) save(kind, subject string, revoke func(tx *gorm.DB, now time.Time) error) error {
+	now := time.Now()
+	return rs.DB.Transaction(func(tx *gorm.DB) error {
+		revocation := models.TokenRevocation{Kind: kind, Subject: subject}
+		err := tx.Where(&revocation).
+			Assign(models.TokenRevocation{RevokedAt: now, ExpiresAt: now.Add(rs.Config.AccessTokenTTL)}).
+			FirstOrCreate(&revocation).Error
+		if err != nil {
+			return err
+		}
+		return revoke(tx, now)
+	})
+}
+
+// reloadIfStale reloads the cache once it is older than RevocationRefresh.
+// Only the first load makes checks wait; later ones are made by a single
+// request while the others keep using the cache, which also stays in use
+// while the database can't be read.
+func (rs *RevocationStore) reloadIfStale() {
+	loaded := false
+	rs.first.Do(func() {
+		loaded = true
+		if err := rs.reload(); err != nil {
+			log.Printf("Error loading token revocations: %v", err)
+		}
+	})
+	if loaded {
+		return
+	}
+
+	rs.mu.RLock()
+	fresh := time.Since(rs.loadedAt) < rs.Config.RevocationRefresh
+	rs.mu.RUnlock()
+	if fresh {
+		return
+	}
+
+	rs.mu.Lock()
+	if time.Since(rs.loadedAt) < rs.Config.RevocationRefresh {
+		// Another request is reloading it
+		rs.mu.Unlock()
+		return
+	}
+	rs.loadedAt = time.Now()
+	rs.mu.Unlock()
+
+	if err := rs.reload(); err != nil {
+		log.Printf("Error loading token revocations: %v", err)
+	}
+}
+
+// reload replaces the cache with the unexpired revocations. The query runs
+// without holding rs.mu; revocations are never lifted before they expire,
+// so those cached meanwhile by this server are kept.
+func (rs *RevocationStore) reload() error {
+	now := time.Now()
+	var revocations []models.TokenRevocation
+	if err := rs.DB.Where("expires_at > ?", now).Find(&revocations).Error; err != nil {
+		return err
+	}
+
+	sessions := make(map[string]time.Time)
+	users := make(map[string]int64)
+	for _, revocation := range revocations {
+		switch revocation.Kind {
+		case models.RevokeSession:
+			sessions[revocation.Subject] = revocation.ExpiresAt
+		case models.RevokeUser:
+			users[revocation.Subject] = revocation.RevokedAt.Unix()
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for sessionID, expiresAt := range rs.sessions {
+		if _, ok := sessions[sessionID]; !ok && expiresAt.After(now) {
+			sessions[sessionID] = expiresAt
+		}
+	}
+	for subject, cutoff := range rs.users {
+		if cutoff > users[subject] && time.Unix(cutoff, 0).Add(rs.Config.AccessTokenTTL).After(now) {
+			users[subject] = cutoff
+		}
+	}
+	rs.sessions, rs.users = sessions, users
+	rs.loadedAt = now
+	return nil
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"strconv"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// newTestRevocationStore creates a store on the database whose cache is
+// reloaded every refresh, and starts its hub
+func newTestRevocationStore(db *gorm.DB, refresh time.Duration) *RevocationStore {
+	hub := utils.NewHub(utils.DefaultWebSocketConfig())
+	go hub.Run()
+	// NewRevocationStore reads the settings from the environment
+	rs := &RevocationStore{
+		DB:  db,
+		Hub: hub,
+		Config: utils.AuthConfig{
+			AccessTokenTTL:       15 * time.Minute,
+			RefreshTokenTTL:      24 * time.Hour,
+			RevocationRefresh:    refresh,
+			SessionTouchInterval: time.Minute,
+		},
+		sessions: make(map[string]time.Time),
+		users:    make(map[string]int64),
+	}
+	return rs
+}
+
+// testClaims returns the claims of a token of the user's session issued
+// at the given time
+func testClaims(userID uint, sessionID string, issuedAt time.Time) *utils.Claims {
+	claims := &utils.Claims{SessionID: sessionID}
+	claims.Subject = strconv.FormatUint(uint64(userID), 10)
+	claims.IssuedAt = issuedAt.Unix()
+	return claims
+}
+
+func TestRevocationStore(t *testing.T) {
+	db := newTestDB(t)
+	rs := newTestRevocationStore(db, time.Hour)
+	now := time.Now()
+
+	if !rs.IsRevoked(testClaims(1, "", now)) {
+		t.Error("a token without a session was accepted")
+	}
+	if rs.IsRevoked(testClaims(1, "s1", now)) {
+		t.Error("a token of a live session was rejected")
+	}
+
+	if err := db.Create(&models.Session{ID: "s1", UserID: 1, ExpiresAt: now.Add(time.Hour)}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.RevokeSession(1, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if !rs.IsRevoked(testClaims(1, "s1", now)) {
+		t.Error("a token of the revoked session was accepted")
+	}
+	if rs.IsRevoked(testClaims(1, "s2", now)) {
+		t.Error("revoking a session rejected another one")
+	}
+	var session models.Session
+	if err := db.First(&session, "id = ?", "s1").Error; err != nil || session.RevokedAt == nil {
+		t.Errorf("session row was not revoked: %v", err)
+	}
+
+	if err := rs.RevokeUser(2); err != nil {
+		t.Fatal(err)
+	}
+	if !rs.IsRevoked(testClaims(2, "s3", now.Add(-time.Minute))) {
+		t.Error("a token issued before the user logged out everywhere was accepted")
+	}
+	if rs.IsRevoked(testClaims(2, "s3", now.Add(time.Minute))) {
+		t.Error("a token issued after the user logged out everywhere was rejected")
+	}
+	if rs.IsRevoked(testClaims(1, "s4", now.Add(-time.Minute))) {
+		t.Error("logging a user out everywhere rejected another user's token")
+	}
+
+	t.Run("revocations made on another server", func(t *testing.T) {
+		// A second store on the same database starts with an empty cache
+		// and loads the revocations on its first check
+		other := newTestRevocationStore(db, time.Hour)
+		if !other.IsRevoked(testClaims(1, "s1", now)) {
+			t.Error("the session revoked elsewhere was accepted")
+		}
+		if !other.IsRevoked(testClaims(2, "s3", now.Add(-time.Minute))) {
+			t.Error("the user revoked elsewhere was accepted")
+		}
+
+		// Until the cache goes stale, new rows aren't seen
+		if err := rs.RevokeSession(1, "s5"); err != nil {
+			t.Fatal(err)
+		}
+		if other.IsRevoked(testClaims(1, "s5", now)) {
+			t.Error("the cache was reloaded before it went stale")
+		}
+		other.loadedAt = time.Time{}
+		if !other.IsRevoked(testClaims(1, "s5", now)) {
+			t.Error("the stale cache wasn't reloaded")
+		}
+	})
+
+	t.Run("expired revocations", func(t *testing.T) {
+		expired := models.TokenRevocation{Kind: models.RevokeSession, Subject: "old", RevokedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+		if err := db.Create(&expired).Error; err != nil {
+			t.Fatal(err)
+		}
+		rs.loadedAt = time.Time{}
+		if rs.IsRevoked(testClaims(1, "old", now)) {
+			t.Error("an expired revocation was still applied")
+		}
+
+		// Checks only read; the cleanup is left to Start
+		var count int64
+		db.Model(&models.TokenRevocation{}).Where("subject = ?", "old").Count(&count)
+		if count != 1 {
+			t.Error("a check deleted the expired revocation")
+		}
+		if err := rs.purge(); err != nil {
+			t.Fatal(err)
+		}
+		db.Model(&models.TokenRevocation{}).Where("subject = ?", "old").Count(&count)
+		if count != 0 {
+			t.Error("the expired revocation wasn't deleted")
+		}
+		if !rs.IsRevoked(testClaims(1, "s1", now)) {
+			t.Error("purging dropped a live revocation")
+		}
+	})
+
+	t.Run("revocations cached during a reload", func(t *testing.T) {
+		// A session revoked here but not yet read back by a reload stays
+		// revoked; the cache only grows until revocations expire
+		rs.mu.Lock()
+		rs.sessions["s6"] = now.Add(time.Hour)
+		rs.mu.Unlock()
+		if err := rs.reload(); err != nil {
+			t.Fatal(err)
+		}
+		if !rs.IsRevoked(testClaims(1, "s6", now)) {
+			t.Error("a cached revocation was dropped by the reload")
+		}
+	})
+}
+
+func TestRevocationStoreClosesSocketsOfOtherServers(t *testing.T) {
+	db := newTestDB(t)
+	here := newTestRevocationStore(db, time.Hour)
+	there := newTestRevocationStore(db, time.Hour)
+
+	// Both connections are open on the other server
+	connect := func(userID uint, sessionID string) *utils.Client {
+		client := utils.NewClient(nil, utils.RandomID(), userID, "user")
+		client.SessionID = sessionID
+		client.SetToken(time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+		there.Hub.Register(client)
+		return client
+	}
+	revoked := connect(1, "s1")
+	kept := connect(1, "s2")
+
+	if err := here.RevokeSession(1, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	// What Start does every RevocationRefresh
+	there.refresh()
+
+	select {
+	case _, ok := <-revoked.Send:
+		if ok {
+			t.Fatal("unexpected frame before the close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the revoked session's socket wasn't closed")
+	}
+
+	select {
+	case _, ok := <-kept.Send:
+		if !ok {
+			t.Error("the socket of another session was closed")
+		}
+	default:
+	}
+}
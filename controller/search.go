@@ -0,0 +1,312 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"html"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+var ErrEmptySearch = errors.New("search text is required")
+
+// maxSearchTerms bounds the number of words a search may match on
+const maxSearchTerms = 8
+
+// SearchIndex is a full-text index over message content. MessageService
+// applies the caller's scope, filters and pagination; the index only decides
+// which messages contain the search terms.
+type SearchIndex interface {
+	// Setup creates the index and anything keeping it up to date
+	Setup(db *gorm.DB) error
+	// Match restricts a message query to messages containing every term,
+	// each matched as a word prefix
+	Match(query *gorm.DB, terms []string) *gorm.DB
+}
+
+// NewSearchIndex returns the search index suited to the database and sets
+// it up. SQLite uses FTS5 when the driver was built with it (the
+// sqlite_fts5 build tag) and falls back to LIKE otherwise.
+func NewSearchIndex(db *gorm.DB) (SearchIndex, error) {
+	switch name := db.Dialector.Name(); name {
+	case "mysql":
+		if err := (mysqlSearchIndex{}).Setup(db); err != nil {
+			return nil, err
+		}
+		return mysqlSearchIndex{}, nil
+	case "sqlite":
+		if err := (sqliteSearchIndex{}).Setup(db); err != nil {
+			log.Printf("FTS5 is not available, searching messages with LIKE: %v", err)
+			return likeSearchIndex{}, nil
+		}
+		return sqliteSearchIndex{}, nil
+	default:
+		return nil, fmt.Errorf("no search index for %s", name)
+	}
+}
+
+// mysqlSearchIndex uses a FULLTEXT index in boolean mode
+type mysqlSearchIndex struct{}
+
+const mysqlFullTextIndex = "idx_messages_content_fulltext"
+
+func (mysqlSearchIndex) Setup(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&models.Message{}, mysqlFullTextIndex) {
+		return nil
+	}
+	return db.Exec("CREATE FULLTEXT INDEX " + mysqlFullTextIndex + " ON messages (content)").Error
+}
+
+func (mysqlSearchIndex) Match(query *gorm.DB, terms []string) *gorm.DB {
+	boolean := make([]string, len(terms))
+	for i, term := range terms {
+		boolean[i] = "+" + term + "*"
+	}
+	return query.Where("MATCH (content) AGAINST (? IN BOOLEAN MODE)", strings.Join(boolean, " "))
+}
+
+// sqliteSearchIndex uses an FTS5 table over messages.content, kept in sync
+// by triggers
+type sqliteSearchIndex struct{}
+
+func (sqliteSearchIndex) Setup(db *gorm.DB) error {
+	if db.Migrator().HasTable("messages_fts") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		statements := []string{
+			"CREATE VIRTUAL TABLE messages_fts USING fts5(content, content='messages', content_rowid='id')",
+			`CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+				INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+			END`,
+			`CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+				INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+			END`,
+			`CREATE TRIGGER messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+				INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+				INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+			END`,
+			// Index the messages stored before the table existed
+			"INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')",
+		}
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (sqliteSearchIndex) Match(query *gorm.DB, terms []string) *gorm.DB {
+	phrases := make([]string, len(terms))
+	for i, term := range terms {
+		phrases[i] = `"` + term + `"*`
+	}
+	return query.Where("id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)", strings.Join(phrases, " "))
+}
+
+// likeSearchIndex scans message content with LIKE. It needs no setup and
+// works anywhere, but reads every message in scope.
+type likeSearchIndex struct{}
+
+func (likeSearchIndex) Setup(db *gorm.DB) error {
+	return nil
+}
+
+func (likeSearchIndex) Match(query *gorm.DB, terms []string) *gorm.DB {
+	for _, term := range terms {
+		query = query.Where("LOWER(content) LIKE ?", "%"+term+"%")
+	}
+	return query
+}
+
+// searchTerms splits search text into lowercased words; anything that isn't
+// a letter or digit separates words, so terms never carry query syntax
+func searchTerms(text string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), isNotWordRune) {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
+
+func isNotWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// MessageSearch is a search request. Everything but Text is optional.
+type MessageSearch struct {
+	Text          string
+	SenderID      uint
+	Conversation  *conversationRef
+	Since         time.Time
+	Until         time.Time
+	HasAttachment bool
+	Before        uint
+	Limit         int
+}
+
+// SearchResult is a matching message with an HTML snippet of its content in
+// which the matched words are wrapped in <mark>
+type SearchResult struct {
+	ConversationID string         `json:"conversation_id"`
+	Snippet        string         `json:"snippet"`
+	Message        models.Message `json:"message"`
+}
+
+// SearchPage is one page of search results, newest first
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// Search finds the messages containing every word of the search text in the
+// conversations the user takes part in
+func (ms *MessageService) Search(userID uint, search MessageSearch) (*SearchPage, error) {
+	terms := searchTerms(search.Text)
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+
+	memberOf := ms.DB.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID)
+	query := ms.DB.Model(&models.Message{}).
+		Where("((group_id = 0 AND (sender_id = ? OR receiver_id = ?)) OR group_id IN (?))", userID, userID, memberOf).
+		Where("id NOT IN (?)", hiddenMessageIDs(ms.DB, userID)).
+		Where("is_deleted = ?", false)
+	query = ms.Index.Match(query, terms)
+
+	if search.Conversation != nil {
+		query = search.Conversation.scope(query, userID)
+	}
+	if search.SenderID != 0 {
+		query = query.Where("sender_id = ?", search.SenderID)
+	}
+	if !search.Since.IsZero() {
+		query = query.Where("timestamp >= ?", search.Since)
+	}
+	if !search.Until.IsZero() {
+		query = query.Where("timestamp < ?", search.Until)
+	}
+	if search.HasAttachment {
+		// image_url covers messages sent before attachments were uploads
+		query = query.Where("(image_url <> '' OR EXISTS (SELECT 1 FROM attachments WHERE attachments.message_id = messages.id))")
+	}
+	if search.Before != 0 {
+		query = query.Where("id < ?", search.Before)
+	}
+
+	var messages []models.Message
+	if err := query.Preload("Sender").Preload("Attachments.Variants").Order("id DESC").Limit(search.Limit + 1).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	page := &SearchPage{Results: []SearchResult{}}
+	if len(messages) > search.Limit {
+		messages = messages[:search.Limit]
+		page.NextCursor = utils.Cursor{ID: messages[len(messages)-1].ID}.Encode()
+	}
+	for _, message := range messages {
+		page.Results = append(page.Results, SearchResult{
+			ConversationID: conversationOf(&message, userID).String(),
+			Snippet:        highlightSnippet(message.Content, terms),
+			Message:        message,
+		})
+	}
+	return page, nil
+}
+
+// Snippets show a few words of context before the first match and are cut
+// off after snippetWords words
+const (
+	snippetLead  = 5
+	snippetWords = 24
+)
+
+// highlightSnippet returns an HTML-escaped excerpt of content around the
+// first word matching a term, with matching words wrapped in <mark>
+func highlightSnippet(content string, terms []string) string {
+	type span struct{ start, end int }
+
+	var words []span
+	start := -1
+	for i, r := range content {
+		if isNotWordRune(r) {
+			if start >= 0 {
+				words = append(words, span{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, span{start, len(content)})
+	}
+
+	matches := func(word string) bool {
+		word = strings.ToLower(word)
+		for _, term := range terms {
+			if strings.HasPrefix(word, term) {
+				return true
+			}
+		}
+		return false
+	}
+
+	first := 0
+	for i, w := range words {
+		if matches(content[w.start:w.end]) {
+			first = i
+			break
+		}
+	}
+	from := first - snippetLead
+	if from < 0 {
+		from = 0
+	}
+	to := from + snippetWords
+	if to > len(words) {
+		to = len(words)
+	}
+	if from >= to {
+		return html.EscapeString(content)
+	}
+
+	var b strings.Builder
+	pos := 0
+	if from > 0 {
+		b.WriteString("…")
+		pos = words[from].start
+	}
+	for _, w := range words[from:to] {
+		b.WriteString(html.EscapeString(content[pos:w.start]))
+		word := html.EscapeString(content[w.start:w.end])
+		if matches(content[w.start:w.end]) {
+			word = "<mark>" + word + "</mark>"
+		}
+		b.WriteString(word)
+		pos = w.end
+	}
+	if to < len(words) {
+		b.WriteString("…")
+	} else {
+		b.WriteString(html.EscapeString(content[pos:]))
+	}
+	return b.String()
+}
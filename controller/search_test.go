@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"reflect"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello, World", []string{"hello", "world"}},
+		{`"quoted" +must -not* OR`, []string{"quoted", "must", "not", "or"}},
+		{"again and AGAIN", []string{"again", "and"}},
+		{"a b c d e f g h i j", []string{"a", "b", "c", "d", "e", "f", "g", "h"}},
+		{" -*\" ", nil},
+	}
+	for _, tt := range tests {
+		if got := searchTerms(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		content string
+		terms   []string
+		want    string
+	}{
+		{"Lunch at noon?", []string{"lun"}, "<mark>Lunch</mark> at noon?"},
+		{"<b>tea</b> & Tea", []string{"tea"}, "&lt;b&gt;<mark>tea</mark>&lt;/b&gt; &amp; <mark>Tea</mark>"},
+		{
+			"one two three four five six seven eight target",
+			[]string{"target"},
+			"…four five six seven eight <mark>target</mark>",
+		},
+		{"???", []string{"x"}, "???"},
+	}
+	for _, tt := range tests {
+		if got := highlightSnippet(tt.content, tt.terms); got != tt.want {
+			t.Errorf("highlightSnippet(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+// searchIDs lists the message IDs of a search page in order
+func searchIDs(page *SearchPage) []uint {
+	ids := []uint{}
+	for _, result := range page.Results {
+		ids = append(ids, result.Message.ID)
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	index, err := NewSearchIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.Index = index
+	gc := NewGroupController(ms)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	group := createTestGroup(t, gc, carol, alice)
+
+	first := sendTestMessage(t, ms, alice, bob, "Lunch tomorrow?")
+	second := sendTestMessage(t, ms, bob, alice, "lunch sounds good")
+	sendTestMessage(t, ms, bob, carol, "lunch without alice")
+	groupMessage := models.Message{Content: "group lunch on friday", GroupID: group.ID}
+	if err := ms.Send(carol.ID, &groupMessage); err != nil {
+		t.Fatal(err)
+	}
+	hidden := sendTestMessage(t, ms, bob, alice, "lunch, hidden")
+	if err := ms.Delete(&alice, hidden.ID, utils.DeleteForMe); err != nil {
+		t.Fatal(err)
+	}
+	deleted := sendTestMessage(t, ms, alice, bob, "lunch, deleted")
+	if err := ms.Delete(&alice, deleted.ID, utils.DeleteForEveryone); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only visible messages from the user's own conversations match
+	page, err := ms.Search(alice.ID, MessageSearch{Text: "LUNCH", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchIDs(page), []uint{groupMessage.ID, second.ID, first.ID}; !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %v, want %v", got, want)
+	}
+	if result := page.Results[1]; result.ConversationID != (conversationRef{PeerID: bob.ID}).String() || result.Snippet != "<mark>lunch</mark> sounds good" {
+		t.Errorf("result = %s %q", result.ConversationID, result.Snippet)
+	}
+
+	// Every term must match, each as a word prefix
+	if page, _ = ms.Search(alice.ID, MessageSearch{Text: "lunch goo", Limit: 10}); !reflect.DeepEqual(searchIDs(page), []uint{second.ID}) {
+		t.Errorf("two-term results = %v, want [%d]", searchIDs(page), second.ID)
+	}
+
+	// Filters narrow the results
+	filters := []struct {
+		name   string
+		search MessageSearch
+		want   []uint
+	}{
+		{"sender", MessageSearch{SenderID: alice.ID}, []uint{first.ID}},
+		{"conversation", MessageSearch{Conversation: &conversationRef{GroupID: group.ID}}, []uint{groupMessage.ID}},
+		{"before", MessageSearch{Before: second.ID}, []uint{first.ID}},
+		{"attachment", MessageSearch{HasAttachment: true}, []uint{}},
+	}
+	for _, tt := range filters {
+		tt.search.Text = "lunch"
+		tt.search.Limit = 10
+		page, err := ms.Search(alice.ID, tt.search)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := searchIDs(page); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: results = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Pages continue from the cursor
+	page, _ = ms.Search(alice.ID, MessageSearch{Text: "lunch", Limit: 2})
+	if page.NextCursor == "" || !reflect.DeepEqual(searchIDs(page), []uint{groupMessage.ID, second.ID}) {
+		t.Errorf("first page = %v, cursor %q", searchIDs(page), page.NextCursor)
+	}
+
+	if _, err := ms.Search(alice.ID, MessageSearch{Text: " ?! ", Limit: 10}); !errors.Is(err, ErrEmptySearch) {
+		t.Errorf("Search() without words = %v, want %v", err, ErrEmptySearch)
+	}
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionService keeps track of the devices users are logged in on. It
+// checks the session of every authenticated request, through the revocation
+// store, and records when each session was last used.
+type SessionService struct {
+	DB          *gorm.DB
+	Config      utils.AuthConfig
+	Revocations *RevocationStore
+
+	// touched holds the sessions whose last-seen time was written since
+	// touchedAt; it is reset every SessionTouchInterval
+	mu        sync.Mutex
+	touched   map[string]bool
+	touchedAt time.Time
+}
+
+// NewSessionService creates the service. It shares the revocation store's
+// database and settings.
+func NewSessionService(revocations *RevocationStore) *SessionService {
+	return &SessionService{
+		DB:          revocations.DB,
+		Config:      revocations.Config,
+		Revocations: revocations,
+		touched:     make(map[string]bool),
+	}
+}
+
+// Start records a new session for the user logging in with the request
+func (ss *SessionService) Start(userID uint, deviceName string, r *http.Request) (*models.Session, error) {
+	now := time.Now()
+	session := &models.Session{
+		ID:         utils.RandomID(),
+		UserID:     userID,
+		DeviceName: truncate(strings.TrimSpace(deviceName), 100),
+		UserAgent:  truncate(r.UserAgent(), 255),
+		IP:         clientIP(r),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ss.Config.RefreshTokenTTL),
+	}
+	if err := ss.DB.Create(session).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// IsRevoked reports whether the token's session was logged out
+func (ss *SessionService) IsRevoked(claims *utils.Claims) bool {
+	return ss.Revocations.IsRevoked(claims)
+}
+
+// Touch updates the last-seen time of the token's session, at most once
+// per SessionTouchInterval so busy clients don't write on every request
+func (ss *SessionService) Touch(claims *utils.Claims) {
+	ss.mu.Lock()
+	if time.Since(ss.touchedAt) >= ss.Config.SessionTouchInterval {
+		ss.touched = make(map[string]bool)
+		ss.touchedAt = time.Now()
+	}
+	if ss.touched[claims.SessionID] {
+		ss.mu.Unlock()
+		return
+	}
+	ss.touched[claims.SessionID] = true
+	ss.mu.Unlock()
+
+	if err := ss.DB.Model(&models.Session{}).Where("id = ?", claims.SessionID).
+		Update("last_seen_at", time.Now()).Error; err != nil {
+		log.Printf("Error updating session %s: %v", claims.SessionID, err)
+	}
+}
+
+// List returns the user's active sessions, most recently used first, with
+// the current one marked
+func (ss *SessionService) List(userID uint, currentID string) ([]models.Session, error) {
+	var sessions []models.Session
+	if err := ss.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+	return sessions, nil
+}
+
+// Revoke logs out one of the user's active sessions
+func (ss *SessionService) Revoke(userID uint, sessionID string) error {
+	var session models.Session
+	if err := ss.DB.Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	return ss.Revocations.RevokeSession(userID, sessionID)
+}
+
+// End logs out the session a request was made with. Unlike Revoke it
+// doesn't need a recorded session, so tokens issued before sessions were
+// recorded can be logged out too.
+func (ss *SessionService) End(userID uint, sessionID string) error {
+	return ss.Revocations.RevokeSession(userID, sessionID)
+}
+
+// RevokeAll logs the user out of every device, including the current
+// session
+func (ss *SessionService) RevokeAll(userID uint, currentID string) error {
+	if err := ss.Revocations.RevokeUser(userID); err != nil {
+		return err
+	}
+	return ss.Revocations.RevokeSession(userID, currentID)
+}
+
+// clientIP returns the address the request came from, preferring the first
+// X-Forwarded-For hop set by a proxy. It's only shown to the user, so a
+// spoofed header does no harm.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		ip := strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		if net.ParseIP(ip) != nil {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// truncate cuts s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// newTestUserController wires a user controller to test attachments and
+// sessions
+func newTestUserController(t *testing.T, db *gorm.DB) *UserController {
+	t.Helper()
+	rs := newTestRevocationStore(db, time.Hour)
+	return NewUserController(db, newTestAttachments(t, db), NewSessionService(rs), NewTokenService(rs))
+}
+
+// startLogin records a session as a login from the given address would
+func startLogin(t *testing.T, ss *SessionService, user models.User, device, forwardedFor string) *models.Session {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("User-Agent", "chitchat-test")
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	session, err := ss.Start(user.ID, device, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestSessions(t *testing.T) {
+	db := newTestDB(t)
+	ss := NewSessionService(newTestRevocationStore(db, time.Hour))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	phone := startLogin(t, ss, alice, "  Phone ", "203.0.113.7, 10.0.0.2")
+	laptop := startLogin(t, ss, alice, strings.Repeat("é", 60), "not an address")
+	theirs := startLogin(t, ss, bob, "Phone", "")
+
+	if phone.DeviceName != "Phone" || phone.IP != "203.0.113.7" || phone.UserAgent != "chitchat-test" {
+		t.Errorf("phone = %q from %s with %q", phone.DeviceName, phone.IP, phone.UserAgent)
+	}
+	// Long names are cut without splitting characters, and a bad
+	// X-Forwarded-For falls back to the connection's address
+	if laptop.DeviceName != strings.Repeat("é", 50) || laptop.IP != "10.0.0.1" {
+		t.Errorf("laptop = %q from %s", laptop.DeviceName, laptop.IP)
+	}
+
+	db.Model(phone).Update("last_seen_at", time.Now().Add(-time.Hour))
+	sessions, err := ss.List(alice.ID, phone.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != laptop.ID || sessions[1].ID != phone.ID {
+		t.Fatalf("sessions = %+v, want the laptop then the phone", sessions)
+	}
+	if sessions[0].Current || !sessions[1].Current {
+		t.Error("the phone isn't the only current session")
+	}
+
+	// Other users' sessions can't be revoked
+	if err := ss.Revoke(alice.ID, theirs.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Revoke() of bob's session = %v, want %v", err, ErrSessionNotFound)
+	}
+	if err := ss.Revoke(alice.ID, laptop.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !ss.IsRevoked(testClaims(alice.ID, laptop.ID, time.Now())) {
+		t.Error("tokens of the revoked session are still accepted")
+	}
+	if err := ss.Revoke(alice.ID, laptop.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("revoking twice = %v, want %v", err, ErrSessionNotFound)
+	}
+	if sessions, _ := ss.List(alice.ID, phone.ID); len(sessions) != 1 || sessions[0].ID != phone.ID {
+		t.Errorf("sessions after a revoke = %+v, want the phone", sessions)
+	}
+
+	if err := ss.RevokeAll(alice.ID, phone.ID); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ := ss.List(alice.ID, phone.ID); len(sessions) != 0 {
+		t.Errorf("sessions after logging out everywhere = %+v", sessions)
+	}
+	if sessions, _ := ss.List(bob.ID, theirs.ID); len(sessions) != 1 {
+		t.Error("logging alice out everywhere ended bob's session")
+	}
+}
+
+func TestTouchSession(t *testing.T) {
+	db := newTestDB(t)
+	ss := NewSessionService(newTestRevocationStore(db, time.Hour))
+	alice := createTestUser(t, db, "alice")
+	session := startLogin(t, ss, alice, "Phone", "")
+
+	lastSeen := func() time.Time {
+		t.Helper()
+		var stored models.Session
+		if err := db.First(&stored, "id = ?", session.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		return stored.LastSeenAt
+	}
+	stale := time.Now().Add(-time.Hour)
+	db.Model(session).Update("last_seen_at", stale)
+
+	claims := testClaims(alice.ID, session.ID, time.Now())
+	ss.Touch(claims)
+	touched := lastSeen()
+	if !touched.After(stale) {
+		t.Fatal("Touch() didn't update the last-seen time")
+	}
+
+	// Within SessionTouchInterval the session is written once
+	db.Model(session).Update("last_seen_at", stale)
+	ss.Touch(claims)
+	if !lastSeen().Equal(stale) {
+		t.Error("a second Touch() within the interval wrote again")
+	}
+
+	ss.Config.SessionTouchInterval = 0
+	ss.Touch(claims)
+	if !lastSeen().After(stale) {
+		t.Error("Touch() after the interval didn't write")
+	}
+}
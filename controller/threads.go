@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+)
+
+// threadReply checks that a message replies to a live message of its own
+// conversation and places it in that message's thread
+func (ms *MessageService) threadReply(message *models.Message) error {
+	target, err := ms.findMessage(*message.ReplyToID)
+	if err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			return ErrInvalidReply
+		}
+		return err
+	}
+	if target.IsDeleted || target.IsSystem ||
+		conversationOf(target, message.SenderID) != conversationOf(message, message.SenderID) {
+		return ErrInvalidReply
+	}
+
+	rootID := target.ID
+	if target.ThreadRootID != nil {
+		rootID = *target.ThreadRootID
+	}
+	message.ThreadRootID = &rootID
+	return nil
+}
+
+// publishThreadReply tells the people who wrote in a thread, including its
+// root, that a reply was posted. Former group members and members on either
+// side of a block with the replier are left out.
+func (ms *MessageService) publishThreadReply(message *models.Message) error {
+	rootID := *message.ThreadRootID
+
+	var participants []uint
+	if err := ms.DB.Model(&models.Message{}).
+		Where("id = ? OR thread_root_id = ?", rootID, rootID).
+		Distinct().Pluck("sender_id", &participants).Error; err != nil {
+		return err
+	}
+
+	recipients, err := ms.Recipients(message)
+	if err != nil {
+		return err
+	}
+	if recipients, err = withoutBlocked(ms.DB, message.SenderID, recipients); err != nil {
+		return err
+	}
+	inConversation := make(map[uint]bool, len(recipients))
+	for _, id := range recipients {
+		inConversation[id] = true
+	}
+	userIDs := participants[:0]
+	for _, id := range participants {
+		if inConversation[id] {
+			userIDs = append(userIDs, id)
+		}
+	}
+
+	counts, err := ms.replyCounts(rootID, userIDs)
+	if err != nil {
+		return err
+	}
+
+	// Each participant gets the count attachThreads would show them, so
+	// those sharing a count share an event
+	byCount := make(map[int64][]uint)
+	for _, id := range userIDs {
+		byCount[counts[id]] = append(byCount[counts[id]], id)
+	}
+	for count, ids := range byCount {
+		ms.Hub.SendEvent(utils.EventThreadReply, utils.ThreadReplyPayload{
+			RootID:     rootID,
+			ReplyCount: count,
+			Message:    message,
+		}, ids...)
+	}
+	return nil
+}
+
+// replyCounts counts the replies to a thread root for each user, leaving out
+// the replies the user deleted for themselves like attachThreads does
+func (ms *MessageService) replyCounts(rootID uint, userIDs []uint) (map[uint]int64, error) {
+	var total int64
+	if err := ms.DB.Model(&models.Message{}).Where("thread_root_id = ?", rootID).Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		UserID uint
+		Hidden int64
+	}
+	if len(userIDs) > 0 {
+		if err := ms.DB.Model(&models.HiddenMessage{}).
+			Select("hidden_messages.user_id, COUNT(*) AS hidden").
+			Joins("JOIN messages ON messages.id = hidden_messages.message_id").
+			Where("messages.thread_root_id = ? AND hidden_messages.user_id IN ?", rootID, userIDs).
+			Group("hidden_messages.user_id").
+			Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	counts := make(map[uint]int64, len(userIDs))
+	for _, id := range userIDs {
+		counts[id] = total
+	}
+	for _, row := range rows {
+		counts[row.UserID] = total - row.Hidden
+	}
+	return counts, nil
+}
+
+// attachThreads fills in the reply count and last reply of the thread roots
+// among messages, with one query for the counts and one for the last replies
+func (ms *MessageService) attachThreads(userID uint, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID
+	}
+
+	var rows []struct {
+		RootID      uint
+		ReplyCount  int64
+		LastReplyID uint
+	}
+	if err := ms.DB.Model(&models.Message{}).
+		Select("thread_root_id AS root_id, COUNT(*) AS reply_count, MAX(id) AS last_reply_id").
+		Where("thread_root_id IN ?", ids).
+		Where("id NOT IN (?)", hiddenMessageIDs(ms.DB, userID)).
+		Group("thread_root_id").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	lastIDs := make([]uint, len(rows))
+	for i, row := range rows {
+		lastIDs[i] = row.LastReplyID
+	}
+	var lastReplies []models.Message
+	if err := ms.DB.Preload("Sender").Where("id IN ?", lastIDs).Find(&lastReplies).Error; err != nil {
+		return err
+	}
+	replies := make(map[uint]*models.Message, len(lastReplies))
+	for i := range lastReplies {
+		replies[lastReplies[i].ID] = &lastReplies[i]
+	}
+
+	summaries := make(map[uint]*models.ThreadSummary, len(rows))
+	for _, row := range rows {
+		summaries[row.RootID] = &models.ThreadSummary{ReplyCount: row.ReplyCount, LastReply: replies[row.LastReplyID]}
+	}
+	for i := range messages {
+		messages[i].Thread = summaries[messages[i].ID]
+	}
+	return nil
+}
+
+// ThreadPage is a thread root and a page of its replies, oldest first
+type ThreadPage struct {
+	Root       models.Message   `json:"root"`
+	Replies    []models.Message `json:"replies"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// Thread returns the thread a message belongs to, whether it is the root or
+// one of the replies. after is the next_cursor of the previous page.
+func (ms *MessageService) Thread(userID, messageID uint, after string, limit int) (*ThreadPage, error) {
+	message, err := ms.findMessage(messageID)
+	if err != nil {
+		return nil, err
+	}
+	visible, err := ms.canView(userID, message)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, ErrMessageNotFound
+	}
+
+	root := message
+	if message.ThreadRootID != nil {
+		if root, err = ms.findMessage(*message.ThreadRootID); err != nil {
+			return nil, err
+		}
+	}
+
+	query := ms.DB.Preload("Sender").Preload("Attachments.Variants").
+		Where("thread_root_id = ?", root.ID).
+		Where("id NOT IN (?)", hiddenMessageIDs(ms.DB, userID))
+	if after != "" {
+		afterID, err := utils.IDFromCursorParam(after)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("id > ?", afterID)
+	}
+
+	page := &ThreadPage{Replies: []models.Message{}}
+	if err := query.Order("id").Limit(limit + 1).Find(&page.Replies).Error; err != nil {
+		return nil, err
+	}
+	if len(page.Replies) > limit {
+		page.Replies = page.Replies[:limit]
+		page.NextCursor = utils.Cursor{ID: page.Replies[limit-1].ID}.Encode()
+	}
+
+	if err := ms.DB.Preload("Sender").Preload("Attachments.Variants").First(&page.Root, root.ID).Error; err != nil {
+		return nil, err
+	}
+	// The root and the replies are decorated together, then split again
+	messages := append([]models.Message{page.Root}, page.Replies...)
+	if err := ms.attachThreads(userID, messages[:1]); err != nil {
+		return nil, err
+	}
+	if err := ms.attachReactions(userID, messages); err != nil {
+		return nil, err
+	}
+	page.Root, page.Replies = messages[0], messages[1:]
+	return page, nil
+}
@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"reflect"
+	"testing"
+)
+
+// replyTo sends a reply from sender to receiver in the thread of message
+func replyTo(t *testing.T, ms *MessageService, sender, receiver models.User, message models.Message, content string) models.Message {
+	t.Helper()
+	reply := models.Message{Content: content, ReceiverID: &receiver.ID, ReplyToID: &message.ID}
+	if err := ms.Send(sender.ID, &reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestThreadReplies(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+
+	root := sendTestMessage(t, ms, alice, bob, "root")
+	reply := replyTo(t, ms, bob, alice, root, "reply")
+	nested := replyTo(t, ms, alice, bob, reply, "nested")
+
+	// Replies to replies join the root's thread
+	for _, message := range []models.Message{reply, nested} {
+		if message.ThreadRootID == nil || *message.ThreadRootID != root.ID {
+			t.Errorf("message %d has thread root %v, want %d", message.ID, message.ThreadRootID, root.ID)
+		}
+	}
+
+	// Replies must stay in the conversation and answer a live message
+	other := sendTestMessage(t, ms, alice, carol, "elsewhere")
+	retracted := sendTestMessage(t, ms, alice, bob, "retracted")
+	if err := ms.Delete(&alice, retracted.ID, utils.DeleteForEveryone); err != nil {
+		t.Fatal(err)
+	}
+	missing := models.Message{}
+	missing.ID = other.ID + 100
+	for name, target := range map[string]models.Message{"other conversation": other, "retracted": retracted, "missing": missing} {
+		message := models.Message{Content: "x", ReceiverID: &bob.ID, ReplyToID: &target.ID}
+		if err := ms.Send(alice.ID, &message); !errors.Is(err, ErrInvalidReply) {
+			t.Errorf("%s: Send() = %v, want %v", name, err, ErrInvalidReply)
+		}
+	}
+
+	// Clients can't place a message in a thread themselves
+	forged := models.Message{Content: "x", ReceiverID: &bob.ID, ThreadRootID: &root.ID}
+	if err := ms.Send(alice.ID, &forged); err != nil || forged.ThreadRootID != nil {
+		t.Errorf("Send() with a thread root = %v, thread %v", err, forged.ThreadRootID)
+	}
+}
+
+func TestThread(t *testing.T) {
+	db := newTestDB(t)
+	ms := NewMessageService(db, newTestHub())
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+
+	root := sendTestMessage(t, ms, alice, bob, "root")
+	var replies []models.Message
+	for _, content := range []string{"one", "two", "three"} {
+		replies = append(replies, replyTo(t, ms, bob, alice, root, content))
+	}
+	if err := ms.Delete(&alice, replies[1].ID, utils.DeleteForMe); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any message of the thread opens it; replies deleted for the user are
+	// neither listed nor counted
+	page, err := ms.Thread(alice.ID, replies[2].ID, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Root.ID != root.ID || page.Root.Thread == nil || page.Root.Thread.ReplyCount != 2 {
+		t.Fatalf("root = %d with %+v, want %d with 2 replies", page.Root.ID, page.Root.Thread, root.ID)
+	}
+	if page.Root.Thread.LastReply == nil || page.Root.Thread.LastReply.ID != replies[2].ID {
+		t.Errorf("last reply = %v, want %d", page.Root.Thread.LastReply, replies[2].ID)
+	}
+	got := messageIDs(page.Replies)
+	if page, err = ms.Thread(alice.ID, root.ID, page.NextCursor, 1); err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, messageIDs(page.Replies)...)
+	if want := []uint{replies[0].ID, replies[2].ID}; !reflect.DeepEqual(got, want) || page.NextCursor != "" {
+		t.Errorf("replies = %v, want %v", got, want)
+	}
+
+	if _, err := ms.Thread(carol.ID, root.ID, "", 10); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Thread() by an outsider = %v, want %v", err, ErrMessageNotFound)
+	}
+
+	// History shows the summary on the root
+	history, err := ms.History(bob.ID, conversationRef{PeerID: alice.ID}, utils.PageParams{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range history.Messages {
+		if message.ID == root.ID && (message.Thread == nil || message.Thread.ReplyCount != 3) {
+			t.Errorf("history root thread = %+v, want 3 replies", message.Thread)
+		}
+	}
+}
+
+func TestPublishThreadReply(t *testing.T) {
+	db := newTestDB(t)
+	hub := newTestHub()
+	ms := NewMessageService(db, hub)
+	gc := NewGroupController(ms)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	group := createTestGroup(t, gc, alice, bob, carol)
+
+	send := func(sender models.User, replyTo *uint) models.Message {
+		message := models.Message{Content: "hi", GroupID: group.ID, ReplyToID: replyTo}
+		if err := ms.Send(sender.ID, &message); err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+	root := send(alice, nil)
+	first := send(bob, &root.ID)
+	if err := ms.Delete(&alice, first.ID, utils.DeleteForMe); err != nil {
+		t.Fatal(err)
+	}
+
+	author := connectTestClient(hub, alice.ID)
+	replier := connectTestClient(hub, bob.ID)
+	bystander := connectTestClient(hub, carol.ID)
+	reply := send(bob, &root.ID)
+	if err := ms.publishThreadReply(&reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// Participants get the count their own history would show
+	for name, tt := range map[string]struct {
+		client *utils.Client
+		count  int64
+	}{"author": {author, 1}, "replier": {replier, 2}} {
+		env := nextEvent(t, tt.client)
+		var payload utils.ThreadReplyPayload
+		env.DecodePayload(&payload)
+		if env.Type != utils.EventThreadReply || payload.RootID != root.ID || payload.ReplyCount != tt.count {
+			t.Errorf("%s got %s %+v, want %d replies", name, env.Type, payload, tt.count)
+		}
+	}
+	expectNoEvent(t, hub, bystander)
+}
@@ -0,0 +1,181 @@
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid or has expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, the session has been logged out")
+
+	// errRefreshRaced means another request used the refresh token first
+	errRefreshRaced = errors.New("refresh token was used concurrently")
+)
+
+// tokenErrorStatus maps token errors to HTTP status codes
+func tokenErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidRefreshToken), errors.Is(err, ErrRefreshTokenReused):
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// TokenPair is what a client gets at login and on every refresh. Token is
+// the short-lived access token sent as the bearer token.
+type TokenPair struct {
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// TokenService issues access tokens together with single-use refresh
+// tokens, and rotates them on refresh
+type TokenService struct {
+	DB          *gorm.DB
+	Config      utils.AuthConfig
+	Revocations *RevocationStore
+}
+
+// NewTokenService creates the service. It shares the revocation store's
+// database and settings, since logging out revokes refresh tokens too.
+func NewTokenService(revocations *RevocationStore) *TokenService {
+	return &TokenService{DB: revocations.DB, Config: revocations.Config, Revocations: revocations}
+}
+
+// Issue returns the first tokens of a new login session
+func (ts *TokenService) Issue(user *models.User, sessionID string) (*TokenPair, error) {
+	return ts.issue(ts.DB, user, sessionID)
+}
+
+// Refresh exchanges a refresh token for new tokens of the same session.
+// Presenting a token that was already used logs the session out, since
+// either the client or whoever stole the token holds an old copy and
+// there's no telling which.
+func (ts *TokenService) Refresh(raw string) (*TokenPair, error) {
+	var token models.RefreshToken
+	if err := ts.DB.Where("token_hash = ?", hashRefreshToken(raw)).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	if token.RevokedAt != nil || !time.Now().Before(token.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if token.UsedAt != nil {
+		return nil, ts.reused(&token)
+	}
+
+	// Tokens of sessions that were never recorded can't be listed or
+	// revoked by the user, so those sessions have to log in again
+	var session models.Session
+	if err := ts.DB.Where("id = ? AND revoked_at IS NULL", token.SessionID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	var user models.User
+	if err := ts.DB.First(&user, token.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	var pair *TokenPair
+	err := ts.DB.Transaction(func(tx *gorm.DB) error {
+		// Only one request may use the token
+		result := tx.Model(&models.RefreshToken{}).Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshRaced
+		}
+
+		var err error
+		pair, err = ts.issue(tx, &user, token.SessionID)
+		return err
+	})
+	if errors.Is(err, errRefreshRaced) {
+		return nil, ts.reused(&token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// reused revokes the session of a refresh token that was presented twice,
+// which revokes every refresh token of its family
+func (ts *TokenService) reused(token *models.RefreshToken) error {
+	if err := ts.Revocations.RevokeSession(token.UserID, token.SessionID); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// issue signs an access token, stores the hash of a new refresh token for
+// the session and extends the session
+func (ts *TokenService) issue(tx *gorm.DB, user *models.User, sessionID string) (*TokenPair, error) {
+	now := time.Now()
+	access, err := utils.GenerateJwt(user.ID, user.Username, sessionID, ts.Config.AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	raw := hex.EncodeToString(secret)
+
+	refresh := models.RefreshToken{
+		UserID:    user.ID,
+		SessionID: sessionID,
+		TokenHash: hashRefreshToken(raw),
+		ExpiresAt: now.Add(ts.Config.RefreshTokenTTL),
+	}
+	if err := tx.Create(&refresh).Error; err != nil {
+		return nil, err
+	}
+
+	// The session lasts as long as its newest refresh token
+	if err := tx.Model(&models.Session{}).Where("id = ?", sessionID).
+		Updates(map[string]interface{}{"last_seen_at": now, "expires_at": refresh.ExpiresAt}).Error; err != nil {
+		return nil, err
+	}
+
+	// Expired tokens are no longer needed to detect reuse
+	if err := tx.Where("user_id = ? AND expires_at <= ?", user.ID, now).Delete(&models.RefreshToken{}).Error; err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		Token:            access,
+		ExpiresAt:        now.Add(ts.Config.AccessTokenTTL).Truncate(time.Second),
+		RefreshToken:     raw,
+		RefreshExpiresAt: refresh.ExpiresAt,
+	}, nil
+}
+
+// hashRefreshToken returns the stored form of a refresh token. The tokens
+// are random, so a plain hash is enough to make a database leak useless.
+func hashRefreshToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"errors"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"testing"
+	"time"
+)
+
+// useTestKey makes GenerateJwt and ParseJwt use a fixed HS256 secret
+func useTestKey(t *testing.T) {
+	t.Helper()
+	km := utils.NewKeyManager()
+	km.SetKeys(nil, utils.NewHMACKey("", []byte("test secret")))
+	utils.UseKeyManager(km)
+}
+
+// startTestSession records a session of the user and issues its first tokens
+func startTestSession(t *testing.T, ts *TokenService, user *models.User) (*models.Session, *TokenPair) {
+	t.Helper()
+	session := &models.Session{ID: utils.RandomID(), UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := ts.DB.Create(session).Error; err != nil {
+		t.Fatal(err)
+	}
+	pair, err := ts.Issue(user, session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, pair
+}
+
+func TestRefresh(t *testing.T) {
+	useTestKey(t)
+	db := newTestDB(t)
+	rs := newTestRevocationStore(db, time.Hour)
+	ts := NewTokenService(rs)
+	alice := createTestUser(t, db, "alice")
+
+	session, first := startTestSession(t, ts, &alice)
+	second, err := ts.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("the refresh token wasn't rotated")
+	}
+	claims, err := utils.ParseJwt(second.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.SessionID != session.ID || claims.Username != "alice" {
+		t.Errorf("access token has session %q user %q, want %q alice", claims.SessionID, claims.Username, session.ID)
+	}
+	third, err := ts.Refresh(second.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first token turns up again: someone holds an old copy, so the
+	// whole session is logged out
+	if _, err := ts.Refresh(first.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reusing a refresh token = %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := ts.Refresh(third.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("the newest token of the family = %v, want ErrInvalidRefreshToken", err)
+	}
+	if !rs.IsRevoked(claims) {
+		t.Error("access tokens of the reused session are still accepted")
+	}
+	var stored models.Session
+	if err := db.First(&stored, "id = ?", session.ID).Error; err != nil || stored.RevokedAt == nil {
+		t.Errorf("the session wasn't revoked: %v", err)
+	}
+
+	t.Run("other sessions", func(t *testing.T) {
+		// Alice's other device keeps working
+		_, pair := startTestSession(t, ts, &alice)
+		if _, err := ts.Refresh(pair.RefreshToken); err != nil {
+			t.Errorf("refreshing another session = %v", err)
+		}
+	})
+
+	t.Run("invalid tokens", func(t *testing.T) {
+		if _, err := ts.Refresh("not a token"); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("unknown token = %v, want ErrInvalidRefreshToken", err)
+		}
+
+		_, expired := startTestSession(t, ts, &alice)
+		db.Model(&models.RefreshToken{}).Where("token_hash = ?", hashRefreshToken(expired.RefreshToken)).
+			Update("expires_at", time.Now().Add(-time.Second))
+		if _, err := ts.Refresh(expired.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("expired token = %v, want ErrInvalidRefreshToken", err)
+		}
+
+		revoked, pair := startTestSession(t, ts, &alice)
+		if err := rs.RevokeSession(alice.ID, revoked.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ts.Refresh(pair.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("token of a logged out session = %v, want ErrInvalidRefreshToken", err)
+		}
+	})
+}
@@ -2,10 +2,11 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github/similadayo/chitchat/config"
 	"github/similadayo/chitchat/models"
 	"github/similadayo/chitchat/utils"
+	"mime"
 	"net/http"
 	"time"
 
@@ -13,51 +14,141 @@ import (
 	"gorm.io/gorm"
 )
 
+var errInvalidUserBody = errors.New("Invalid request body")
+
+// userBodyStatus maps errors from decodeUser to HTTP status codes
+func userBodyStatus(err error) int {
+	if errors.Is(err, errInvalidUserBody) {
+		return http.StatusBadRequest
+	}
+	return attachmentErrorStatus(err)
+}
+
 type UserController struct {
-	DB *gorm.DB
+	DB          *gorm.DB
+	Attachments *AttachmentService
+	Sessions    *SessionService
+	Tokens      *TokenService
 }
 
 // NewUserController creates a new user controller
-func NewUserController() *UserController {
-	db, err := config.ConnectDB()
+func NewUserController(db *gorm.DB, attachments *AttachmentService, sessions *SessionService, tokens *TokenService) *UserController {
+	return &UserController{DB: db, Attachments: attachments, Sessions: sessions, Tokens: tokens}
+}
+
+// userInput is the part of a user that clients may set. Everything else,
+// such as the avatar and moderator flag, is owned by the server.
+type userInput struct {
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// decodeUser reads the user fields of a JSON body, or of a multipart form
+// that may also carry a profile_pic image. The picture is uploaded to
+// storage and returned unsaved; it's nil when none was sent.
+func (uc *UserController) decodeUser(w http.ResponseWriter, r *http.Request) (*userInput, *models.Attachment, error) {
+	var user userInput
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+			return nil, nil, errInvalidUserBody
+		}
+		return &user, nil, nil
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, uc.Attachments.Config.MaxAvatarSize+multipartOverhead)
+	if err := r.ParseMultipartForm(multipartOverhead); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, nil, ErrAttachmentTooLarge
+		}
+		return nil, nil, errInvalidUserBody
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	user.Username = r.FormValue("username")
+	user.Email = r.FormValue("email")
+	user.Password = r.FormValue("password")
+	user.FirstName = r.FormValue("first_name")
+	user.LastName = r.FormValue("last_name")
+
+	file, header, err := r.FormFile("profile_pic")
+	if errors.Is(err, http.ErrMissingFile) {
+		return &user, nil, nil
+	}
 	if err != nil {
-		panic(err)
+		return nil, nil, errInvalidUserBody
 	}
+	defer file.Close()
 
-	config.MigrateDB(db)
-	return &UserController{DB: db}
+	avatar, err := uc.Attachments.Upload(r.Context(), models.AttachmentAvatar, header.Filename, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user, avatar, nil
 }
 
-// RegisterUser registers a new user
-func (uc *UserController) RegisterUser(w http.ResponseWriter, r *http.Request) {
-	var user models.User
+// saveAvatar records an uploaded profile picture for the user and points
+// the profile at it
+func saveAvatar(tx *gorm.DB, user *models.User, avatar *models.Attachment) error {
+	avatar.UploaderID = user.ID
+	if err := tx.Create(avatar).Error; err != nil {
+		return err
+	}
+	user.ProfilePic = avatar.URL()
+	user.AvatarID = &avatar.ID
+	user.Avatar = avatar
+	return tx.Model(user).Updates(map[string]interface{}{
+		"profile_pic": user.ProfilePic,
+		"avatar_id":   avatar.ID,
+	}).Error
+}
 
+// RegisterUser registers a new user from a JSON body, or from a multipart
+// form when a profile picture is uploaded with it
+func (uc *UserController) RegisterUser(w http.ResponseWriter, r *http.Request) {
 	// Parse the request body
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	input, avatar, err := uc.decodeUser(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), userBodyStatus(err))
 		return
 	}
 
 	// Hash the password before saving the user
-	hashedPassword, err := utils.HashPassword(user.Password)
+	hashedPassword, err := utils.HashPassword(input.Password)
 	if err != nil {
 		http.Error(w, "Could not hash the password", http.StatusInternalServerError)
 		return
 	}
-	user.Password = hashedPassword
-
-	// Handle image upload for profile picture
-	file, handler, err := r.FormFile("profile_pic")
-	if err == nil {
-		defer file.Close()
-		user.ProfilePic = handler.Filename
+	user := &models.User{
+		Username:  input.Username,
+		Email:     input.Email,
+		Password:  hashedPassword,
+		FirstName: input.FirstName,
+		LastName:  input.LastName,
 	}
 
-	// Save the user in the database
-	if err := uc.DB.Create(&user).Error; err != nil {
+	// Save the user in the database, with the uploaded profile picture
+	err = uc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		if avatar != nil {
+			return saveAvatar(tx, user, avatar)
+		}
+		return nil
+	})
+	if err != nil {
 		http.Error(w, "Could not save the user", http.StatusInternalServerError)
 		return
 	}
+	if avatar != nil {
+		uc.Attachments.Process(avatar)
+	}
 
 	// Respond with success message
 	w.Header().Set("Content-Type", "application/json")
@@ -65,9 +156,14 @@ func (uc *UserController) RegisterUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "User created successfully"})
 }
 
-// LoginUser logs in a user
+// LoginUser logs in a user, starting a session for the device named by
+// device_name
 func (uc *UserController) LoginUser(w http.ResponseWriter, r *http.Request) {
-	var user models.User
+	var user struct {
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		DeviceName string `json:"device_name"`
+	}
 
 	// Parse the request body
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
@@ -88,17 +184,40 @@ func (uc *UserController) LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate a JWT token for the authenticated user
-	token, err := utils.GenerateJwt(existingUser.Username)
+	// Issue the tokens of a new session for the authenticated user
+	session, err := uc.Sessions.Start(existingUser.ID, user.DeviceName, r)
+	if err != nil {
+		http.Error(w, "Could not start a session", http.StatusInternalServerError)
+		return
+	}
+	tokens, err := uc.Tokens.Issue(&existingUser, session.ID)
 	if err != nil {
 		http.Error(w, "Could not generate JWT token", http.StatusInternalServerError)
 		return
 	}
 
-	// Respond with the token
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	// Respond with the access and refresh tokens
+	utils.RespondWithJSON(w, http.StatusOK, tokens)
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token can only be used once.
+func (uc *UserController) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := uc.Tokens.Refresh(body.RefreshToken)
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, tokens)
 }
 
 // Other functions (e.g., update user, delete user, etc.) can be added similarly.
@@ -116,7 +235,7 @@ func (uc *UserController) GetUserProfile(w http.ResponseWriter, r *http.Request)
 
 	// Fetch the full user from the database using the username
 	var user models.User
-	if err := uc.DB.Where("username = ?", username).First(&user).Error; err != nil {
+	if err := uc.DB.Preload("Avatar.Variants").Where("username = ?", username).First(&user).Error; err != nil {
 		fmt.Println("Error fetching user from database:", err)
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -142,28 +261,37 @@ func (uc *UserController) UpdateUserProfile(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	var updatedUser models.User
-	if err := json.NewDecoder(r.Body).Decode(&updatedUser); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	// A multipart form may carry a new profile picture
+	updatedUser, avatar, err := uc.decodeUser(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), userBodyStatus(err))
 		return
 	}
 
-	//handles image upload for profile picture
-	file, handler, err := r.FormFile("profile_pic")
-	if err == nil {
-		defer file.Close()
-		updatedUser.ProfilePic = handler.Filename
-	}
-
 	user.FirstName = updatedUser.FirstName
 	user.LastName = updatedUser.LastName
 	user.Email = updatedUser.Email
-	user.ProfilePic = updatedUser.ProfilePic
 
-	if err := uc.DB.Save(&user).Error; err != nil {
+	err = uc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		if avatar != nil {
+			return saveAvatar(tx, &user, avatar)
+		}
+		return nil
+	})
+	if err != nil {
 		http.Error(w, "Could not update the user", http.StatusInternalServerError)
 		return
 	}
+	if avatar != nil {
+		uc.Attachments.Process(avatar)
+	}
+	if err := uc.DB.Preload("Avatar.Variants").First(&user, user.ID).Error; err != nil {
+		http.Error(w, "Could not load the user", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -194,24 +322,65 @@ func (uc *UserController) DeleteUserProfile(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(map[string]string{"message": "User deleted successfully"})
 }
 
-// GetAllUsers returns all the users
+// GetAllUsers returns a page of users ordered by ID. The after parameter
+// takes the next_cursor of the previous page. Users who blocked the current
+// user are left out.
 func (uc *UserController) GetAllUsers(w http.ResponseWriter, r *http.Request) {
-	var users []models.User
+	user, err := currentUser(uc.DB, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
-	//Get all the users from the database
-	if err := uc.DB.Find(&users).Error; err != nil {
+	params, err := utils.ParsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Before != "" || params.Around != 0 {
+		http.Error(w, "Users can only be paged forward with after", http.StatusBadRequest)
+		return
+	}
+
+	query := uc.DB.Where("id NOT IN (?)", blockersOf(uc.DB, user.ID)).Order("id").Limit(params.Limit + 1)
+	if params.After != "" {
+		afterID, err := utils.IDFromCursorParam(params.After)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("id > ?", afterID)
+	}
+
+	//Get a page of users from the database, plus one to see if there are more
+	users := []models.User{}
+	if err := query.Find(&users).Error; err != nil {
 		http.Error(w, "Could not get the users", http.StatusInternalServerError)
 		return
 	}
 
+	response := map[string]interface{}{"users": users}
+	if len(users) > params.Limit {
+		users = users[:params.Limit]
+		response["users"] = users
+		response["next_cursor"] = utils.Cursor{ID: users[len(users)-1].ID}.Encode()
+	}
+
 	//Respond with the users
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(users)
+	json.NewEncoder(w).Encode(response)
 }
 
-// GetUserByUserName returns a user by UserName
+// GetUserByUserName returns a user by UserName, unless they blocked the
+// current user
 func (uc *UserController) GetUserByUserName(w http.ResponseWriter, r *http.Request) {
+	viewer, err := currentUser(uc.DB, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	//Get the UserName from the URL
 	vars := mux.Vars(r)
 	userName := vars["username"]
@@ -224,7 +393,8 @@ func (uc *UserController) GetUserByUserName(w http.ResponseWriter, r *http.Reque
 
 	//Get the user by UserName
 	var user models.User
-	if err := uc.DB.Where("username = ?", userName).First(&user).Error; err != nil {
+	if err := uc.DB.Preload("Avatar.Variants").Where("username = ?", userName).
+		Where("id NOT IN (?)", blockersOf(uc.DB, viewer.ID)).First(&user).Error; err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
@@ -259,78 +429,150 @@ func (uc *UserController) GetUserByEmail(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(user)
 }
 
-// BlockUser blocks a user
+// BlockUser adds the {username} user to the current user's block list.
+// Neither side can then message, react to or see the presence of the other,
+// and the blocked user can no longer look the blocker up.
 func (uc *UserController) BlockUser(w http.ResponseWriter, r *http.Request) {
-	//Get the authenticated user from the request context
-	user := r.Context().Value("user").(models.User)
+	user, err := currentUser(uc.DB, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
-	//Get the user to block by UserName
-	userName := r.URL.Query().Get("username")
+	if err := Block(uc.DB, user.ID, mux.Vars(r)["username"]); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
 
-	//Check if the UserName is empty
-	if userName == "" {
-		http.Error(w, "UserName is required", http.StatusBadRequest)
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "User blocked successfully"})
+}
+
+// UnblockUser removes the {username} user from the current user's block list
+func (uc *UserController) UnblockUser(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(uc.DB, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	//Get the user to block
-	var userToBlock models.User
-	if err := uc.DB.Where("username = ?", userName).First(&userToBlock).Error; err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+	if err := Unblock(uc.DB, user.ID, mux.Vars(r)["username"]); err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
 		return
 	}
 
-	//Block the user
-	if err := uc.DB.Model(&user).Association("BlockedUsers").Append(&userToBlock); err != nil {
-		http.Error(w, "Could not block the user", http.StatusInternalServerError)
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "User unblocked successfully"})
+}
+
+// GetBlockedUsers lists the users the current user has blocked
+func (uc *UserController) GetBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(uc.DB, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	//Respond with success message
-	w.Header().Set("Content-Type", "application/json")
+	blocked, err := BlockedUsers(uc.DB, user.ID)
+	if err != nil {
+		http.Error(w, "Could not get the blocked users", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"users": blocked})
+}
+
+// Logout revokes the session of the request's token, closing its websocket
+// connections, so none of its tokens can be used again
+func (uc *UserController) Logout(w http.ResponseWriter, r *http.Request) {
+	user, claims, ok := uc.currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	if err := uc.Sessions.End(user.ID, claims.SessionID); err != nil {
+		http.Error(w, "Could not log out", http.StatusInternalServerError)
+		return
+	}
+
+	clearAuthCookie(w)
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User blocked successfully"})
+	w.Write([]byte("Successfully logged out"))
 }
 
-// UnblockUser unblocks a user
-func (uc *UserController) UnblockUser(w http.ResponseWriter, r *http.Request) {
-	//Get the authenticated user from the request context
-	user := r.Context().Value("user").(models.User)
+// LogoutAll revokes every token issued to the user so far, logging them out
+// of all their devices
+func (uc *UserController) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user, claims, ok := uc.currentSession(w, r)
+	if !ok {
+		return
+	}
 
-	//Get the user to unblock by UserName
-	userName := r.URL.Query().Get("username")
+	if err := uc.Sessions.RevokeAll(user.ID, claims.SessionID); err != nil {
+		http.Error(w, "Could not log out", http.StatusInternalServerError)
+		return
+	}
 
-	//Check if the UserName is empty
-	if userName == "" {
-		http.Error(w, "UserName is required", http.StatusBadRequest)
+	clearAuthCookie(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Successfully logged out of all devices"))
+}
+
+// GetSessions lists the devices the current user is logged in on
+func (uc *UserController) GetSessions(w http.ResponseWriter, r *http.Request) {
+	user, claims, ok := uc.currentSession(w, r)
+	if !ok {
 		return
 	}
 
-	//Get the user to unblock
-	var userToUnblock models.User
-	if err := uc.DB.Where("username = ?", userName).First(&userToUnblock).Error; err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+	sessions, err := uc.Sessions.List(user.ID, claims.SessionID)
+	if err != nil {
+		http.Error(w, "Could not get the sessions", http.StatusInternalServerError)
 		return
 	}
 
-	//Unblock the user
-	if err := uc.DB.Model(&user).Association("BlockedUsers").Delete(&userToUnblock); err != nil {
-		http.Error(w, "Could not unblock the user", http.StatusInternalServerError)
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"sessions": sessions})
+}
+
+// RevokeSession logs the current user out of the {id} session, closing its
+// websocket connections
+func (uc *UserController) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := uc.currentSession(w, r)
+	if !ok {
 		return
 	}
 
-	//Respond with success message
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User unblocked successfully"})
+	if err := uc.Sessions.Revoke(user.ID, mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Could not revoke the session", http.StatusInternalServerError)
+		return
+	}
+
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Session revoked successfully"})
 }
 
-// LogoutUser logs out a user
-func (uc *UserController) Logout(w http.ResponseWriter, r *http.Request) {
-	// Clear the Authorization header or token on client side
-	w.Header().Set("Authorization", "")
+// currentSession returns the user and the token claims of the request,
+// writing the error response when they're missing
+func (uc *UserController) currentSession(w http.ResponseWriter, r *http.Request) (*models.User, *utils.Claims, bool) {
+	claims, ok := utils.GetClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, nil, false
+	}
 
-	// You could also delete a token from cookies (if stored in cookies)
+	user, err := currentUser(uc.DB, r)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return user, claims, true
+}
+
+// clearAuthCookie clears the Authorization header and expires the token
+// cookie of clients that keep it there
+func clearAuthCookie(w http.ResponseWriter) {
+	w.Header().Set("Authorization", "")
 	http.SetCookie(w, &http.Cookie{
 		Name:     "Authorization",
 		Value:    "",
@@ -338,8 +580,4 @@ func (uc *UserController) Logout(w http.ResponseWriter, r *http.Request) {
 		Expires:  time.Now().Add(-1 * time.Hour), // Expiring the cookie immediately
 		HttpOnly: true,
 	})
-
-	// Optionally respond with a message
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Successfully logged out"))
 }
@@ -2,22 +2,232 @@ package controller
 
 import (
 	"fmt"
+	"github/similadayo/chitchat/models"
 	"github/similadayo/chitchat/utils"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
 )
 
-func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := utils.UpgradeConnection(w, r)
+type WebSocketController struct {
+	DB       *gorm.DB
+	Hub      *utils.Hub
+	Messages *MessageService
+	Sessions *SessionService
+}
+
+// NewWebSocketController creates a new websocket controller and registers
+// its frame handlers with the hub
+func NewWebSocketController(messages *MessageService, sessions *SessionService) *WebSocketController {
+	hub := messages.Hub
+	wc := &WebSocketController{DB: messages.DB, Hub: hub, Messages: messages, Sessions: sessions}
+	hub.Handle(utils.EventAuth, wc.handleAuth)
+	hub.Handle(utils.EventMessageSend, wc.handleMessageSend)
+	hub.Handle(utils.EventTyping, wc.handleTyping)
+	hub.Handle(utils.EventPresence, wc.handlePresence)
+	hub.Handle(utils.EventReceipt, wc.handleReceipt)
+	return wc
+}
+
+// WebSocketHandler authenticates the request, upgrades it and registers the
+// connection with the hub. Browsers can't set headers on a websocket handshake,
+// so the token may also be sent as a subprotocol or a query parameter.
+func (wc *WebSocketController) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	tokenString := utils.TokenFromRequest(r)
+	if tokenString == "" {
+		http.Error(w, "Authorization token is required", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := utils.ParseJwt(tokenString)
 	if err != nil {
-		fmt.Fprintf(w, "%+v\n", err)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if wc.Sessions.IsRevoked(claims) {
+		http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+		return
 	}
+	wc.Sessions.Touch(claims)
 
-	client := &utils.Client{
-		ID:   "1",
-		Conn: conn,
-		Send: make(chan []byte),
+	var user models.User
+	if err := wc.DB.Where("username = ?", claims.Username).First(&user).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
 	}
 
+	conn, err := utils.UpgradeConnection(w, r)
+	if err != nil {
+		// The upgrader has already replied to the client
+		log.Printf("Error upgrading connection: %v", err)
+		return
+	}
+
+	client := utils.NewClient(conn, utils.RandomID(), user.ID, user.Username)
+	client.SessionID = claims.SessionID
+	client.SetToken(time.Unix(claims.IssuedAt, 0), time.Unix(claims.ExpiresAt, 0))
+	wc.Hub.Register(client)
+
 	go utils.HandleMessages(client)
 	go utils.WriteMessage(client)
 }
+
+// handleAuth moves the connection onto a fresh access token of its session,
+// so it stays open past the expiry of the token it was opened with. Clients
+// send one after every refresh.
+func (wc *WebSocketController) handleAuth(client *utils.Client, env *utils.Envelope) error {
+	var payload utils.AuthPayload
+	if err := env.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	claims, err := utils.ParseJwt(payload.Token)
+	if err != nil {
+		return utils.NewProtocolError(utils.ErrCodeUnauthorized, "invalid token")
+	}
+	if claims.Subject != strconv.FormatUint(uint64(client.UserID), 10) || claims.SessionID != client.SessionID {
+		return utils.NewProtocolError(utils.ErrCodeForbidden, "the token belongs to another session")
+	}
+	if wc.Sessions.IsRevoked(claims) {
+		return utils.NewProtocolError(utils.ErrCodeUnauthorized, "token has been revoked")
+	}
+	wc.Sessions.Touch(claims)
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	client.SetToken(time.Unix(claims.IssuedAt, 0), expiresAt)
+	client.SendEvent(utils.EventAuthAck, utils.AuthAckPayload{RefID: env.ID, ExpiresAt: expiresAt})
+	return nil
+}
+
+// handleMessageSend stores a message through the message service, pushes it
+// to the recipients and the sender's other devices, then acknowledges it to the
+// sending connection with the server-assigned ID
+func (wc *WebSocketController) handleMessageSend(client *utils.Client, env *utils.Envelope) error {
+	var payload utils.MessageSendPayload
+	if err := env.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	message := models.Message{
+		Content:       payload.Content,
+		GroupID:       payload.GroupID,
+		AttachmentIDs: payload.AttachmentIDs,
+	}
+	if payload.ReceiverID != 0 {
+		message.ReceiverID = &payload.ReceiverID
+	}
+	if payload.ReplyToID != 0 {
+		message.ReplyToID = &payload.ReplyToID
+	}
+
+	if err := wc.Messages.Send(client.UserID, &message); err != nil {
+		return messageProtocolError(err)
+	}
+
+	client.SendEvent(utils.EventMessageAck, utils.MessageAckPayload{
+		RefID:     env.ID,
+		MessageID: message.ID,
+		Timestamp: message.Timestamp,
+	})
+
+	return wc.Messages.Publish(&message, client)
+}
+
+// handleTyping relays a typing indicator to the receiver or the group,
+// leaving out anyone who has a block with the typing user
+func (wc *WebSocketController) handleTyping(client *utils.Client, env *utils.Envelope) error {
+	var payload utils.TypingPayload
+	if err := env.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	typing := utils.TypingPayload{
+		UserID:  client.UserID,
+		GroupID: payload.GroupID,
+		Typing:  payload.Typing,
+	}
+
+	switch {
+	case payload.GroupID != 0:
+		if err := wc.Messages.checkGroupMember(payload.GroupID, client.UserID); err != nil {
+			return messageProtocolError(err)
+		}
+		memberIDs, err := groupMemberIDs(wc.DB, payload.GroupID)
+		if err != nil {
+			return err
+		}
+		if memberIDs, err = withoutBlocked(wc.DB, client.UserID, memberIDs); err != nil {
+			return err
+		}
+		data, err := utils.EncodeEvent(utils.EventTyping, typing)
+		if err != nil {
+			return err
+		}
+		wc.Hub.Broadcast(&utils.Delivery{UserIDs: memberIDs, Data: data, Except: client})
+	case payload.ReceiverID != 0:
+		blocked, err := isBlockedBetween(wc.DB, client.UserID, payload.ReceiverID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return messageProtocolError(ErrBlocked)
+		}
+		wc.Hub.SendEvent(utils.EventTyping, typing, payload.ReceiverID)
+	default:
+		return utils.NewProtocolError(utils.ErrCodeInvalidPayload, "receiver_id or group_id is required")
+	}
+	return nil
+}
+
+// handlePresence replies with the online status of the requested users.
+// Users on either side of a block always appear offline to each other.
+func (wc *WebSocketController) handlePresence(client *utils.Client, env *utils.Envelope) error {
+	var payload utils.PresencePayload
+	if err := env.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	related, err := blockRelations(wc.DB, client.UserID)
+	if err != nil {
+		return err
+	}
+
+	statuses := make([]utils.PresenceStatus, 0, len(payload.UserIDs))
+	for _, userID := range payload.UserIDs {
+		online := !related[userID] && wc.Hub.IsOnline(userID)
+		statuses = append(statuses, utils.PresenceStatus{UserID: userID, Online: online})
+	}
+
+	client.SendEvent(utils.EventPresence, statuses)
+	return nil
+}
+
+// handleReceipt records a delivery confirmation or a read receipt sent by
+// the receiver's client
+func (wc *WebSocketController) handleReceipt(client *utils.Client, env *utils.Envelope) error {
+	var payload utils.ReceiptPayload
+	if err := env.DecodePayload(&payload); err != nil {
+		return err
+	}
+	if payload.MessageID == 0 {
+		return utils.NewProtocolError(utils.ErrCodeInvalidPayload, "message_id is required")
+	}
+
+	switch payload.Status {
+	case utils.ReceiptDelivered:
+		if err := wc.Messages.MarkDelivered(client.UserID, payload.MessageID); err != nil {
+			return messageProtocolError(err)
+		}
+		return nil
+	case utils.ReceiptRead:
+		if err := wc.Messages.MarkReadMessage(client.UserID, payload.MessageID); err != nil {
+			return messageProtocolError(err)
+		}
+		return nil
+	default:
+		return utils.NewProtocolError(utils.ErrCodeInvalidPayload, fmt.Sprintf("unknown receipt status %q", payload.Status))
+	}
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/similadayo/chitchat/models"
+	"github/similadayo/chitchat/utils"
+	"testing"
+	"time"
+)
+
+func TestHandleAuth(t *testing.T) {
+	useTestKey(t)
+	db := newTestDB(t)
+	rs := newTestRevocationStore(db, time.Hour)
+	wc := NewWebSocketController(NewMessageService(db, rs.Hub), NewSessionService(rs))
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+
+	session := models.Session{ID: "phone", UserID: alice.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := db.Create(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+	client := utils.NewClient(nil, utils.RandomID(), alice.ID, alice.Username)
+	client.SessionID = session.ID
+	openedAt, openExpiry := time.Now().Add(-14*time.Minute).Truncate(time.Second), time.Now().Add(time.Minute).Truncate(time.Second)
+	client.SetToken(openedAt, openExpiry)
+	rs.Hub.Register(client)
+
+	auth := func(token string) error {
+		var env utils.Envelope
+		frame := fmt.Sprintf(`{"v":1,"type":"auth","id":"r1","payload":{"token":%q}}`, token)
+		if err := json.Unmarshal([]byte(frame), &env); err != nil {
+			t.Fatal(err)
+		}
+		return wc.handleAuth(client, &env)
+	}
+	token := func(user models.User, sessionID string, ttl time.Duration) string {
+		token, err := utils.GenerateJwt(user.ID, user.Username, sessionID, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	wantCode := func(err error, code string) {
+		t.Helper()
+		var perr *utils.ProtocolError
+		if !errors.As(err, &perr) || perr.Code != code {
+			t.Errorf("got %v, want a %s error", err, code)
+		}
+		if _, expiresAt := client.TokenTimes(); !expiresAt.Equal(openExpiry) {
+			t.Errorf("a rejected token moved the expiry to %v", expiresAt)
+		}
+	}
+
+	wantCode(auth("garbage"), utils.ErrCodeUnauthorized)
+	wantCode(auth(token(alice, session.ID, -time.Minute)), utils.ErrCodeUnauthorized)
+	wantCode(auth(token(alice, "laptop", time.Hour)), utils.ErrCodeForbidden)
+	wantCode(auth(token(bob, session.ID, time.Hour)), utils.ErrCodeForbidden)
+
+	if err := auth(token(alice, session.ID, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	issuedAt, expiresAt := client.TokenTimes()
+	if !issuedAt.After(openedAt) || expiresAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("token times are %v to %v, want the new token's", issuedAt, expiresAt)
+	}
+	select {
+	case data := <-client.Send:
+		var env utils.Envelope
+		var ack utils.AuthAckPayload
+		if err := json.Unmarshal(data, &env); err != nil || env.DecodePayload(&ack) != nil {
+			t.Fatalf("bad ack %s", data)
+		}
+		if env.Type != utils.EventAuthAck || ack.RefID != "r1" || !ack.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("got %s %+v, want an ack of r1 until %v", env.Type, ack, expiresAt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ack was sent")
+	}
+
+	// Once the session is logged out its tokens can't extend the socket
+	fresh := token(alice, session.ID, time.Hour)
+	if err := rs.RevokeSession(alice.ID, session.ID); err != nil {
+		t.Fatal(err)
+	}
+	var perr *utils.ProtocolError
+	if err := auth(fresh); !errors.As(err, &perr) || perr.Code != utils.ErrCodeUnauthorized {
+		t.Errorf("token of a revoked session = %v, want unauthorized", err)
+	}
+}
@@ -1,46 +1,55 @@
 package middlewares
 
 import (
-	"fmt"
 	"github/similadayo/chitchat/utils"
 	"net/http"
 	"strings"
 )
 
-// AuthMiddleware is a middleware that checks if the user is authenticated
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
+// AuthMiddleware returns a middleware that checks if the user is
+// authenticated with a token whose session hasn't been revoked, and keeps
+// the session's last-seen time up to date
+func AuthMiddleware(sessions utils.SessionChecker) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
 
-		// Check if the Authorization header is empty
-		if authHeader == "" {
-			http.Error(w, "Authorization header is required", http.StatusUnauthorized)
-			return
-		}
+			// Check if the Authorization header is empty
+			if authHeader == "" {
+				http.Error(w, "Authorization header is required", http.StatusUnauthorized)
+				return
+			}
 
-		// Extract the token from the Authorization header
-		tokenStrings := strings.Split(authHeader, " ")
-		if len(tokenStrings) < 2 || tokenStrings[1] == "" {
-			http.Error(w, "Invalid token format", http.StatusUnauthorized)
-			return
-		}
-		tokenString := tokenStrings[1]
+			// Extract the token from the Authorization header
+			tokenStrings := strings.Split(authHeader, " ")
+			if len(tokenStrings) < 2 || tokenStrings[1] == "" {
+				http.Error(w, "Invalid token format", http.StatusUnauthorized)
+				return
+			}
+			tokenString := tokenStrings[1]
 
-		// Parse the JWT token
-		claims, err := utils.ParseJwt(tokenString)
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
+			// Parse the JWT token
+			claims, err := utils.ParseJwt(tokenString)
+			if err != nil {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
 
-		// Set the username in the request context
-		r = r.WithContext(utils.SetUserInContext(r.Context(), claims.Username))
+			// Reject tokens of sessions that were logged out
+			if sessions.IsRevoked(claims) {
+				http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+				return
+			}
+			sessions.Touch(claims)
 
-		fmt.Println("User is authenticated:", claims.Username)
+			// Set the username and the token's claims in the request context
+			ctx := utils.SetUserInContext(r.Context(), claims.Username)
+			r = r.WithContext(utils.SetClaimsInContext(ctx, claims))
 
-		// Proceed to the next middleware or handler
-		next.ServeHTTP(w, r)
-	})
+			// Proceed to the next middleware or handler
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
 // CorsMiddleware is a middleware that adds CORS headers to the response
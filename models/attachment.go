@@ -0,0 +1,83 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// What an attachment was uploaded for
+const (
+	AttachmentMessage = "message"
+	AttachmentAvatar  = "avatar"
+)
+
+// Processing states of uploaded images; other files are never processed
+const (
+	MediaPending = "pending"
+	MediaReady   = "ready"
+	MediaFailed  = "failed"
+)
+
+// Attachment is an uploaded file. Its bytes live in storage under Key, the
+// SHA-256 of the content, so identical uploads share one object. Message
+// attachments are linked to their message once it is sent.
+type Attachment struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Key         string    `json:"-" gorm:"size:128;not null;index"`
+	UploaderID  uint      `json:"uploader_id" gorm:"not null;index"`
+	MessageID   *uint     `json:"message_id" gorm:"index"`
+	Purpose     string    `json:"purpose" gorm:"size:16;not null;default:message"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type" gorm:"not null"`
+	Size        int64     `json:"size" gorm:"not null"`
+	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
+
+	// Filled in by the media workers for images
+	MediaStatus string              `json:"media_status,omitempty" gorm:"size:16;index"`
+	Width       int                 `json:"width,omitempty"`
+	Height      int                 `json:"height,omitempty"`
+	BlurHash    string              `json:"blurhash,omitempty" gorm:"size:64"`
+	Variants    []AttachmentVariant `json:"thumbnails,omitempty" gorm:"foreignKey:AttachmentID"`
+}
+
+// URL is where authenticated clients download the attachment
+func (a Attachment) URL() string {
+	return fmt.Sprintf("/attachments/%d", a.ID)
+}
+
+// MarshalJSON adds the download URL to the attachment
+func (a Attachment) MarshalJSON() ([]byte, error) {
+	type attachment Attachment
+	return json.Marshal(struct {
+		attachment
+		URL string `json:"url"`
+	}{attachment(a), a.URL()})
+}
+
+// AttachmentVariant is a thumbnail derived from an image attachment. Size is
+// the longest side it was scaled to fit.
+type AttachmentVariant struct {
+	ID           uint   `json:"-" gorm:"primaryKey"`
+	AttachmentID uint   `json:"-" gorm:"not null;uniqueIndex:idx_variant_size"`
+	Size         int    `json:"size" gorm:"not null;uniqueIndex:idx_variant_size"`
+	Key          string `json:"-" gorm:"size:140;not null"`
+	ContentType  string `json:"content_type" gorm:"not null"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Bytes        int64  `json:"bytes"`
+}
+
+// URL is where authenticated clients download the thumbnail
+func (v AttachmentVariant) URL() string {
+	return fmt.Sprintf("/attachments/%d/thumbnails/%d", v.AttachmentID, v.Size)
+}
+
+// MarshalJSON adds the download URL to the thumbnail
+func (v AttachmentVariant) MarshalJSON() ([]byte, error) {
+	type variant AttachmentVariant
+	return json.Marshal(struct {
+		variant
+		URL string `json:"url"`
+	}{variant(v), v.URL()})
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// UserBlock records that the blocker doesn't want to hear from the blocked
+// user. Blocks are one-way, but either side of one stops direct messaging.
+type UserBlock struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	BlockerID uint      `json:"blocker_id" gorm:"not null;uniqueIndex:idx_user_block"`
+	BlockedID uint      `json:"blocked_id" gorm:"not null;uniqueIndex:idx_user_block;index"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// ConversationSetting holds a user's preferences for one conversation. Like
+// ReadWatermark, direct conversations set PeerID and groups set GroupID.
+type ConversationSetting struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	UserID    uint      `json:"-" gorm:"not null;uniqueIndex:idx_conversation_setting"`
+	PeerID    uint      `json:"-" gorm:"not null;default:0;uniqueIndex:idx_conversation_setting"`
+	GroupID   uint      `json:"-" gorm:"not null;default:0;uniqueIndex:idx_conversation_setting"`
+	Muted     bool      `json:"muted" gorm:"default:false"`
+	Pinned    bool      `json:"pinned" gorm:"default:false"`
+	Archived  bool      `json:"archived" gorm:"default:false"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Roles a member can hold in a group
+const (
+	RoleOwner    = "owner"
+	RoleAdmin    = "admin"
+	RoleMember   = "member"
+	RoleReadOnly = "readonly"
+)
+
+// Group is a conversation between several users
+type Group struct {
+	gorm.Model
+	Name      string `json:"name" gorm:"not null"`
+	AvatarURL string `json:"avatar_url"`
+	OwnerID   uint   `json:"owner_id" gorm:"not null"`
+
+	// AnnouncementOnly restricts posting to the owner and admins
+	AnnouncementOnly bool  `json:"announcement_only" gorm:"default:false"`
+	PinnedMessageID  *uint `json:"pinned_message_id"`
+
+	Members []GroupMember `json:"members,omitempty"`
+}
+
+// GroupMember links a user to a group they belong to
+type GroupMember struct {
+	ID       uint      `json:"id" gorm:"primaryKey"`
+	GroupID  uint      `json:"group_id" gorm:"not null;uniqueIndex:idx_group_user"`
+	UserID   uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_group_user;index"`
+	Role     string    `json:"role" gorm:"not null;default:member"`
+	JoinedAt time.Time `json:"joined_at" gorm:"not null"`
+
+	User User `json:"user" gorm:"foreignKey:UserID"`
+}
+
+// GroupAuditLog records role changes made in a group
+type GroupAuditLog struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	GroupID      uint      `json:"group_id" gorm:"not null;index"`
+	ActorID      uint      `json:"actor_id" gorm:"not null"`
+	TargetUserID uint      `json:"target_user_id" gorm:"not null"`
+	Action       string    `json:"action" gorm:"not null"`
+	OldRole      string    `json:"old_role"`
+	NewRole      string    `json:"new_role"`
+	CreatedAt    time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
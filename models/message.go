@@ -9,16 +9,37 @@ import (
 type Message struct {
 	gorm.Model
 	Content     string    `json:"content" gorm:"not null"`
-	ImageURL    string    `json:"image_url"`
+	ImageURL    string    `json:"image_url"` // legacy; new messages use Attachments
 	IsDelivered bool      `json:"is_delivered" gorm:"default:false"`
 	IsRead      bool      `json:"is_read" gorm:"default:false"`
 	IsEdited    bool      `json:"is_edited" gorm:"default:false"`
 	IsDeleted   bool      `json:"is_deleted" gorm:"default:false"`
+	IsSystem    bool      `json:"is_system" gorm:"default:false"`
 	SenderID    uint      `json:"sender_id" gorm:"not null"`
-	ReceiverID  uint      `json:"receiver_id" gorm:"not null"`
-	GroupID     uint      `json:"group_id"`
+	ReceiverID  *uint     `json:"receiver_id"` // nil for group messages
+	GroupID     uint      `json:"group_id" gorm:"index"`
 	Timestamp   time.Time `json:"timestamp" gorm:"not null"`
 
-	Sender   User `gorm:"foreignKey:SenderID"`
-	Receiver User `gorm:"foreignKey:ReceiverID"`
+	// ReplyToID is the message this one answers and ThreadRootID the first
+	// message of that thread; both are nil outside threads
+	ReplyToID    *uint `json:"reply_to_id" gorm:"index"`
+	ThreadRootID *uint `json:"thread_root_id" gorm:"index"`
+
+	Sender      User         `gorm:"foreignKey:SenderID"`
+	Receiver    User         `gorm:"foreignKey:ReceiverID"`
+	Attachments []Attachment `json:"attachments,omitempty" gorm:"foreignKey:MessageID"`
+
+	// AttachmentIDs lists uploads to link when the message is sent
+	AttachmentIDs []uint `json:"attachment_ids,omitempty" gorm:"-"`
+
+	// Thread is filled in on thread roots and Reactions on every message
+	// when messages are listed
+	Thread    *ThreadSummary  `json:"thread,omitempty" gorm:"-"`
+	Reactions []ReactionCount `json:"reactions,omitempty" gorm:"-"`
+}
+
+// ThreadSummary describes the replies to a thread root
+type ThreadSummary struct {
+	ReplyCount int64    `json:"reply_count"`
+	LastReply  *Message `json:"last_reply,omitempty"`
 }
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Reaction is an emoji a user put on a message. A user can add several
+// different emojis to the same message, but each only once.
+type Reaction struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	MessageID uint      `json:"message_id" gorm:"not null;uniqueIndex:idx_reaction"`
+	UserID    uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_reaction"`
+	Emoji     string    `json:"emoji" gorm:"size:64;not null;uniqueIndex:idx_reaction"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+}
+
+// ReactionCount is the number of users who reacted to a message with an
+// emoji; Me tells whether the current user is one of them
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int64  `json:"count"`
+	Me    bool   `json:"me"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// ReadWatermark is the last message a user has read in a conversation. For
+// direct conversations PeerID is the other user and GroupID is 0; for groups
+// PeerID is 0.
+type ReadWatermark struct {
+	ID                uint      `json:"id" gorm:"primaryKey"`
+	UserID            uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_read_watermark"`
+	PeerID            uint      `json:"peer_id" gorm:"not null;default:0;uniqueIndex:idx_read_watermark"`
+	GroupID           uint      `json:"group_id" gorm:"not null;default:0;uniqueIndex:idx_read_watermark"`
+	LastReadMessageID uint      `json:"last_read_message_id" gorm:"not null"`
+	UpdatedAt         time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// RefreshToken lets a login session get new access tokens. Each one works
+// once: refreshing marks it used and issues the next token of the session,
+// so a session's refresh tokens form a family. Only a hash is stored.
+type RefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	SessionID string     `json:"session_id" gorm:"size:64;not null;index"`
+	TokenHash string     `json:"-" gorm:"size:64;not null;uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// MessageRevision keeps the content a message had before an edit
+type MessageRevision struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	MessageID uint      `json:"message_id" gorm:"not null;index"`
+	EditorID  uint      `json:"editor_id" gorm:"not null"`
+	Content   string    `json:"content" gorm:"not null"`
+	EditedAt  time.Time `json:"edited_at" gorm:"not null"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Revocation kinds
+const (
+	// RevokeSession invalidates every token of one login session
+	RevokeSession = "session"
+	// RevokeUser invalidates every token the user was issued up to RevokedAt
+	RevokeUser = "user"
+)
+
+// TokenRevocation invalidates tokens before they expire. Subject is the
+// session ID or the user ID, depending on the kind. A row is only needed
+// until the last token it covers has expired.
+type TokenRevocation struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Kind      string    `json:"kind" gorm:"size:16;not null;uniqueIndex:idx_token_revocation"`
+	Subject   string    `json:"subject" gorm:"size:64;not null;uniqueIndex:idx_token_revocation"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Session is one login of a user on a device. Its ID is embedded in every
+// token issued for it, so revoking the session logs the device out.
+type Session struct {
+	ID         string     `json:"id" gorm:"primaryKey;size:64"`
+	UserID     uint       `json:"-" gorm:"not null;index"`
+	DeviceName string     `json:"device_name" gorm:"size:100"`
+	UserAgent  string     `json:"user_agent" gorm:"size:255"`
+	IP         string     `json:"ip" gorm:"size:45"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"index"`
+	RevokedAt  *time.Time `json:"-"`
+
+	// Current marks the session of the token the list was requested with
+	Current bool `json:"current" gorm:"-"`
+}
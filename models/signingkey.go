@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// SigningKey is a key JWT tokens are signed with, named by Kid in their
+// header. The newest key whose ActivatesAt has passed signs new tokens;
+// every key that isn't retired verifies them and is published in the JWKS,
+// so verifiers can fetch a key before it starts signing.
+type SigningKey struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Kid         string     `json:"kid" gorm:"size:64;not null;uniqueIndex"`
+	Algorithm   string     `json:"algorithm" gorm:"size:16;not null"`
+	PrivateKey  string     `json:"-" gorm:"type:text;not null"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	ActivatesAt time.Time  `json:"activates_at" gorm:"index"`
+	RetiredAt   *time.Time `json:"retired_at"`
+}
@@ -17,6 +17,11 @@ type User struct {
 	DateOfBirth time.Time `json:"date_of_birth"`
 	ProfilePic  string    `json:"profile_pic"`
 	IsActive    bool      `json:"is_active" gorm:"default:true"`
+	IsModerator bool      `json:"is_moderator" gorm:"default:false"`
 	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
 	UpdatedAt   time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+
+	// Avatar is the uploaded profile picture behind ProfilePic
+	AvatarID *uint       `json:"-"`
+	Avatar   *Attachment `json:"avatar,omitempty" gorm:"foreignKey:AvatarID;constraint:OnDelete:SET NULL"`
 }
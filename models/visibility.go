@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// HiddenMessage hides a message from a single user ("delete for me")
+type HiddenMessage struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	MessageID uint      `json:"message_id" gorm:"not null;uniqueIndex:idx_hidden_message_user"`
+	UserID    uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_hidden_message_user"`
+	HiddenAt  time.Time `json:"hidden_at" gorm:"not null"`
+}
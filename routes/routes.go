@@ -1,26 +1,68 @@
 package routes
 
 import (
+	"github/similadayo/chitchat/config"
 	"github/similadayo/chitchat/controller"
 	"github/similadayo/chitchat/middlewares"
+	"github/similadayo/chitchat/utils"
 
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
-func InitRoutes() *mux.Router {
+// InitRoutes wires the controllers to the migrated database, which they
+// all share
+func InitRoutes(db *gorm.DB) *mux.Router {
 	router := mux.NewRouter()
 
+	// The hub routes frames between the connected websocket clients
+	hub := utils.NewHub(config.LoadWebSocketConfig())
+	go hub.Run()
+
+	// Messages are sent and published the same way from REST, groups and
+	// the websocket, so a single service backs all three
+	messages := controller.NewMessageService(db, hub)
+	index, err := controller.NewSearchIndex(db)
+	if err != nil {
+		panic(err)
+	}
+	messages.Index = index
+
+	// Uploads are shared by the user and attachment controllers, and
+	// uploaded images are processed in the background
+	attachments := controller.NewAttachmentService(db, hub)
+	attachments.Media.Start()
+
+	// Tokens are signed and verified with the keys in the database, which
+	// are reloaded to pick up rotations
+	keys := controller.NewKeyStore(db)
+	keys.Start()
+
+	// Sessions are checked on every request and websocket handshake, and
+	// logging one out closes its websocket connections
+	revocations := controller.NewRevocationStore(db, hub)
+	revocations.Start()
+	sessions := controller.NewSessionService(revocations)
+	tokens := controller.NewTokenService(revocations)
+
 	// Creates new user controller
-	userController := controller.NewUserController()
-	messageController := controller.NewMessageController()
+	userController := controller.NewUserController(db, attachments, sessions, tokens)
+	messageController := controller.NewMessageController(messages)
+	webSocketController := controller.NewWebSocketController(messages, sessions)
+	groupController := controller.NewGroupController(messages)
+	attachmentController := controller.NewAttachmentController(attachments)
+	keyController := controller.NewKeyController(keys)
 
 	// Add routes here
 	router.HandleFunc("/register", userController.RegisterUser).Methods("POST")
 	router.HandleFunc("/login", userController.LoginUser).Methods("POST")
+	router.HandleFunc("/token/refresh", userController.RefreshToken).Methods("POST")
+	router.HandleFunc("/files/{id}", attachmentController.GetSignedFile).Methods("GET", "HEAD")
+	router.HandleFunc("/.well-known/jwks.json", keyController.GetJWKS).Methods("GET")
 
 	// protected user routes
 	protected := router.PathPrefix("/").Subrouter()
-	protected.Use(middlewares.AuthMiddleware)
+	protected.Use(middlewares.AuthMiddleware(sessions))
 	protected.HandleFunc("/users", userController.GetAllUsers).Methods("GET")
 	protected.HandleFunc("/user", userController.GetUserProfile).Methods("GET")
 	protected.HandleFunc("/users/{username}", userController.GetUserByUserName).Methods("GET")
@@ -28,14 +70,48 @@ func InitRoutes() *mux.Router {
 	protected.HandleFunc("/user/delete", userController.DeleteUserProfile).Methods("DELETE")
 	protected.HandleFunc("/block/{username}", userController.BlockUser).Methods("POST")
 	protected.HandleFunc("/unblock/{username}", userController.UnblockUser).Methods("POST")
+	protected.HandleFunc("/blocks", userController.GetBlockedUsers).Methods("GET")
 	protected.HandleFunc("/logout", userController.Logout).Methods("POST")
+	protected.HandleFunc("/logout/all", userController.LogoutAll).Methods("POST")
+	protected.HandleFunc("/sessions", userController.GetSessions).Methods("GET")
+	protected.HandleFunc("/sessions/{id}", userController.RevokeSession).Methods("DELETE")
 
 	//protected message routes
 	protected.HandleFunc("/sendmessage", messageController.SendMessage).Methods("POST")
 	protected.HandleFunc("/getmessage", messageController.GetMessages).Methods("GET")
+	protected.HandleFunc("/messages/{id}", messageController.EditMessage).Methods("PUT")
+	protected.HandleFunc("/messages/{id}", messageController.DeleteMessage).Methods("DELETE")
+	protected.HandleFunc("/messages/{id}/revisions", messageController.GetMessageRevisions).Methods("GET")
+	protected.HandleFunc("/messages/{id}/thread", messageController.GetMessageThread).Methods("GET")
+	protected.HandleFunc("/messages/{id}/reactions/{emoji}", messageController.AddReaction).Methods("PUT")
+	protected.HandleFunc("/messages/{id}/reactions/{emoji}", messageController.RemoveReaction).Methods("DELETE")
+	protected.HandleFunc("/messages/{id}/receipts", messageController.GetMessageReceipts).Methods("GET")
+	protected.HandleFunc("/search/messages", messageController.SearchMessages).Methods("GET")
+	protected.HandleFunc("/conversations", messageController.GetConversations).Methods("GET")
+	protected.HandleFunc("/conversations/{peer}/messages", messageController.GetConversationMessages).Methods("GET")
+	protected.HandleFunc("/conversations/{id}/read", messageController.MarkConversationRead).Methods("POST")
+	protected.HandleFunc("/conversations/{id}/settings", messageController.UpdateConversationSettings).Methods("PUT")
+
+	//protected attachment routes
+	protected.HandleFunc("/attachments", attachmentController.UploadAttachment).Methods("POST")
+	protected.HandleFunc("/attachments/{id}", attachmentController.GetAttachment).Methods("GET", "HEAD")
+	protected.HandleFunc("/attachments/{id}/link", attachmentController.GetAttachmentLink).Methods("GET")
+	protected.HandleFunc("/attachments/{id}/thumbnails/{size}", attachmentController.GetThumbnail).Methods("GET", "HEAD")
+
+	//protected group routes
+	protected.HandleFunc("/groups", groupController.CreateGroup).Methods("POST")
+	protected.HandleFunc("/groups", groupController.GetGroups).Methods("GET")
+	protected.HandleFunc("/groups/{id}", groupController.GetGroup).Methods("GET")
+	protected.HandleFunc("/groups/{id}", groupController.UpdateGroup).Methods("PUT")
+	protected.HandleFunc("/groups/{id}/members", groupController.AddMember).Methods("POST")
+	protected.HandleFunc("/groups/{id}/members/{userID}", groupController.RemoveMember).Methods("DELETE")
+	protected.HandleFunc("/groups/{id}/members/{userID}/role", groupController.ChangeRole).Methods("PUT")
+	protected.HandleFunc("/groups/{id}/audit", groupController.GetAuditLog).Methods("GET")
+	protected.HandleFunc("/groups/{id}/pin", groupController.PinMessage).Methods("PUT")
+	protected.HandleFunc("/groups/{id}/leave", groupController.LeaveGroup).Methods("POST")
 
 	//websocket
-	router.HandleFunc("/ws", controller.WebSocketHandler).Methods("GET")
+	router.HandleFunc("/ws", webSocketController.WebSocketHandler).Methods("GET")
 	return router
 
 }
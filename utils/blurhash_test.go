@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestBlurHash(t *testing.T) {
+	solid := func(c color.NRGBA) *image.NRGBA {
+		img := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+		for y := 0; y < 6; y++ {
+			for x := 0; x < 8; x++ {
+				img.SetNRGBA(x, y, c)
+			}
+		}
+		return img
+	}
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+		// wantDC is the average colour, which a flat image keeps exactly
+		wantDC int
+	}{
+		{"solid colour", solid(color.NRGBA{0xFF, 0x80, 0x00, 0xFF}), 0xFF8000},
+		{"transparent shows white", solid(color.NRGBA{0x12, 0x34, 0x56, 0x00}), 0xFFFFFF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := BlurHash(tt.img, 4, 3)
+			if len(hash) != 4+2*4*3 {
+				t.Fatalf("hash %q has length %d", hash, len(hash))
+			}
+			// The first character encodes the 4x3 components
+			if hash[0] != 'L' || hash[2:6] != encodeBase83(tt.wantDC, 4) {
+				t.Errorf("hash %q, want components L and colour %s", hash, encodeBase83(tt.wantDC, 4))
+			}
+		})
+	}
+
+	if hash := BlurHash(image.NewNRGBA(image.Rect(0, 0, 0, 0)), 4, 3); hash != "" {
+		t.Errorf("empty image hashed to %q", hash)
+	}
+
+	t.Run("gradient", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 16, 4))
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 16; x++ {
+				img.SetNRGBA(x, y, color.NRGBA{uint8(x * 16), uint8(x * 16), uint8(x * 16), 0xFF})
+			}
+		}
+		for _, size := range [][2]int{{1, 1}, {4, 3}, {9, 9}} {
+			hash := BlurHash(img, size[0], size[1])
+			if want := 4 + 2*size[0]*size[1]; len(hash) != want {
+				t.Errorf("%dx%d hash %q has length %d, want %d", size[0], size[1], hash, len(hash), want)
+			}
+		}
+		// The brightness changes left to right, so it carries more AC
+		// energy than a flat image
+		hash, flat := BlurHash(img, 4, 3), BlurHash(solid(color.NRGBA{0x80, 0x80, 0x80, 0xFF}), 4, 3)
+		if strings.IndexByte(base83Chars, hash[1]) <= strings.IndexByte(base83Chars, flat[1]) {
+			t.Errorf("gradient hash %q has no more AC energy than flat %q", hash, flat)
+		}
+	})
+}
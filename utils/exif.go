@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// EXIF tags and the sizes of TIFF field types
+const (
+	tagOrientation = 0x0112
+	tagGPSInfo     = 0x8825
+
+	// maxExifSize bounds the metadata read into memory; a JPEG segment
+	// can't be larger anyway
+	maxExifSize = 1 << 20
+)
+
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// exifBlock locates a TIFF structure holding EXIF data inside an image file.
+// crcOffset is set for PNG chunks, whose CRC must follow their data.
+type exifBlock struct {
+	offset, length int64
+	crcOffset      int64
+}
+
+// exifBlocks finds the EXIF data of a JPEG (APP1 segments) or PNG (eXIf
+// chunks). Only the headers are read.
+func exifBlocks(r io.ReaderAt, contentType string) []exifBlock {
+	switch contentType {
+	case "image/jpeg":
+		return jpegExifBlocks(r)
+	case "image/png":
+		return pngExifBlocks(r)
+	}
+	return nil
+}
+
+func jpegExifBlocks(r io.ReaderAt) []exifBlock {
+	var blocks []exifBlock
+	header := make([]byte, 10)
+	for offset := int64(2); ; {
+		if _, err := r.ReadAt(header[:4], offset); err != nil || header[0] != 0xFF {
+			return blocks
+		}
+		marker := header[1]
+		// Start of scan: the metadata segments are all behind us
+		if marker == 0xDA || marker == 0xD9 {
+			return blocks
+		}
+		length := int64(binary.BigEndian.Uint16(header[2:4]))
+		if length < 2 {
+			return blocks
+		}
+		if marker == 0xE1 && length >= 8 {
+			if _, err := r.ReadAt(header[4:10], offset+4); err == nil && bytes.Equal(header[4:10], []byte("Exif\x00\x00")) {
+				blocks = append(blocks, exifBlock{offset: offset + 10, length: length - 8})
+			}
+		}
+		offset += 2 + length
+	}
+}
+
+func pngExifBlocks(r io.ReaderAt) []exifBlock {
+	var blocks []exifBlock
+	header := make([]byte, 8)
+	for offset := int64(8); ; {
+		if _, err := r.ReadAt(header, offset); err != nil {
+			return blocks
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:8]) {
+		case "eXIf":
+			blocks = append(blocks, exifBlock{offset: offset + 8, length: length, crcOffset: offset + 8 + length})
+		case "IEND":
+			return blocks
+		}
+		offset += 12 + length
+	}
+}
+
+// tiff is an EXIF block read into memory
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func readTIFF(r io.ReaderAt, block exifBlock) (*tiff, bool) {
+	if block.length < 8 || block.length > maxExifSize {
+		return nil, false
+	}
+	data := make([]byte, block.length)
+	if _, err := r.ReadAt(data, block.offset); err != nil {
+		return nil, false
+	}
+
+	t := &tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, false
+	}
+	return t, true
+}
+
+// entry finds a tag in the IFD at offset and returns the position of its
+// 12-byte entry
+func (t *tiff) entry(ifd uint32, tag uint16) (uint32, bool) {
+	if uint64(ifd)+2 > uint64(len(t.data)) {
+		return 0, false
+	}
+	count := uint32(t.order.Uint16(t.data[ifd:]))
+	for i := uint32(0); i < count; i++ {
+		at := ifd + 2 + i*12
+		if uint64(at)+12 > uint64(len(t.data)) {
+			return 0, false
+		}
+		if t.order.Uint16(t.data[at:]) == tag {
+			return at, true
+		}
+	}
+	return 0, false
+}
+
+func (t *tiff) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:])
+}
+
+// clearIFD zeroes an IFD and the values its entries point to, leaving an
+// empty directory behind
+func (t *tiff) clearIFD(ifd uint32) {
+	if uint64(ifd)+2 > uint64(len(t.data)) {
+		return
+	}
+	count := uint32(t.order.Uint16(t.data[ifd:]))
+	end := uint64(ifd) + 2 + uint64(count)*12 + 4
+	if end > uint64(len(t.data)) {
+		end = uint64(len(t.data))
+	}
+
+	for i := uint32(0); i < count; i++ {
+		at := ifd + 2 + i*12
+		if uint64(at)+12 > end {
+			break
+		}
+		size := uint64(tiffTypeSizes[t.order.Uint16(t.data[at+2:])]) * uint64(t.order.Uint32(t.data[at+4:]))
+		if size <= 4 {
+			continue
+		}
+		value := uint64(t.order.Uint32(t.data[at+8:]))
+		if value+size <= uint64(len(t.data)) {
+			clear(t.data[value : value+size])
+		}
+	}
+	clear(t.data[ifd:end])
+}
+
+// ScrubGPS erases the GPS location from the EXIF data of a JPEG or PNG in
+// place. The file keeps its size and the rest of its metadata, so the
+// orientation survives. It reports whether anything was erased.
+func ScrubGPS(f interface {
+	io.ReaderAt
+	io.WriterAt
+}, contentType string) (bool, error) {
+	scrubbed := false
+	for _, block := range exifBlocks(f, contentType) {
+		t, ok := readTIFF(f, block)
+		if !ok {
+			continue
+		}
+		at, ok := t.entry(t.firstIFD(), tagGPSInfo)
+		if !ok {
+			continue
+		}
+
+		// The pointer stays valid, it now leads to an empty directory
+		t.clearIFD(t.order.Uint32(t.data[at+8:]))
+
+		if _, err := f.WriteAt(t.data, block.offset); err != nil {
+			return scrubbed, err
+		}
+		if block.crcOffset != 0 {
+			crc := crc32.NewIEEE()
+			crc.Write([]byte("eXIf"))
+			crc.Write(t.data)
+			var sum [4]byte
+			binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+			if _, err := f.WriteAt(sum[:], block.crcOffset); err != nil {
+				return scrubbed, err
+			}
+		}
+		scrubbed = true
+	}
+	return scrubbed, nil
+}
+
+// ImageOrientation returns the EXIF orientation (1 to 8) of a JPEG or PNG,
+// or 1 when it has none
+func ImageOrientation(r io.ReaderAt, contentType string) int {
+	for _, block := range exifBlocks(r, contentType) {
+		t, ok := readTIFF(r, block)
+		if !ok {
+			continue
+		}
+		if at, ok := t.entry(t.firstIFD(), tagOrientation); ok {
+			if o := int(t.order.Uint16(t.data[at+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
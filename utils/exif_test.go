@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+// memFile is an image file held in memory
+type memFile []byte
+
+func (f memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f memFile) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(f)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(f[off:], p), nil
+}
+
+// Where testTIFF puts the GPS directory and the latitude it points to
+const (
+	testGPSIFD      = 38
+	testGPSLatitude = 68
+)
+
+// testTIFF builds EXIF data with orientation 6 and a GPS directory holding
+// a latitude, stored after the directory as the TIFF format requires for
+// values over 4 bytes
+func testTIFF(order binary.ByteOrder) []byte {
+	data := make([]byte, testGPSLatitude+24)
+	if order == binary.LittleEndian {
+		copy(data, "II")
+	} else {
+		copy(data, "MM")
+	}
+	order.PutUint16(data[2:], 42)
+	order.PutUint32(data[4:], 8)
+
+	entry := func(at int, tag, typ uint16, count, value uint32) {
+		order.PutUint16(data[at:], tag)
+		order.PutUint16(data[at+2:], typ)
+		order.PutUint32(data[at+4:], count)
+		order.PutUint32(data[at+8:], value)
+	}
+	order.PutUint16(data[8:], 2)
+	entry(10, tagOrientation, 3, 1, 0)
+	order.PutUint16(data[18:], 6)
+	entry(22, tagGPSInfo, 4, 1, testGPSIFD)
+
+	order.PutUint16(data[testGPSIFD:], 2)
+	// GPSLatitudeRef "N" fits in the entry, GPSLatitude doesn't
+	entry(testGPSIFD+2, 1, 2, 2, 0)
+	copy(data[testGPSIFD+10:], "N")
+	entry(testGPSIFD+14, 2, 5, 3, testGPSLatitude)
+	for i := 0; i < 6; i++ {
+		order.PutUint32(data[testGPSLatitude+4*i:], uint32(51+i))
+	}
+	return data
+}
+
+// testJPEG wraps EXIF data in an APP1 segment between other segments
+func testJPEG(exif []byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	b.Write([]byte{0xFF, 0xE0, 0x00, 0x04, 0x00, 0x00})
+	b.Write([]byte{0xFF, 0xE1})
+	binary.Write(&b, binary.BigEndian, uint16(8+len(exif)))
+	b.WriteString("Exif\x00\x00")
+	b.Write(exif)
+	b.Write([]byte{0xFF, 0xDA, 0x00, 0x02, 0x12, 0x34, 0xFF, 0xD9})
+	return b.Bytes()
+}
+
+// testPNG wraps EXIF data in an eXIf chunk after the header
+func testPNG(exif []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+	chunk := func(typ string, data []byte) {
+		binary.Write(&b, binary.BigEndian, uint32(len(data)))
+		b.WriteString(typ)
+		b.Write(data)
+		binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+	}
+	chunk("IHDR", make([]byte, 13))
+	chunk("eXIf", exif)
+	chunk("IEND", nil)
+	return b.Bytes()
+}
+
+func TestScrubGPS(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		file        []byte
+		exifAt      int
+	}{
+		{"jpeg little endian", "image/jpeg", testJPEG(testTIFF(binary.LittleEndian)), 18},
+		{"jpeg big endian", "image/jpeg", testJPEG(testTIFF(binary.BigEndian)), 18},
+		{"png", "image/png", testPNG(testTIFF(binary.BigEndian)), 41},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := memFile(bytes.Clone(tt.file))
+			scrubbed, err := ScrubGPS(f, tt.contentType)
+			if err != nil || !scrubbed {
+				t.Fatalf("ScrubGPS = %v, %v; want true", scrubbed, err)
+			}
+			if len(f) != len(tt.file) {
+				t.Fatalf("file changed size from %d to %d", len(tt.file), len(f))
+			}
+
+			exif := f[tt.exifAt : tt.exifAt+testGPSLatitude+24]
+			if !bytes.Equal(exif[:testGPSIFD], tt.file[tt.exifAt:tt.exifAt+testGPSIFD]) {
+				t.Error("the main directory changed")
+			}
+			if rest := exif[testGPSIFD:]; !bytes.Equal(rest, make([]byte, len(rest))) {
+				t.Errorf("GPS data left behind: % x", rest)
+			}
+			if o := ImageOrientation(f, tt.contentType); o != 6 {
+				t.Errorf("orientation = %d, want 6", o)
+			}
+
+			if tt.contentType == "image/png" {
+				crcAt := tt.exifAt + len(exif)
+				want := crc32.ChecksumIEEE(append([]byte("eXIf"), exif...))
+				if got := binary.BigEndian.Uint32(f[crcAt:]); got != want {
+					t.Errorf("eXIf CRC = %08x, want %08x", got, want)
+				}
+			}
+
+			// A second pass finds an empty GPS directory to clear
+			before := bytes.Clone(f)
+			if _, err := ScrubGPS(f, tt.contentType); err != nil || !bytes.Equal(f, before) {
+				t.Errorf("scrubbing again changed the file or failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestScrubGPSMalformed(t *testing.T) {
+	noGPS := testTIFF(binary.LittleEndian)
+	// Drop the GPS entry from the main directory
+	binary.LittleEndian.PutUint16(noGPS[8:], 1)
+
+	badOrder := testTIFF(binary.LittleEndian)
+	copy(badOrder, "XX")
+
+	gpsOutside := testTIFF(binary.LittleEndian)
+	binary.LittleEndian.PutUint32(gpsOutside[30:], 1<<31)
+
+	valueOutside := testTIFF(binary.LittleEndian)
+	binary.LittleEndian.PutUint32(valueOutside[testGPSIFD+22:], 1<<31)
+
+	hugeCount := testTIFF(binary.LittleEndian)
+	binary.LittleEndian.PutUint16(hugeCount[testGPSIFD:], 0xFFFF)
+
+	ifdOutside := testTIFF(binary.LittleEndian)
+	binary.LittleEndian.PutUint32(ifdOutside[4:], 1<<31)
+
+	jpeg := testJPEG(testTIFF(binary.LittleEndian))
+	png := testPNG(testTIFF(binary.LittleEndian))
+
+	tests := []struct {
+		name        string
+		contentType string
+		file        []byte
+		// wantScrub is set when the GPS pointer is valid, even if what
+		// it points to isn't
+		wantScrub bool
+	}{
+		{"no gps", "image/jpeg", testJPEG(noGPS), false},
+		{"not tiff", "image/jpeg", testJPEG(badOrder), false},
+		{"first directory outside", "image/jpeg", testJPEG(ifdOutside), false},
+		{"gps directory outside", "image/jpeg", testJPEG(gpsOutside), true},
+		{"gps value outside", "image/jpeg", testJPEG(valueOutside), true},
+		{"huge entry count", "image/jpeg", testJPEG(hugeCount), true},
+		{"jpeg cut in the exif", "image/jpeg", jpeg[:40], false},
+		{"jpeg cut in a header", "image/jpeg", jpeg[:5], false},
+		{"png cut in the exif", "image/png", png[:60], false},
+		{"empty", "image/jpeg", nil, false},
+		{"unsupported type", "image/gif", jpeg, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := memFile(bytes.Clone(tt.file))
+			scrubbed, err := ScrubGPS(f, tt.contentType)
+			if err != nil || scrubbed != tt.wantScrub {
+				t.Errorf("ScrubGPS = %v, %v; want %v", scrubbed, err, tt.wantScrub)
+			}
+			if len(f) != len(tt.file) {
+				t.Errorf("file changed size from %d to %d", len(tt.file), len(f))
+			}
+			if !tt.wantScrub && !bytes.Equal(f, tt.file) {
+				t.Error("file was changed")
+			}
+			if o := ImageOrientation(f, tt.contentType); o < 1 || o > 8 {
+				t.Errorf("orientation = %d", o)
+			}
+		})
+	}
+}
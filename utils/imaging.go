@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"image"
+	"image/draw"
+)
+
+// ToNRGBA copies an image into an NRGBA image with its origin at 0,0,
+// applying the EXIF orientation so it is the right way up
+func ToNRGBA(src image.Image, orientation int) *image.NRGBA {
+	bounds := src.Bounds()
+	flat := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), src, bounds.Min, draw.Src)
+	if orientation <= 1 || orientation > 8 {
+		return flat
+	}
+
+	w, h := bounds.Dx(), bounds.Dy()
+	// Orientations 5 to 8 swap the axes
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(out.Pix[out.PixOffset(dx, dy):out.PixOffset(dx, dy)+4], flat.Pix[flat.PixOffset(x, y):flat.PixOffset(x, y)+4])
+		}
+	}
+	return out
+}
+
+// FitSize scales width and height down so neither exceeds limit, keeping
+// the aspect ratio
+func FitSize(width, height, limit int) (int, int) {
+	if width <= limit && height <= limit {
+		return width, height
+	}
+	if width >= height {
+		return limit, max(1, height*limit/width)
+	}
+	return max(1, width*limit/height), limit
+}
+
+// Resize scales an image down to width by height, averaging the source
+// pixels that fall into each target pixel. Colours are weighted by alpha
+// so transparent pixels don't darken the edges.
+func Resize(src *image.NRGBA, width, height int) *image.NRGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	out := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, max((y+1)*sh/height, y*sh/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, max((x+1)*sw/width, x*sw/width+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[src.PixOffset(x0, sy) : src.PixOffset(x1-1, sy)+4]
+				for i := 0; i < len(row); i += 4 {
+					alpha := uint64(row[i+3])
+					r += uint64(row[i]) * alpha
+					g += uint64(row[i+1]) * alpha
+					b += uint64(row[i+2]) * alpha
+					a += alpha
+					n++
+				}
+			}
+
+			at := out.PixOffset(x, y)
+			if a > 0 {
+				out.Pix[at] = uint8(r / a)
+				out.Pix[at+1] = uint8(g / a)
+				out.Pix[at+2] = uint8(b / a)
+			}
+			out.Pix[at+3] = uint8(a / n)
+		}
+	}
+	return out
+}
+
+// IsOpaque reports whether every pixel is fully opaque
+func IsOpaque(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xFF {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// testImage builds an image from rows of pixels
+func testImage(rows ...[]color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x, c := range row {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestResize(t *testing.T) {
+	red := func(v uint8) color.NRGBA { return color.NRGBA{v, 0, 0, 0xFF} }
+	clear := color.NRGBA{}
+
+	tests := []struct {
+		name          string
+		src           *image.NRGBA
+		width, height int
+		want          *image.NRGBA
+	}{
+		{
+			"averages blocks",
+			testImage(
+				[]color.NRGBA{red(0), red(100), red(10), red(10)},
+				[]color.NRGBA{red(200), red(100), red(30), red(30)},
+			),
+			2, 1,
+			testImage([]color.NRGBA{red(100), red(20)}),
+		},
+		{
+			"weights colours by alpha",
+			testImage(
+				[]color.NRGBA{{0xFF, 0x80, 0, 0xFF}, clear},
+				[]color.NRGBA{clear, clear},
+			),
+			1, 1,
+			testImage([]color.NRGBA{{0xFF, 0x80, 0, 0x3F}}),
+		},
+		{
+			"fully transparent",
+			testImage([]color.NRGBA{clear, clear}),
+			1, 1,
+			testImage([]color.NRGBA{clear}),
+		},
+		{
+			"uneven blocks",
+			testImage([]color.NRGBA{red(30), red(60), red(90)}),
+			2, 1,
+			testImage([]color.NRGBA{red(30), red(75)}),
+		},
+		{
+			"same size",
+			testImage([]color.NRGBA{red(1), {2, 3, 4, 5}}),
+			2, 1,
+			testImage([]color.NRGBA{red(1), {2, 3, 4, 5}}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Resize(tt.src, tt.width, tt.height)
+			if got.Bounds() != tt.want.Bounds() || !reflect.DeepEqual(got.Pix, tt.want.Pix) {
+				t.Errorf("got %v %v, want %v %v", got.Bounds(), got.Pix, tt.want.Bounds(), tt.want.Pix)
+			}
+		})
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		width, height, limit int
+		wantW, wantH         int
+	}{
+		{100, 50, 32, 32, 16},
+		{50, 100, 32, 16, 32},
+		{32, 32, 32, 32, 32},
+		{10, 20, 32, 10, 20},
+		{1000, 1, 32, 32, 1},
+		{1, 1000, 32, 1, 32},
+	}
+
+	for _, tt := range tests {
+		if w, h := FitSize(tt.width, tt.height, tt.limit); w != tt.wantW || h != tt.wantH {
+			t.Errorf("FitSize(%d, %d, %d) = %d, %d; want %d, %d", tt.width, tt.height, tt.limit, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestToNRGBA(t *testing.T) {
+	a, b, c := color.NRGBA{1, 0, 0, 0xFF}, color.NRGBA{2, 0, 0, 0xFF}, color.NRGBA{3, 0, 0, 0xFF}
+	src := testImage([]color.NRGBA{a, b, c})
+
+	tests := []struct {
+		orientation int
+		want        *image.NRGBA
+	}{
+		{1, testImage([]color.NRGBA{a, b, c})},
+		{2, testImage([]color.NRGBA{c, b, a})},
+		{3, testImage([]color.NRGBA{c, b, a})},
+		// Rotated a quarter turn clockwise, the row becomes a column
+		{6, testImage([]color.NRGBA{a}, []color.NRGBA{b}, []color.NRGBA{c})},
+		{8, testImage([]color.NRGBA{c}, []color.NRGBA{b}, []color.NRGBA{a})},
+		{9, testImage([]color.NRGBA{a, b, c})},
+	}
+
+	for _, tt := range tests {
+		got := ToNRGBA(src, tt.orientation)
+		if got.Bounds() != tt.want.Bounds() || !reflect.DeepEqual(got.Pix, tt.want.Pix) {
+			t.Errorf("orientation %d: got %v %v, want %v %v", tt.orientation, got.Bounds(), got.Pix, tt.want.Bounds(), tt.want.Pix)
+		}
+	}
+}
+
+func TestIsOpaque(t *testing.T) {
+	if !IsOpaque(testImage([]color.NRGBA{{1, 2, 3, 0xFF}})) {
+		t.Error("opaque image reported transparent")
+	}
+	if IsOpaque(testImage([]color.NRGBA{{1, 2, 3, 0xFF}, {1, 2, 3, 0xFE}})) {
+		t.Error("translucent image reported opaque")
+	}
+}
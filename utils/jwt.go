@@ -3,40 +3,91 @@ package utils
 import (
 	"context"
 	"log"
-	"os"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
 )
 
-// jwt key used to create the signature for the JWT
-var jwtSecret = []byte(os.Getenv("JWT_KEY"))
-
+// Claims identify the user, and the login session the token was issued
+// for. The subject is the user ID and the ID (jti) is unique per token.
 type Claims struct {
-	Username string `json:"username"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
 
-// GenerateJwt generates a new JWT token
-func GenerateJwt(username string) (string, error) {
+// AuthConfig controls token lifetimes and how revoked tokens are tracked
+type AuthConfig struct {
+	// AccessTokenTTL is how long a JWT access token stays valid
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is how long a refresh token can be exchanged for new
+	// tokens. Every refresh starts a new lifetime, so a session only ends
+	// after this long without use.
+	RefreshTokenTTL time.Duration
+	// RevocationRefresh is how often the revocation cache is reloaded from
+	// the database, picking up logouts made through other servers
+	RevocationRefresh time.Duration
+	// SessionTouchInterval is how stale a session's last-seen time may get
+	// before a request updates it
+	SessionTouchInterval time.Duration
+
+	// JWTSecret is the legacy HS256 key. It signs tokens until a key is
+	// rotated in, and verifies tokens without a kid header until it's
+	// retired or unset.
+	JWTSecret []byte
+	// KeyEncryptionKey encrypts the rotated signing keys in the database
+	KeyEncryptionKey []byte
+	// KeyRefresh is how often the signing keys are reloaded from the
+	// database, picking up rotations
+	KeyRefresh time.Duration
+}
+
+// DefaultAuthConfig returns the settings used when none are configured
+func DefaultAuthConfig() AuthConfig {
+	return AuthConfig{
+		AccessTokenTTL:       15 * time.Minute,
+		RefreshTokenTTL:      30 * 24 * time.Hour,
+		RevocationRefresh:    30 * time.Second,
+		SessionTouchInterval: time.Minute,
+		KeyRefresh:           time.Minute,
+	}
+}
+
+// SessionChecker checks the login session of a token on every
+// authenticated request
+type SessionChecker interface {
+	// IsRevoked reports whether the token was revoked before it expired
+	IsRevoked(claims *Claims) bool
+	// Touch records that the token's session was just used
+	Touch(claims *Claims)
+}
+
+// GenerateJwt generates a new JWT token for the user's login session that
+// is valid for ttl
+func GenerateJwt(userID uint, username, sessionID string, ttl time.Duration) (string, error) {
+	now := time.Now()
 	claims := &Claims{
-		Username: username,
+		Username:  username,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Hour * 24).Unix(),
+			Id:        RandomID(),
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return currentKeys().Sign(claims)
 }
 
 // ParseJwt parses a JWT token
 func ParseJwt(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, currentKeys().Keyfunc)
 
 	if err != nil {
 		log.Printf("Error parsing JWT token: %v", err)
@@ -51,24 +102,10 @@ func ParseJwt(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-// RefreshJwt refreshes a JWT token
-func RefreshJwt(tokenString string) (string, error) {
-	claims, err := ParseJwt(tokenString)
-	if err != nil {
-		return "", err
-	}
-
-	claims.ExpiresAt = time.Now().Add(time.Hour * 24).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
-}
-
 // ExtractClaims extracts the claims from a JWT token
 func ExtractClaims(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	_, err := jwt.ParseWithClaims(tokenString, claims, currentKeys().Keyfunc)
 
 	if err != nil {
 		log.Printf("Error extracting claims from JWT token: %v", err)
@@ -84,10 +121,36 @@ func ValidateJwt(tokenString string) bool {
 	return err == nil
 }
 
+// BearerSubprotocol is the WebSocket subprotocol used by browsers to pass the
+// token, sent as "Sec-WebSocket-Protocol: bearer, <token>"
+const BearerSubprotocol = "bearer"
+
+// TokenFromRequest extracts the JWT token from the Authorization header, the
+// bearer WebSocket subprotocol or the token query parameter, in that order
+func TokenFromRequest(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		tokenStrings := strings.Split(authHeader, " ")
+		if len(tokenStrings) < 2 {
+			return ""
+		}
+		return tokenStrings[1]
+	}
+
+	protocols := websocket.Subprotocols(r)
+	if len(protocols) >= 2 && protocols[0] == BearerSubprotocol {
+		return protocols[1]
+	}
+
+	return r.URL.Query().Get("token")
+}
+
 // Define a custom type for the context key
 type contextKey string
 
-const usernameKey contextKey = "username"
+const (
+	usernameKey contextKey = "username"
+	claimsKey   contextKey = "claims"
+)
 
 // SetUserInContext sets the username in the request context
 func SetUserInContext(ctx context.Context, username string) context.Context {
@@ -100,6 +163,17 @@ func GetUserFromContext(ctx context.Context) (string, bool) {
 	return username, ok
 }
 
+// SetClaimsInContext sets the claims of the request's token in the context
+func SetClaimsInContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// GetClaimsFromContext gets the claims of the request's token from the context
+func GetClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok
+}
+
 // Define the User type
 type User struct {
 	Username string `json:"username"`
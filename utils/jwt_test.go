@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenFromRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		query  string
+		want   string
+	}{
+		{"authorization header", http.Header{"Authorization": {"Bearer abc"}}, "", "abc"},
+		{"header wins", http.Header{"Authorization": {"Bearer abc"}, "Sec-Websocket-Protocol": {"bearer, def"}}, "token=ghi", "abc"},
+		{"malformed header", http.Header{"Authorization": {"abc"}}, "token=ghi", ""},
+		{"subprotocol", http.Header{"Sec-Websocket-Protocol": {"bearer, def"}}, "token=ghi", "def"},
+		{"other subprotocol", http.Header{"Sec-Websocket-Protocol": {"chat, def"}}, "token=ghi", "ghi"},
+		{"query", nil, "token=ghi", "ghi"},
+		{"none", nil, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws?"+tt.query, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if got := TokenFromRequest(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
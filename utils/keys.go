@@ -0,0 +1,398 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Algorithms JWT tokens can be signed with
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// rsaKeyBits is the size of generated RSA keys
+const rsaKeyBits = 2048
+
+var (
+	ErrUnknownKey           = errors.New("token was signed with an unknown key")
+	ErrNoSigningKey         = errors.New("no JWT signing key is configured")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrNoKeyEncryptionKey   = errors.New("signing keys are encrypted with JWT_KEY_ENCRYPTION_KEY, which is not set")
+)
+
+// KeyEncryptionKeySize is the size, in bytes, of the AES-256 key that
+// signing keys are encrypted with in the database
+const KeyEncryptionKeySize = 32
+
+// sealedPrefix marks stored keys encrypted by SealSigningKey
+const sealedPrefix = "sealed:"
+
+// SigningMethodEdDSA signs tokens with Ed25519 keys (RFC 8037), which the
+// jwt package doesn't support itself
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(AlgEdDSA, func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return AlgEdDSA
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// SigningKey is a key tokens are signed or verified with, named in their
+// kid header. The legacy JWT_KEY secret has no kid and verifies tokens
+// issued without one.
+type SigningKey struct {
+	Kid       string
+	Algorithm string
+
+	// private is the HMAC secret, an *rsa.PrivateKey or an
+	// ed25519.PrivateKey, depending on the algorithm
+	private interface{}
+}
+
+// NewHMACKey returns an HS256 key for the secret
+func NewHMACKey(kid string, secret []byte) *SigningKey {
+	return &SigningKey{Kid: kid, Algorithm: AlgHS256, private: secret}
+}
+
+// GenerateSigningKey creates a random key for the algorithm and returns it
+// with its encoded form, which ParseSigningKey reads back
+func GenerateSigningKey(algorithm string) (*SigningKey, string, error) {
+	var private interface{}
+	var encoded string
+	switch algorithm {
+	case AlgHS256:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, "", err
+		}
+		private, encoded = secret, base64.StdEncoding.EncodeToString(secret)
+	case AlgRS256, AlgEdDSA:
+		var err error
+		if algorithm == AlgRS256 {
+			private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		} else {
+			_, private, err = ed25519.GenerateKey(rand.Reader)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, "", err
+		}
+		encoded = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	default:
+		return nil, "", fmt.Errorf("%w %q", ErrUnsupportedAlgorithm, algorithm)
+	}
+	return &SigningKey{Kid: RandomID(), Algorithm: algorithm, private: private}, encoded, nil
+}
+
+// ParseSigningKey decodes a stored key: a base64 secret for HS256, or a
+// PKCS #8 PEM private key otherwise
+func ParseSigningKey(kid, algorithm, encoded string) (*SigningKey, error) {
+	key := &SigningKey{Kid: kid, Algorithm: algorithm}
+	if algorithm == AlgHS256 {
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", kid, err)
+		}
+		key.private = secret
+		return key, nil
+	}
+
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, fmt.Errorf("key %s: no PEM block", kid)
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", kid, err)
+	}
+
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		if algorithm != AlgRS256 {
+			return nil, fmt.Errorf("key %s: an RSA key can't be used for %s", kid, algorithm)
+		}
+	case ed25519.PrivateKey:
+		if algorithm != AlgEdDSA {
+			return nil, fmt.Errorf("key %s: an Ed25519 key can't be used for %s", kid, algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("key %s: %w %T", kid, ErrUnsupportedAlgorithm, private)
+	}
+	key.private = private
+	return key, nil
+}
+
+// SealSigningKey encrypts an encoded key for storage with AES-GCM under the
+// key encryption key. The kid is authenticated along with it, so a sealed
+// key can't be moved to another row.
+func SealSigningKey(kek []byte, kid, encoded string) (string, error) {
+	if len(kek) == 0 {
+		return "", ErrNoKeyEncryptionKey
+	}
+	aead, err := newKeyCipher(kek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(encoded), []byte(kid))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenSigningKey decrypts a key sealed by SealSigningKey. Keys stored before
+// they were encrypted are returned as they are.
+func OpenSigningKey(kek []byte, kid, stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+	if len(kek) == 0 {
+		return "", fmt.Errorf("key %s: %w", kid, ErrNoKeyEncryptionKey)
+	}
+	aead, err := newKeyCipher(kek)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("key %s: malformed sealed key", kid)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	encoded, err := aead.Open(nil, nonce, ciphertext, []byte(kid))
+	if err != nil {
+		return "", fmt.Errorf("key %s: can't be decrypted with JWT_KEY_ENCRYPTION_KEY", kid)
+	}
+	return string(encoded), nil
+}
+
+// IsSealed reports whether a stored key is encrypted
+func IsSealed(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrefix)
+}
+
+// newKeyCipher returns the AES-GCM cipher of the key encryption key
+func newKeyCipher(kek []byte) (cipher.AEAD, error) {
+	if len(kek) != KeyEncryptionKeySize {
+		return nil, fmt.Errorf("the key encryption key must be %d bytes", KeyEncryptionKeySize)
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// method returns the signing method of the key's algorithm
+func (k *SigningKey) method() jwt.SigningMethod {
+	switch k.Algorithm {
+	case AlgRS256:
+		return jwt.SigningMethodRS256
+	case AlgEdDSA:
+		return SigningMethodEdDSA
+	}
+	return jwt.SigningMethodHS256
+}
+
+// public returns the key signatures are verified with: the secret itself
+// for HMAC keys
+func (k *SigningKey) public() interface{} {
+	switch private := k.private.(type) {
+	case *rsa.PrivateKey:
+		return &private.PublicKey
+	case ed25519.PrivateKey:
+		return private.Public()
+	}
+	return k.private
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519 curve and public key
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public half of an asymmetric key. HMAC keys are secret
+// and have none.
+func (k *SigningKey) JWK() (JWK, bool) {
+	jwk := JWK{Kid: k.Kid, Use: "sig", Alg: k.Algorithm}
+	switch private := k.private.(type) {
+	case *rsa.PrivateKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(private.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(private.E)).Bytes())
+		return jwk, true
+	case ed25519.PrivateKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(private.Public().(ed25519.PublicKey))
+		return jwk, true
+	}
+	return JWK{}, false
+}
+
+// KeyManager holds the keys tokens are signed and verified with. A single
+// key signs new tokens, and any of the keys verifies them, so tokens signed
+// before a rotation stay valid until their key is retired.
+type KeyManager struct {
+	mu      sync.RWMutex
+	keys    map[string]*SigningKey
+	signing *SigningKey
+}
+
+// NewKeyManager creates a manager without keys; SetKeys must be called
+// before it can sign
+func NewKeyManager() *KeyManager {
+	return &KeyManager{keys: make(map[string]*SigningKey)}
+}
+
+// SetKeys replaces the verification keys and the key that signs new tokens
+func (km *KeyManager) SetKeys(keys []*SigningKey, signing *SigningKey) {
+	byKid := make(map[string]*SigningKey, len(keys)+1)
+	for _, key := range keys {
+		byKid[key.Kid] = key
+	}
+	if signing != nil {
+		byKid[signing.Kid] = signing
+	}
+
+	km.mu.Lock()
+	km.keys, km.signing = byKid, signing
+	km.mu.Unlock()
+}
+
+// Sign signs the claims with the signing key, naming it in the kid header
+func (km *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	km.mu.RLock()
+	key := km.signing
+	km.mu.RUnlock()
+	if key == nil {
+		return "", ErrNoSigningKey
+	}
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	if key.Kid != "" {
+		token.Header["kid"] = key.Kid
+	}
+	return token.SignedString(key.private)
+}
+
+// Keyfunc picks the key a token is verified with from its kid header. The
+// token's algorithm must be the key's, so a public key can't be passed off
+// as an HMAC secret.
+func (km *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	km.mu.RLock()
+	key := km.keys[kid]
+	km.mu.RUnlock()
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("token algorithm %s doesn't match key %s", token.Method.Alg(), kid)
+	}
+	return key.public(), nil
+}
+
+// JWKS returns the public keys of the asymmetric keys, for other services
+// to verify tokens with
+func (km *KeyManager) JWKS() JWKSet {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range km.keys {
+		if jwk, ok := key.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+var (
+	keyManagerMu sync.RWMutex
+	keyManager   *KeyManager
+)
+
+// UseKeyManager makes GenerateJwt and ParseJwt use the manager's keys
+func UseKeyManager(km *KeyManager) {
+	keyManagerMu.Lock()
+	keyManager = km
+	keyManagerMu.Unlock()
+}
+
+// currentKeys returns the installed key manager, or an empty one that
+// can't sign or verify anything
+func currentKeys() *KeyManager {
+	keyManagerMu.RLock()
+	defer keyManagerMu.RUnlock()
+	if keyManager == nil {
+		return NewKeyManager()
+	}
+	return keyManager
+}
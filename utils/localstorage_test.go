@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLocalStorage(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(key string) string {
+		t.Helper()
+		body, err := storage.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer body.Close()
+		data, _ := io.ReadAll(body)
+		return string(data)
+	}
+
+	key := "sha256/ab/cd/abcd"
+	if exists, err := storage.Exists(ctx, key); err != nil || exists {
+		t.Fatalf("Exists() before Put = %v, %v", exists, err)
+	}
+	if err := storage.Put(ctx, key, strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := storage.Exists(ctx, key); !exists {
+		t.Error("object doesn't exist after Put")
+	}
+	if got := read(key); got != "hello" {
+		t.Errorf("Get() = %q, want %q", got, "hello")
+	}
+
+	// A short write leaves the stored object alone
+	if err := storage.Put(ctx, key, strings.NewReader("bye"), 5, "text/plain"); err == nil {
+		t.Error("Put() with a short body succeeded")
+	}
+	if got := read(key); got != "hello" {
+		t.Errorf("Get() after a failed Put = %q, want %q", got, "hello")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := storage.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := storage.Get(ctx, key); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Get() after Delete = %v, want %v", err, ErrObjectNotFound)
+	}
+
+	// Keys can't escape the root
+	for _, key := range []string{"", "/", "../secret", "a/../../b"} {
+		if err := storage.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultPageLimit is the page size used when the request has no limit
+	DefaultPageLimit = 50
+	// MaxPageLimit caps the limit a client can ask for
+	MaxPageLimit = 200
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a list ordered by (Timestamp, ID). Lists that
+// are only ordered by ID leave Timestamp zero.
+type Cursor struct {
+	Timestamp time.Time
+	ID        uint
+}
+
+// cursorPayload is the JSON hidden inside an encoded cursor
+type cursorPayload struct {
+	T  int64 `json:"t,omitempty"`
+	ID uint  `json:"id"`
+}
+
+// Encode returns the opaque form of the cursor handed to clients
+func (c Cursor) Encode() string {
+	payload := cursorPayload{ID: c.ID}
+	if !c.Timestamp.IsZero() {
+		payload.T = c.Timestamp.UnixNano()
+	}
+	data, _ := json.Marshal(payload)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses an opaque cursor
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var payload cursorPayload
+	if err := json.Unmarshal(data, &payload); err != nil || payload.ID == 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	cursor := &Cursor{ID: payload.ID}
+	if payload.T != 0 {
+		cursor.Timestamp = time.Unix(0, payload.T)
+	}
+	return cursor, nil
+}
+
+// PageParams are the pagination query parameters of a list request. Before
+// and After hold either an opaque cursor or a bare ID; Around is an ID to
+// centre the page on.
+type PageParams struct {
+	Before string
+	After  string
+	Around uint
+	Limit  int
+}
+
+// ParsePageParams reads before, after, around and limit from the query string
+func ParsePageParams(r *http.Request) (PageParams, error) {
+	query := r.URL.Query()
+	params := PageParams{
+		Before: query.Get("before"),
+		After:  query.Get("after"),
+		Limit:  DefaultPageLimit,
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return params, errors.New("limit must be a positive number")
+		}
+		params.Limit = n
+	}
+	if params.Limit > MaxPageLimit {
+		params.Limit = MaxPageLimit
+	}
+
+	if around := query.Get("around"); around != "" {
+		id, err := ConvertToUint(around)
+		if err != nil {
+			return params, errors.New("around must be a message ID")
+		}
+		params.Around = id
+	}
+
+	set := 0
+	for _, used := range []bool{params.Before != "", params.After != "", params.Around != 0} {
+		if used {
+			set++
+		}
+	}
+	if set > 1 {
+		return params, errors.New("only one of before, after and around can be used")
+	}
+
+	return params, nil
+}
+
+// IDFromCursorParam accepts either an opaque cursor or a bare ID and returns the ID
+func IDFromCursorParam(s string) (uint, error) {
+	if id, err := ConvertToUint(s); err == nil {
+		return id, nil
+	}
+
+	cursor, err := DecodeCursor(s)
+	if err != nil {
+		return 0, err
+	}
+	return cursor.ID, nil
+}
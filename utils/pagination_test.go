@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCursor(t *testing.T) {
+	for _, cursor := range []Cursor{
+		{Timestamp: time.Date(2024, 1, 1, 12, 0, 0, 123, time.UTC), ID: 7},
+		{ID: 42},
+	} {
+		got, err := DecodeCursor(cursor.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != cursor.ID || !got.Timestamp.Equal(cursor.Timestamp) {
+			t.Errorf("DecodeCursor(Encode(%+v)) = %+v", cursor, got)
+		}
+	}
+
+	for _, s := range []string{"", "not a cursor", Cursor{}.Encode()} {
+		if _, err := DecodeCursor(s); err != ErrInvalidCursor {
+			t.Errorf("DecodeCursor(%q) = %v, want ErrInvalidCursor", s, err)
+		}
+	}
+}
+
+func TestIDFromCursorParam(t *testing.T) {
+	tests := []struct {
+		param   string
+		want    uint
+		wantErr bool
+	}{
+		{"12", 12, false},
+		{Cursor{Timestamp: time.Now(), ID: 9}.Encode(), 9, false},
+		{"nope", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := IDFromCursorParam(tt.param)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("IDFromCursorParam(%q) = %d, %v; want %d, error %v", tt.param, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParsePageParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    PageParams
+		wantErr bool
+	}{
+		{"", PageParams{Limit: DefaultPageLimit}, false},
+		{"limit=10&before=abc", PageParams{Before: "abc", Limit: 10}, false},
+		{"after=5", PageParams{After: "5", Limit: DefaultPageLimit}, false},
+		{"around=3&limit=1000", PageParams{Around: 3, Limit: MaxPageLimit}, false},
+		{"limit=0", PageParams{}, true},
+		{"limit=x", PageParams{}, true},
+		{"around=x", PageParams{}, true},
+		{"before=1&after=2", PageParams{}, true},
+		{"after=1&around=2", PageParams{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParsePageParams(httptest.NewRequest("GET", "/?"+tt.query, nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePageParams(%q) error = %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParsePageParams(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ProtocolVersion is the version of the envelope protocol spoken over /ws
+const ProtocolVersion = 1
+
+// EventType identifies the kind of an envelope
+type EventType string
+
+const (
+	EventMessageSend     EventType = "message.send"
+	EventMessageNew      EventType = "message.new"
+	EventMessageAck      EventType = "message.ack"
+	EventMessageEdited   EventType = "message.edited"
+	EventMessageDeleted  EventType = "message.deleted"
+	EventThreadReply     EventType = "thread.reply"
+	EventReactionAdded   EventType = "reaction.added"
+	EventReactionRemoved EventType = "reaction.removed"
+	// EventAttachmentProcessed carries an attachment once its thumbnails
+	// and image metadata are ready
+	EventAttachmentProcessed EventType = "attachment.processed"
+	EventTyping              EventType = "typing"
+	EventPresence            EventType = "presence"
+	EventReceipt             EventType = "receipt"
+	EventError               EventType = "error"
+	// EventAuth carries a fresh access token for the connection, and
+	// EventAuthAck confirms it was accepted
+	EventAuth    EventType = "auth"
+	EventAuthAck EventType = "auth.ack"
+)
+
+// Envelope is the JSON frame exchanged over the WebSocket connection
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    EventType       `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Ts      int64           `json:"ts"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// MessageSendPayload is sent by a client to post a message to a user or
+// to a group
+type MessageSendPayload struct {
+	ReceiverID uint   `json:"receiver_id,omitempty"`
+	GroupID    uint   `json:"group_id,omitempty"`
+	Content    string `json:"content"`
+	ReplyToID  uint   `json:"reply_to_id,omitempty"`
+	// AttachmentIDs are uploads from POST /attachments to send along
+	AttachmentIDs []uint `json:"attachment_ids,omitempty"`
+}
+
+// MessageAckPayload confirms to the sender that a message was accepted.
+// RefID is the envelope ID of the message.send frame.
+type MessageAckPayload struct {
+	RefID     string    `json:"ref_id"`
+	MessageID uint      `json:"message_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Scopes of a message.deleted event
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+// MessageDeletedPayload tells clients to hide a message ("me") or to replace
+// it with a tombstone ("everyone")
+type MessageDeletedPayload struct {
+	MessageID uint   `json:"message_id"`
+	Scope     string `json:"scope"`
+	DeletedBy uint   `json:"deleted_by"`
+}
+
+// ThreadReplyPayload tells the participants of a thread about a new reply
+type ThreadReplyPayload struct {
+	RootID     uint        `json:"root_id"`
+	ReplyCount int64       `json:"reply_count"`
+	Message    interface{} `json:"message"`
+}
+
+// ReactionPayload tells the conversation that a user added or removed a
+// reaction on a message
+type ReactionPayload struct {
+	MessageID uint   `json:"message_id"`
+	UserID    uint   `json:"user_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// TypingPayload signals that a user started or stopped typing. Clients set
+// ReceiverID or GroupID, the server fills in UserID when relaying it.
+type TypingPayload struct {
+	UserID     uint `json:"user_id,omitempty"`
+	ReceiverID uint `json:"receiver_id,omitempty"`
+	GroupID    uint `json:"group_id,omitempty"`
+	Typing     bool `json:"typing"`
+}
+
+// PresencePayload asks for the presence of the given users
+type PresencePayload struct {
+	UserIDs []uint `json:"user_ids"`
+}
+
+// PresenceStatus reports whether a user is connected
+type PresenceStatus struct {
+	UserID uint `json:"user_id"`
+	Online bool `json:"online"`
+}
+
+// Receipt statuses
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// ReceiptPayload reports that a message reached or was read by its recipient.
+// Read receipts cover every message up to and including MessageID.
+type ReceiptPayload struct {
+	MessageID uint   `json:"message_id"`
+	Status    string `json:"status"`
+	UserID    uint   `json:"user_id,omitempty"`
+	GroupID   uint   `json:"group_id,omitempty"`
+}
+
+// AuthPayload is sent by a client to keep its connection open past the
+// expiry of the token it connected with. The token must be an access token
+// of the same session, usually the one a refresh just returned.
+type AuthPayload struct {
+	Token string `json:"token"`
+}
+
+// AuthAckPayload tells the client until when its connection stays open.
+// RefID is the envelope ID of the auth frame.
+type AuthAckPayload struct {
+	RefID     string    `json:"ref_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Machine-readable codes carried by error frames
+const (
+	ErrCodeBadFrame           = "bad_frame"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeUnauthorized       = "unauthorized"
+	ErrCodeInternal           = "internal_error"
+)
+
+// ErrorPayload is the payload of an error frame. RefID is the ID of the
+// envelope that caused the error, if any.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	RefID   string `json:"ref_id,omitempty"`
+}
+
+// ProtocolError is returned by handlers to reply with a specific error code
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NewProtocolError creates a new protocol error
+func NewProtocolError(code, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+// NewEnvelope builds an envelope of the given type with a fresh ID and timestamp
+func NewEnvelope(eventType EventType, payload interface{}) (*Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		Version: ProtocolVersion,
+		Type:    eventType,
+		ID:      RandomID(),
+		Ts:      time.Now().UnixMilli(),
+		Payload: data,
+	}, nil
+}
+
+// EncodeEvent builds an envelope and encodes it for the wire
+func EncodeEvent(eventType EventType, payload interface{}) ([]byte, error) {
+	env, err := NewEnvelope(eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// DecodePayload unmarshals the envelope payload into v
+func (e *Envelope) DecodePayload(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return NewProtocolError(ErrCodeInvalidPayload, "payload is required")
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return NewProtocolError(ErrCodeInvalidPayload, err.Error())
+	}
+	return nil
+}
+
+// HandlerFunc handles a single envelope received from a client
+type HandlerFunc func(client *Client, env *Envelope) error
+
+// Dispatcher decodes incoming frames and routes them to the handler
+// registered for their type
+type Dispatcher struct {
+	handlers map[EventType]HandlerFunc
+	mu       sync.RWMutex
+}
+
+// NewDispatcher creates an empty dispatcher
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{handlers: make(map[EventType]HandlerFunc)}
+}
+
+// Handle registers the handler for an event type
+func (d *Dispatcher) Handle(eventType EventType, handler HandlerFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[eventType] = handler
+}
+
+// Dispatch decodes and validates a raw frame, then runs its handler. Any
+// failure is reported back to the client as an error frame.
+func (d *Dispatcher) Dispatch(client *Client, msg []byte) {
+	var env Envelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		client.SendError("", NewProtocolError(ErrCodeBadFrame, "frame is not a valid envelope"))
+		return
+	}
+
+	if env.Version != ProtocolVersion {
+		client.SendError(env.ID, NewProtocolError(ErrCodeUnsupportedVersion,
+			fmt.Sprintf("protocol version %d is not supported", env.Version)))
+		return
+	}
+
+	d.mu.RLock()
+	handler, ok := d.handlers[env.Type]
+	d.mu.RUnlock()
+	if !ok {
+		client.SendError(env.ID, NewProtocolError(ErrCodeUnknownType,
+			fmt.Sprintf("event type %q is not supported", env.Type)))
+		return
+	}
+
+	if err := handler(client, &env); err != nil {
+		client.SendError(env.ID, err)
+	}
+}
+
+// SendEvent queues an event for this connection only
+func (c *Client) SendEvent(eventType EventType, payload interface{}) {
+	data, err := EncodeEvent(eventType, payload)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", eventType, err)
+		return
+	}
+	c.hub.Broadcast(&Delivery{Client: c, Data: data})
+}
+
+// SendError replies to the client with an error frame
+func (c *Client) SendError(refID string, err error) {
+	var protoErr *ProtocolError
+	if !errors.As(err, &protoErr) {
+		log.Printf("Error handling frame from client %s: %v", c.ID, err)
+		protoErr = NewProtocolError(ErrCodeInternal, "internal server error")
+	}
+
+	c.SendEvent(EventError, ErrorPayload{
+		Code:    protoErr.Code,
+		Message: protoErr.Message,
+		RefID:   refID,
+	})
+}
+
+// SendEvent encodes an event and delivers it to every connection of the users
+func (h *Hub) SendEvent(eventType EventType, payload interface{}, userIDs ...uint) {
+	data, err := EncodeEvent(eventType, payload)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", eventType, err)
+		return
+	}
+	h.SendToUsers(data, userIDs...)
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// readEnvelope waits for the next frame queued for the client
+func readEnvelope(t *testing.T, client *Client) Envelope {
+	t.Helper()
+	select {
+	case data, ok := <-client.Send:
+		if !ok {
+			t.Fatal("send queue was closed")
+		}
+		var env Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Fatalf("frame is not an envelope: %v", err)
+		}
+		return env
+	case <-time.After(time.Second):
+		t.Fatal("no frame was sent")
+	}
+	return Envelope{}
+}
+
+// expectNoFrame fails if a frame is queued for the client shortly
+func expectNoFrame(t *testing.T, client *Client) {
+	t.Helper()
+	select {
+	case data := <-client.Send:
+		t.Fatalf("unexpected frame %s", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	hub := newTestHub()
+
+	var handled *Envelope
+	hub.Handle("test.ok", func(client *Client, env *Envelope) error {
+		handled = env
+		return nil
+	})
+	hub.Handle("test.protocol", func(client *Client, env *Envelope) error {
+		var payload struct{ Name string }
+		return env.DecodePayload(&payload)
+	})
+	hub.Handle("test.forbidden", func(client *Client, env *Envelope) error {
+		return NewProtocolError(ErrCodeForbidden, "not yours")
+	})
+	hub.Handle("test.internal", func(client *Client, env *Envelope) error {
+		return errors.New("database is down")
+	})
+
+	tests := []struct {
+		name      string
+		frame     string
+		wantCode  string
+		wantRefID string
+	}{
+		{"handled", `{"v":1,"type":"test.ok","id":"a1","payload":{}}`, "", ""},
+		{"not json", `{"v":1,`, ErrCodeBadFrame, ""},
+		{"not an object", `[1,2]`, ErrCodeBadFrame, ""},
+		{"missing version", `{"type":"test.ok","id":"a2"}`, ErrCodeUnsupportedVersion, "a2"},
+		{"future version", `{"v":2,"type":"test.ok","id":"a3"}`, ErrCodeUnsupportedVersion, "a3"},
+		{"unknown type", `{"v":1,"type":"test.nope","id":"a4"}`, ErrCodeUnknownType, "a4"},
+		{"missing payload", `{"v":1,"type":"test.protocol","id":"a5"}`, ErrCodeInvalidPayload, "a5"},
+		{"malformed payload", `{"v":1,"type":"test.protocol","id":"a6","payload":{"Name":1}}`, ErrCodeInvalidPayload, "a6"},
+		{"protocol error", `{"v":1,"type":"test.forbidden","id":"a7"}`, ErrCodeForbidden, "a7"},
+		{"internal error", `{"v":1,"type":"test.internal","id":"a8"}`, ErrCodeInternal, "a8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, hub, 1)
+			handled = nil
+			hub.dispatcher.Dispatch(client, []byte(tt.frame))
+
+			if tt.wantCode == "" {
+				if handled == nil || handled.ID != "a1" {
+					t.Fatalf("handler got %+v, want the a1 envelope", handled)
+				}
+				expectNoFrame(t, client)
+				return
+			}
+
+			env := readEnvelope(t, client)
+			if env.Type != EventError {
+				t.Fatalf("got a %s frame, want an error", env.Type)
+			}
+			var payload ErrorPayload
+			if err := json.Unmarshal(env.Payload, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.Code != tt.wantCode || payload.RefID != tt.wantRefID {
+				t.Errorf("got code %q ref %q, want %q ref %q", payload.Code, payload.RefID, tt.wantCode, tt.wantRefID)
+			}
+			if tt.wantCode == ErrCodeInternal && payload.Message != "internal server error" {
+				t.Errorf("internal error leaked %q", payload.Message)
+			}
+		})
+	}
+}
+
+func TestEncodeEvent(t *testing.T) {
+	data, err := EncodeEvent(EventTyping, TypingPayload{UserID: 7, Typing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Version != ProtocolVersion || env.Type != EventTyping || env.ID == "" || env.Ts == 0 {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+
+	var payload TypingPayload
+	if err := env.DecodePayload(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.UserID != 7 || !payload.Typing {
+		t.Errorf("payload round-tripped to %+v", payload)
+	}
+}
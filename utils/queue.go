@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// SlowConsumerPolicy decides what happens when a client's send queue is full
+type SlowConsumerPolicy string
+
+const (
+	// PolicyDropOldest discards the oldest queued frame to make room
+	PolicyDropOldest SlowConsumerPolicy = "drop_oldest"
+	// PolicyDisconnect closes the connection with CloseSlowConsumer
+	PolicyDisconnect SlowConsumerPolicy = "disconnect"
+	// PolicySpill moves the frame, and those still queued, to the session's
+	// offline queue and closes the connection with CloseSlowConsumer. They
+	// are replayed on the session's next connection. Connections without a
+	// session are disconnected as with PolicyDisconnect.
+	PolicySpill SlowConsumerPolicy = "spill"
+)
+
+// CloseSlowConsumer is the close code sent to clients dropped for not
+// draining their send queue
+const CloseSlowConsumer = 4008
+
+// ParseSlowConsumerPolicy validates a policy name
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	switch policy := SlowConsumerPolicy(name); policy {
+	case PolicyDropOldest, PolicyDisconnect, PolicySpill:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown slow consumer policy %q", name)
+}
+
+// QueueStats counts how often the slow-consumer policy kicked in
+type QueueStats struct {
+	Dropped      uint64 `json:"dropped"`
+	Disconnected uint64 `json:"disconnected"`
+	Spilled      uint64 `json:"spilled"`
+}
+
+// queueCounters is the live, concurrently updated form of QueueStats
+type queueCounters struct {
+	dropped      atomic.Uint64
+	disconnected atomic.Uint64
+	spilled      atomic.Uint64
+}
+
+func (c *queueCounters) snapshot() QueueStats {
+	return QueueStats{
+		Dropped:      c.dropped.Load(),
+		Disconnected: c.disconnected.Load(),
+		Spilled:      c.spilled.Load(),
+	}
+}
+
+// OfflineQueue holds frames for login sessions until their next connection
+type OfflineQueue interface {
+	Push(sessionID string, data []byte)
+	Drain(sessionID string) [][]byte
+}
+
+// MemoryOfflineQueue is an in-memory OfflineQueue keeping at most limit
+// frames per session; older frames are discarded first
+type MemoryOfflineQueue struct {
+	limit  int
+	frames map[string][][]byte
+	mu     sync.Mutex
+}
+
+// NewMemoryOfflineQueue creates an in-memory offline queue
+func NewMemoryOfflineQueue(limit int) *MemoryOfflineQueue {
+	return &MemoryOfflineQueue{limit: limit, frames: make(map[string][][]byte)}
+}
+
+// Push appends a frame to the session's queue
+func (q *MemoryOfflineQueue) Push(sessionID string, data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	frames := append(q.frames[sessionID], data)
+	if len(frames) > q.limit {
+		frames = frames[len(frames)-q.limit:]
+	}
+	q.frames[sessionID] = frames
+}
+
+// Drain removes and returns the session's queued frames
+func (q *MemoryOfflineQueue) Drain(sessionID string) [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	frames := q.frames[sessionID]
+	delete(q.frames, sessionID)
+	return frames
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newPolicyHub starts a hub with small send queues and the given
+// slow-consumer policy
+func newPolicyHub(size int, policy SlowConsumerPolicy) *Hub {
+	config := DefaultWebSocketConfig()
+	config.SendQueueSize = size
+	config.SlowConsumerPolicy = policy
+	hub := NewHub(config)
+	go hub.Run()
+	return hub
+}
+
+// newSessionClient registers a connection of the user's login session
+func newSessionClient(hub *Hub, userID uint, sessionID string) *Client {
+	client := NewClient(nil, RandomID(), userID, "user")
+	client.SessionID = sessionID
+	hub.Register(client)
+	return client
+}
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    SlowConsumerPolicy
+		wantErr bool
+	}{
+		{"drop_oldest", PolicyDropOldest, false},
+		{"disconnect", PolicyDisconnect, false},
+		{"spill", PolicySpill, false},
+		{"", "", true},
+		{"Spill", "", true},
+		{"block", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSlowConsumerPolicy(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSlowConsumerPolicy(%q) = %q, %v; want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMemoryOfflineQueue(t *testing.T) {
+	q := NewMemoryOfflineQueue(2)
+	q.Push("s1", []byte("1"))
+	q.Push("s1", []byte("2"))
+	q.Push("s1", []byte("3"))
+	q.Push("s2", []byte("x"))
+
+	if got := q.Drain("s1"); !reflect.DeepEqual(got, [][]byte{[]byte("2"), []byte("3")}) {
+		t.Errorf("Drain(s1) = %q, want the 2 newest frames", got)
+	}
+	if got := q.Drain("s1"); len(got) != 0 {
+		t.Errorf("second Drain(s1) = %q, want nothing", got)
+	}
+	if got := q.Drain("s2"); !reflect.DeepEqual(got, [][]byte{[]byte("x")}) {
+		t.Errorf("Drain(s2) = %q, want x", got)
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	tests := []struct {
+		policy     SlowConsumerPolicy
+		wantQueued []string
+		wantClosed bool
+		wantStats  QueueStats
+		// wantReplay is what the session's next connection gets
+		wantReplay []string
+	}{
+		{
+			policy:     PolicyDropOldest,
+			wantQueued: []string{"2", "3"},
+			wantStats:  QueueStats{Dropped: 1},
+		},
+		{
+			policy:     PolicyDisconnect,
+			wantQueued: []string{"1", "2"},
+			wantClosed: true,
+			wantStats:  QueueStats{Disconnected: 1},
+		},
+		{
+			policy:     PolicySpill,
+			wantClosed: true,
+			wantStats:  QueueStats{Spilled: 1},
+			wantReplay: []string{"1", "2", "3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			hub := newPolicyHub(2, tt.policy)
+			slow := newSessionClient(hub, 1, "phone")
+			laptop := newSessionClient(hub, 1, "laptop")
+
+			// The laptop keeps up, the phone doesn't read at all
+			for _, frame := range []string{"1", "2", "3"} {
+				hub.SendToUsers([]byte(frame), 1)
+				flush(hub)
+				if got, _ := queued(laptop); !reflect.DeepEqual(got, []string{frame}) {
+					t.Fatalf("laptop got %q, want %q", got, frame)
+				}
+			}
+
+			got, closed := queued(slow)
+			if !reflect.DeepEqual(got, tt.wantQueued) || closed != tt.wantClosed {
+				t.Errorf("slow client got %q, closed %v; want %q, closed %v", got, closed, tt.wantQueued, tt.wantClosed)
+			}
+			if closed && slow.closeCode != CloseSlowConsumer {
+				t.Errorf("slow client was closed with %d, want %d", slow.closeCode, CloseSlowConsumer)
+			}
+			if stats := hub.Stats(); stats != tt.wantStats {
+				t.Errorf("stats = %+v, want %+v", stats, tt.wantStats)
+			}
+
+			// Other sessions already got the frames live, so only the
+			// session's next connection gets what was missed, once
+			tablet := newSessionClient(hub, 1, "tablet")
+			flush(hub)
+			if got, _ := queued(tablet); len(got) != 0 {
+				t.Errorf("another session got %q replayed", got)
+			}
+			again := newSessionClient(hub, 1, "phone")
+			flush(hub)
+			if got, _ := queued(again); !reflect.DeepEqual(got, tt.wantReplay) {
+				t.Errorf("reconnected client got %q, want %q", got, tt.wantReplay)
+			}
+			other := newSessionClient(hub, 1, "phone")
+			flush(hub)
+			if got, _ := queued(other); len(got) != 0 {
+				t.Errorf("a later connection got %q replayed", got)
+			}
+			if stats := hub.Stats(); stats != tt.wantStats {
+				t.Errorf("stats after the replay = %+v, want %+v", stats, tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestSpillWithoutSession(t *testing.T) {
+	hub := newPolicyHub(1, PolicySpill)
+	slow := newTestClient(t, hub, 1)
+	for _, frame := range []string{"1", "2"} {
+		hub.SendToUsers([]byte(frame), 1)
+	}
+	flush(hub)
+
+	// With no session to replay to, the client is simply dropped
+	if got, closed := queued(slow); !reflect.DeepEqual(got, []string{"1"}) || !closed {
+		t.Errorf("slow client got %q, closed %v; want [1], closed", got, closed)
+	}
+	if stats := hub.Stats(); stats != (QueueStats{Disconnected: 1}) {
+		t.Errorf("stats = %+v, want one disconnect", stats)
+	}
+	again := newTestClient(t, hub, 1)
+	flush(hub)
+	if got, _ := queued(again); len(got) != 0 {
+		t.Errorf("reconnected client got %q replayed", got)
+	}
+}
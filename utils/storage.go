@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// Storage keeps uploaded files as opaque objects addressed by key
+type Storage interface {
+	// Put stores size bytes read from r under key, replacing any object
+	// already there
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key, or returns ErrObjectNotFound
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Exists reports whether an object is stored under key
+	Exists(ctx context.Context, key string) (bool, error)
+	// Delete removes the object under key; deleting a missing object is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// S3Config locates an S3-compatible bucket. Requests use path-style URLs
+// (endpoint/bucket/key), which MinIO and most stand-ins expect.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// StorageConfig selects the storage backend and the limits of uploads
+type StorageConfig struct {
+	// Driver is "local" or "s3"
+	Driver string
+	// LocalDir is the directory the local driver writes to
+	LocalDir string
+	S3       S3Config
+
+	// MaxUploadSize and MaxAvatarSize are in bytes
+	MaxUploadSize int64
+	MaxAvatarSize int64
+
+	// URLSecret signs download links and URLTTL is how long they stay valid
+	URLSecret []byte
+	URLTTL    time.Duration
+}
+
+// DefaultStorageConfig returns the settings used when none are configured.
+// URLSecret has no default.
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Driver:        "local",
+		LocalDir:      "uploads",
+		S3:            S3Config{Region: "us-east-1"},
+		MaxUploadSize: 25 << 20,
+		MaxAvatarSize: 5 << 20,
+		URLTTL:        15 * time.Minute,
+	}
+}
+
+// MediaConfig controls the processing of uploaded images
+type MediaConfig struct {
+	// Workers process images in the background, taking jobs from a queue
+	// of QueueSize
+	Workers   int
+	QueueSize int
+	// ThumbnailSizes are the longest sides, in pixels, of the thumbnails
+	ThumbnailSizes []int
+	// MaxPixels skips images too large to decode safely
+	MaxPixels int
+}
+
+// DefaultMediaConfig returns the settings used when none are configured
+func DefaultMediaConfig() MediaConfig {
+	return MediaConfig{
+		Workers:        2,
+		QueueSize:      256,
+		ThumbnailSizes: []int{160, 480, 1080},
+		MaxPixels:      50_000_000,
+	}
+}
+
+// NewStorage creates the storage backend selected by the config
+func NewStorage(cfg StorageConfig) (Storage, error) {
+	switch cfg.Driver {
+	case "local":
+		return NewLocalStorage(cfg.LocalDir)
+	case "s3":
+		return NewS3Storage(cfg.S3)
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", cfg.Driver)
+}
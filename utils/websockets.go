@@ -1,22 +1,323 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// WebSocketConfig controls heartbeats and limits of WebSocket connections
+type WebSocketConfig struct {
+	// PingInterval is how often the server pings each client. It must be
+	// shorter than PongWait.
+	PingInterval time.Duration
+	// PongWait is how long a connection may stay silent before it's reaped
+	PongWait time.Duration
+	// WriteTimeout bounds a single write to the connection
+	WriteTimeout time.Duration
+	// MaxMessageSize is the largest frame, in bytes, accepted from a client
+	MaxMessageSize int64
+	// SendQueueSize is the number of outgoing frames buffered per client
+	SendQueueSize int
+	// SlowConsumerPolicy applies when a client's send queue is full
+	SlowConsumerPolicy SlowConsumerPolicy
+	// OfflineQueueSize is the number of spilled frames kept per session
+	OfflineQueueSize int
+}
+
+// DefaultWebSocketConfig returns the settings used when none are configured
+func DefaultWebSocketConfig() WebSocketConfig {
+	return WebSocketConfig{
+		PingInterval:   54 * time.Second,
+		PongWait:       60 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxMessageSize: 64 * 1024,
+
+		SendQueueSize:      256,
+		SlowConsumerPolicy: PolicyDisconnect,
+		OfflineQueueSize:   1000,
+	}
+}
+
 var upgrader = websocket.Upgrader{
+	// Echo the bearer subprotocol back so browsers accept the handshake
+	Subprotocols: []string{BearerSubprotocol},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
+// Client is a single WebSocket connection owned by an authenticated user.
+// A user may have several clients at once (e.g. phone and laptop).
 type Client struct {
-	ID   string
-	Conn *websocket.Conn
-	Send chan []byte
+	ID       string
+	UserID   uint
+	Username string
+	Conn     *websocket.Conn
+	Send     chan []byte
+
+	// SessionID is the login session the connection's token was issued for
+	SessionID string
+
+	// issuedAt and expiresAt are those of the connection's latest token,
+	// which an auth frame may replace before it expires
+	tokenMu   sync.Mutex
+	issuedAt  time.Time
+	expiresAt time.Time
+
+	hub *Hub
+
+	// closeCode and closeReason are sent when the hub drops the client
+	closeCode   int
+	closeReason string
+}
+
+// CloseRevoked is the close code sent to clients whose session was logged out
+const CloseRevoked = 4001
+
+// Delivery is a frame addressed to every connection of the given users, or
+// to a single connection when Client is set
+type Delivery struct {
+	UserIDs []uint
+	Client  *Client
+	Data    []byte
+
+	// Except skips a single connection, usually the one the frame came from
+	Except *Client
+}
+
+// Hub keeps track of the connected clients, keyed by user ID, and routes
+// frames to the connections of their recipients
+type Hub struct {
+	clients    map[uint]map[*Client]bool
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan *Delivery
+	mu         sync.RWMutex
+
+	dispatcher *Dispatcher
+	config     WebSocketConfig
+	offline    OfflineQueue
+	counters   queueCounters
+}
+
+// NewHub creates a new hub. Run must be started before clients connect.
+func NewHub(config WebSocketConfig) *Hub {
+	return &Hub{
+		config:     config,
+		offline:    NewMemoryOfflineQueue(config.OfflineQueueSize),
+		clients:    make(map[uint]map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan *Delivery),
+		dispatcher: NewDispatcher(),
+	}
+}
+
+// Handle registers the handler for frames of the given type
+func (h *Hub) Handle(eventType EventType, handler HandlerFunc) {
+	h.dispatcher.Handle(eventType, handler)
+}
+
+// Run processes registrations and deliveries until the program exits
+func (h *Hub) Run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.mu.Lock()
+			if h.clients[client.UserID] == nil {
+				h.clients[client.UserID] = make(map[*Client]bool)
+			}
+			h.clients[client.UserID][client] = true
+			h.mu.Unlock()
+
+		case client := <-h.unregister:
+			h.mu.Lock()
+			h.remove(client)
+			h.mu.Unlock()
+
+		case delivery := <-h.broadcast:
+			h.mu.Lock()
+			if delivery.Client != nil {
+				if h.clients[delivery.Client.UserID][delivery.Client] {
+					h.send(delivery.Client, delivery.Data)
+				}
+			}
+			for _, userID := range delivery.UserIDs {
+				for client := range h.clients[userID] {
+					if client == delivery.Except {
+						continue
+					}
+					h.send(client, delivery.Data)
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// send queues data on a registered client, applying the slow-consumer
+// policy when its queue is full. The caller must hold h.mu.
+func (h *Hub) send(client *Client, data []byte) {
+	select {
+	case client.Send <- data:
+		return
+	default:
+	}
+
+	switch h.config.SlowConsumerPolicy {
+	case PolicyDropOldest:
+		// Only the hub writes to the queue, so after discarding the oldest
+		// frame there is room for this one
+		select {
+		case <-client.Send:
+		default:
+		}
+		select {
+		case client.Send <- data:
+		default:
+		}
+		h.counters.dropped.Add(1)
+
+	case PolicySpill:
+		if client.SessionID == "" {
+			// Nothing ties a later connection to this one, so there is no
+			// one to replay the frames to
+			log.Printf("Dropping client %s of user %d: send queue is full", client.ID, client.UserID)
+			h.disconnect(client, CloseSlowConsumer, "slow consumer")
+			h.counters.disconnected.Add(1)
+			return
+		}
+		// Move everything the writer hasn't picked up yet to the session's
+		// offline queue, in order, and drop the client so it reconnects and
+		// gets them back instead of silently missing them. Other sessions of
+		// the user already got these frames on their own connections.
+		for pending := true; pending; {
+			select {
+			case queued := <-client.Send:
+				h.offline.Push(client.SessionID, queued)
+			default:
+				pending = false
+			}
+		}
+		h.offline.Push(client.SessionID, data)
+		log.Printf("Spilling client %s of user %d: send queue is full", client.ID, client.UserID)
+		h.disconnect(client, CloseSlowConsumer, "slow consumer")
+		h.counters.spilled.Add(1)
+
+	default:
+		log.Printf("Dropping client %s of user %d: send queue is full", client.ID, client.UserID)
+		h.disconnect(client, CloseSlowConsumer, "slow consumer")
+		h.counters.disconnected.Add(1)
+	}
+}
+
+// disconnect removes a client and closes its connection with the given
+// close code. The caller must hold h.mu.
+func (h *Hub) disconnect(client *Client, code int, reason string) {
+	client.closeCode = code
+	client.closeReason = reason
+	h.remove(client)
+}
+
+// remove deletes a client from the registry and closes its send queue.
+// The caller must hold h.mu.
+func (h *Hub) remove(client *Client) {
+	conns, ok := h.clients[client.UserID]
+	if !ok || !conns[client] {
+		return
+	}
+	delete(conns, client)
+	close(client.Send)
+	if len(conns) == 0 {
+		delete(h.clients, client.UserID)
+	}
+}
+
+// Register allocates the client's send queue and adds it to the hub. Frames
+// spilled when an earlier connection of the session was dropped for being
+// too slow are queued first, with room for them on top of the usual size so
+// the replay can't overflow the queue again.
+func (h *Hub) Register(client *Client) {
+	client.hub = h
+	var spilled [][]byte
+	if client.SessionID != "" {
+		spilled = h.offline.Drain(client.SessionID)
+	}
+	client.Send = make(chan []byte, h.config.SendQueueSize+len(spilled))
+	for _, data := range spilled {
+		client.Send <- data
+	}
+	h.register <- client
+}
+
+// Unregister removes a client from the hub and closes its send queue
+func (h *Hub) Unregister(client *Client) {
+	h.unregister <- client
+}
+
+// Broadcast queues a delivery for routing
+func (h *Hub) Broadcast(delivery *Delivery) {
+	h.broadcast <- delivery
+}
+
+// SendToUsers delivers data to every connection of the given users
+func (h *Hub) SendToUsers(data []byte, userIDs ...uint) {
+	h.Broadcast(&Delivery{UserIDs: userIDs, Data: data})
+}
+
+// DisconnectSession closes the user's connections opened with tokens of
+// the session
+func (h *Hub) DisconnectSession(userID uint, sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients[userID] {
+		if client.SessionID == sessionID {
+			h.disconnect(client, CloseRevoked, "session revoked")
+		}
+	}
+}
+
+// DisconnectUser closes every connection of the user
+func (h *Hub) DisconnectUser(userID uint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients[userID] {
+		h.disconnect(client, CloseRevoked, "session revoked")
+	}
+}
+
+// DisconnectRevoked closes every connection whose token isRevoked reports
+// as revoked. It lets logouts made through other servers reach the
+// connections of this one.
+func (h *Hub) DisconnectRevoked(isRevoked func(client *Client) bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, conns := range h.clients {
+		for client := range conns {
+			if isRevoked(client) {
+				h.disconnect(client, CloseRevoked, "session revoked")
+			}
+		}
+	}
+}
+
+// Stats returns how often the slow-consumer policy was applied
+func (h *Hub) Stats() QueueStats {
+	return h.counters.snapshot()
+}
+
+// IsOnline reports whether the user has at least one open connection
+func (h *Hub) IsOnline(userID uint) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[userID]) > 0
 }
 
 // UpgradeConnection upgrades the HTTP connection to a WebSocket connection
@@ -29,47 +330,125 @@ func UpgradeConnection(w http.ResponseWriter, r *http.Request) (*websocket.Conn,
 	return conn, nil
 }
 
-// HandleMessages handles incoming messages from the WebSocket connection
+// HandleMessages reads envelopes from the WebSocket connection and hands
+// them to the hub's dispatcher. The connection is unregistered as soon as a
+// read fails or no pong arrives within the configured wait.
 func HandleMessages(client *Client) {
 	defer func() {
+		client.hub.Unregister(client)
 		client.Conn.Close()
 	}()
 
+	config := client.hub.config
+	client.Conn.SetReadLimit(config.MaxMessageSize)
+	client.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	client.Conn.SetPongHandler(func(string) error {
+		return client.Conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	})
+
 	for {
 		_, msg, err := client.Conn.ReadMessage()
 		if err != nil {
-			fmt.Println("Error reading message: ", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Error reading message: %v", err)
+			}
 			break
 		}
 
-		client.Send <- msg
+		client.hub.dispatcher.Dispatch(client, msg)
 	}
 }
 
-// WriteMessage writes a message to the WebSocket connection
+// WriteMessage writes queued frames to the WebSocket connection, pings the
+// client periodically and closes the connection once the client's latest
+// token expires or a write fails
 func WriteMessage(client *Client) {
+	config := client.hub.config
+	ticker := time.NewTicker(config.PingInterval)
+	defer ticker.Stop()
+
+	var timer *time.Timer
+	var expired <-chan time.Time
+	if _, expiresAt := client.TokenTimes(); !expiresAt.IsZero() {
+		timer = time.NewTimer(time.Until(expiresAt))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
 	defer func() {
+		// Closing the connection also stops the reader, which unregisters the client
 		client.Conn.Close()
 	}()
 
 	for {
-		msg, ok := <-client.Send
-		if !ok {
+		select {
+		case msg, ok := <-client.Send:
+			client.Conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+			if !ok {
+				// The hub closed the queue; tell the client why if it dropped us
+				closeMessage := []byte{}
+				if client.closeCode != 0 {
+					closeMessage = websocket.FormatCloseMessage(client.closeCode, client.closeReason)
+				}
+				client.Conn.WriteMessage(websocket.CloseMessage, closeMessage)
+				return
+			}
+			err := client.Conn.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				log.Printf("Error writing message: %v", err)
+				return
+			}
+		case <-ticker.C:
+			client.Conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+			if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-expired:
+			// The client may have sent a newer token meanwhile
+			if _, expiresAt := client.TokenTimes(); time.Now().Before(expiresAt) {
+				timer.Reset(time.Until(expiresAt))
+				continue
+			}
+			client.Conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+			client.Conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired"))
 			return
 		}
-		err := client.Conn.WriteMessage(websocket.TextMessage, msg)
-		if err != nil {
-			fmt.Println("Error writing message: ", err)
-			break
-		}
 	}
 }
 
-// NewClient creates a new client
-func NewClient(conn *websocket.Conn, id string) *Client {
+// SetToken records the issue and expiry time of the token the client is
+// authenticated with. The connection is closed once it expires, unless a
+// newer token is set first.
+func (c *Client) SetToken(issuedAt, expiresAt time.Time) {
+	c.tokenMu.Lock()
+	c.issuedAt, c.expiresAt = issuedAt, expiresAt
+	c.tokenMu.Unlock()
+}
+
+// TokenTimes returns the issue and expiry time of the client's latest token
+func (c *Client) TokenTimes() (issuedAt, expiresAt time.Time) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.issuedAt, c.expiresAt
+}
+
+// NewClient creates a new client for the given user. Its send queue is
+// allocated when it's registered with a hub.
+func NewClient(conn *websocket.Conn, id string, userID uint, username string) *Client {
 	return &Client{
-		ID:   id,
-		Conn: conn,
-		Send: make(chan []byte),
+		ID:       id,
+		UserID:   userID,
+		Username: username,
+		Conn:     conn,
+	}
+}
+
+// RandomID returns a random hex identifier for connections and events
+func RandomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%p", b)
 	}
+	return hex.EncodeToString(b)
 }
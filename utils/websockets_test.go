@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestHub starts a hub
+func newTestHub() *Hub {
+	hub := NewHub(DefaultWebSocketConfig())
+	go hub.Run()
+	return hub
+}
+
+// newTestClient registers a client without a connection with the hub;
+// frames sent to it are read from its Send queue
+func newTestClient(t *testing.T, hub *Hub, userID uint) *Client {
+	t.Helper()
+	client := NewClient(nil, RandomID(), userID, "user")
+	hub.Register(client)
+	return client
+}
+
+// flush waits until the hub has handled everything sent to it before
+func flush(hub *Hub) {
+	// Run handles one request at a time, so once it takes this delivery
+	// the earlier ones are done
+	hub.Broadcast(&Delivery{})
+}
+
+// queued drains the frames currently queued for the client, reporting
+// whether the queue was closed
+func queued(client *Client) ([]string, bool) {
+	var frames []string
+	for {
+		select {
+		case data, ok := <-client.Send:
+			if !ok {
+				return frames, true
+			}
+			frames = append(frames, string(data))
+		default:
+			return frames, false
+		}
+	}
+}
+
+func TestHubRouting(t *testing.T) {
+	hub := newTestHub()
+	phone := newTestClient(t, hub, 1)
+	laptop := newTestClient(t, hub, 1)
+	other := newTestClient(t, hub, 2)
+
+	hub.SendToUsers([]byte("a"), 1)
+	hub.Broadcast(&Delivery{UserIDs: []uint{1, 2}, Data: []byte("b"), Except: phone})
+	hub.SendToUsers([]byte("c"), 3)
+	flush(hub)
+
+	tests := []struct {
+		name   string
+		client *Client
+		want   []string
+	}{
+		{"phone", phone, []string{"a"}},
+		{"laptop", laptop, []string{"a", "b"}},
+		{"other user", other, []string{"b"}},
+	}
+	for _, tt := range tests {
+		got, closed := queued(tt.client)
+		if closed || len(got) != len(tt.want) {
+			t.Errorf("%s got %q, closed %v; want %q", tt.name, got, closed, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s got %q, want %q", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestHubUnregister(t *testing.T) {
+	hub := newTestHub()
+	phone := newTestClient(t, hub, 1)
+	laptop := newTestClient(t, hub, 1)
+	flush(hub)
+	if !hub.IsOnline(1) || hub.IsOnline(2) {
+		t.Fatal("IsOnline doesn't match the registered clients")
+	}
+
+	hub.Unregister(phone)
+	flush(hub)
+	if _, closed := queued(phone); !closed {
+		t.Error("the unregistered client's queue is still open")
+	}
+	if !hub.IsOnline(1) {
+		t.Error("the user went offline with a connection left")
+	}
+
+	// Unregistering twice is harmless
+	hub.Unregister(phone)
+	hub.Unregister(laptop)
+	flush(hub)
+	if hub.IsOnline(1) {
+		t.Error("the user is online without connections")
+	}
+}
+
+func TestHubDropsFullClients(t *testing.T) {
+	hub := newTestHub()
+	size := DefaultWebSocketConfig().SendQueueSize
+	slow := newTestClient(t, hub, 1)
+	fast := newTestClient(t, hub, 1)
+
+	for i := 0; i <= size; i++ {
+		hub.SendToUsers([]byte("x"), 1)
+		flush(hub)
+		queued(fast)
+	}
+
+	got, closed := queued(slow)
+	if !closed || len(got) != size {
+		t.Errorf("slow client got %d frames, closed %v; want %d and closed", len(got), closed, size)
+	}
+	if _, closed := queued(fast); closed {
+		t.Error("the client keeping up was dropped")
+	}
+}
+
+// serveTestClient starts a server that registers every connection as a
+// client of user 1 with the hub and dials it. prepare runs once the client
+// is registered, before its reader and writer start.
+func serveTestClient(t *testing.T, hub *Hub, prepare func(*Client)) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := UpgradeConnection(w, r)
+		if err != nil {
+			return
+		}
+		client := NewClient(conn, RandomID(), 1, "user")
+		hub.Register(client)
+		if prepare != nil {
+			prepare(client)
+		}
+		go HandleMessages(client)
+		go WriteMessage(client)
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitOffline waits until user 1 has no connection left
+func waitOffline(hub *Hub, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !hub.IsOnline(1) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestWriteMessageClosesOnTokenExpiry(t *testing.T) {
+	conn := serveTestClient(t, newTestHub(), func(client *Client) {
+		client.SetToken(time.Now(), time.Now().Add(50*time.Millisecond))
+		client.Send <- []byte("hello")
+	})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("got %q, %v; want the queued frame", data, err)
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("got %v, want a policy violation close", err)
+	}
+}
+
+// testHeartbeatConfig pings every 20ms and reaps connections silent for 60ms
+func testHeartbeatConfig() WebSocketConfig {
+	config := DefaultWebSocketConfig()
+	config.PingInterval = 20 * time.Millisecond
+	config.PongWait = 60 * time.Millisecond
+	return config
+}
+
+func TestHeartbeatKeepsAnsweringClients(t *testing.T) {
+	hub := NewHub(testHeartbeatConfig())
+	go hub.Run()
+	conn := serveTestClient(t, hub, nil)
+
+	pings := make(chan struct{}, 100)
+	conn.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	// Reading processes the pings, which the handler answers
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	if !hub.IsOnline(1) {
+		t.Fatal("a client answering pings was reaped")
+	}
+	if len(pings) < 3 {
+		t.Errorf("got %d pings in 300ms, want one every 20ms", len(pings))
+	}
+}
+
+func TestHeartbeatReapsSilentClients(t *testing.T) {
+	hub := NewHub(testHeartbeatConfig())
+	go hub.Run()
+	// The connection is never read, so pings go unanswered
+	serveTestClient(t, hub, nil)
+
+	if !waitOffline(hub, time.Second) {
+		t.Fatal("a client not answering pings is still registered")
+	}
+}
+
+func TestReadLimitClosesConnection(t *testing.T) {
+	config := DefaultWebSocketConfig()
+	config.MaxMessageSize = 16
+	hub := NewHub(config)
+	go hub.Run()
+	conn := serveTestClient(t, hub, nil)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 64))); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("got %v, want a message too big close", err)
+	}
+	if !waitOffline(hub, time.Second) {
+		t.Error("the client sending an oversized frame is still registered")
+	}
+}